@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// sdListenFDsStart is the first file descriptor passed by systemd socket
+// activation; stdin, stdout and stderr come before it
+const sdListenFDsStart = 3
+
+// systemdListener returns the listening socket passed by systemd socket
+// activation, or nil if the process wasn't socket activated. Only the first
+// socket is used. The LISTEN_* variables are cleared so child processes
+// don't mistake the socket for their own.
+func systemdListener() (net.Listener, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	return inheritedListener(pid, fds, os.Getpid(), sdListenFDsStart)
+}
+
+// inheritedListener implements systemdListener for the given LISTEN_PID and
+// LISTEN_FDS values, the current process ID and the first passed descriptor
+func inheritedListener(pid, fds string, self int, firstFD uintptr) (net.Listener, error) {
+	if pid == "" || fds == "" {
+		return nil, nil
+	}
+	if p, err := strconv.Atoi(pid); err != nil || p != self {
+		return nil, nil // Meant for another process
+	}
+
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	if n > 1 {
+		logger.Warn("Socket activation passed several sockets, only the first is used", "sockets", n)
+	}
+
+	f := os.NewFile(firstFD, "LISTEN_FD_"+strconv.Itoa(int(firstFD)))
+	defer f.Close() // FileListener works on a duplicate
+
+	listener, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to use socket passed by systemd: %w", err)
+	}
+	return listener, nil
+}
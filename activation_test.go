@@ -0,0 +1,81 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestInheritedListener(t *testing.T) {
+	original, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer original.Close()
+
+	// Stands in for the descriptor systemd passes as fd 3. It is owned,
+	// and closed, by inheritedListener.
+	f, err := original.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("Failed to get listener file: %v", err)
+	}
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatalf("Failed to duplicate listener: %v", err)
+	}
+
+	listener, err := inheritedListener("1234", "1", 1234, uintptr(fd))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if listener == nil {
+		t.Fatal("Expected an inherited listener")
+	}
+	defer listener.Close()
+	if listener.Addr().String() != original.Addr().String() {
+		t.Errorf("Expected %s, got %s", original.Addr(), listener.Addr())
+	}
+
+	// The inherited listener accepts connections made to the original address
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.Close()
+		}
+		accepted <- err
+	}()
+	conn, err := net.Dial("tcp", original.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	conn.Close()
+	if err := <-accepted; err != nil {
+		t.Errorf("Failed to accept: %v", err)
+	}
+}
+
+func TestInheritedListenerNotActivated(t *testing.T) {
+	tests := []struct {
+		name, pid, fds string
+	}{
+		{"No environment", "", ""},
+		{"Other process", "999", "1"},
+		{"No sockets", "1234", "0"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			listener, err := inheritedListener(test.pid, test.fds, 1234, sdListenFDsStart)
+			if listener != nil || err != nil {
+				t.Errorf("Expected no listener and no error, got %v and %v", listener, err)
+			}
+		})
+	}
+
+	if _, err := inheritedListener("1234", "many", 1234, sdListenFDsStart); err == nil {
+		t.Error("Expected an error for invalid LISTEN_FDS")
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/alecthomas/kong"
+)
+
+// configEnvPrefix prefixes the environment variables that set flags, e.g.
+// CLAMDPROXY_BACKEND for --backend
+const configEnvPrefix = "CLAMDPROXY"
+
+// cliOptions configures flag resolution: explicit flags win over environment
+// variables, which win over the --config file, which wins over defaults
+func cliOptions() []kong.Option {
+	return []kong.Option{
+		kong.DefaultEnvars(configEnvPrefix),
+		kong.Configuration(jsonConfig),
+		kong.Vars{"version": versionString()},
+	}
+}
+
+// jsonConfig loads a --config file whose keys are flag names, with dashes
+// written as underscores. Kong lets resolvers override environment variables,
+// so keys whose flag is also set in the environment are skipped to keep the
+// environment in charge.
+func jsonConfig(r io.Reader) (kong.Resolver, error) {
+	resolver, err := kong.JSON(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return kong.ResolverFunc(func(ctx *kong.Context, parent *kong.Path, flag *kong.Flag) (any, error) {
+		for _, env := range flag.Envs {
+			if _, ok := os.LookupEnv(env); ok {
+				return nil, nil
+			}
+		}
+		return resolver.Resolve(ctx, parent, flag)
+	}), nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/alecthomas/kong"
+)
+
+// configTarget mirrors a few cli fields to exercise flag resolution
+type configTarget struct {
+	Config   kong.ConfigFlag `name:"config" type:"existingfile"`
+	Listen   string          `name:"listen" default:"127.0.0.1:3310"`
+	Backend  []string        `name:"backend" default:"127.0.0.1:3311"`
+	LogLevel string          `name:"log-level" default:"warn"`
+}
+
+func parseConfigTarget(t *testing.T, args ...string) configTarget {
+	t.Helper()
+
+	var target configTarget
+	parser, err := kong.New(&target, cliOptions()...)
+	if err != nil {
+		t.Fatalf("Failed to build parser: %v", err)
+	}
+	if _, err := parser.Parse(args); err != nil {
+		t.Fatalf("Failed to parse %v: %v", args, err)
+	}
+	return target
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clamdproxy.json")
+	config := `{"listen": "0.0.0.0:3310", "backend": ["10.0.0.1:3310", "10.0.0.2:3310"], "log_level": "info"}`
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Defaults", func(t *testing.T) {
+		got := parseConfigTarget(t)
+		if got.Listen != "127.0.0.1:3310" || got.LogLevel != "warn" {
+			t.Errorf("Expected defaults, got %+v", got)
+		}
+	})
+
+	t.Run("Config file over defaults", func(t *testing.T) {
+		got := parseConfigTarget(t, "--config", path)
+		if got.Listen != "0.0.0.0:3310" || got.LogLevel != "info" {
+			t.Errorf("Expected values from the config file, got %+v", got)
+		}
+		if !reflect.DeepEqual(got.Backend, []string{"10.0.0.1:3310", "10.0.0.2:3310"}) {
+			t.Errorf("Expected backends from the config file, got %v", got.Backend)
+		}
+	})
+
+	t.Run("Environment over config file", func(t *testing.T) {
+		t.Setenv("CLAMDPROXY_LOG_LEVEL", "debug")
+		t.Setenv("CLAMDPROXY_BACKEND", "10.0.0.3:3310,10.0.0.4:3310")
+
+		got := parseConfigTarget(t, "--config", path)
+		if got.LogLevel != "debug" || got.Listen != "0.0.0.0:3310" {
+			t.Errorf("Expected the environment to override the file, got %+v", got)
+		}
+		if !reflect.DeepEqual(got.Backend, []string{"10.0.0.3:3310", "10.0.0.4:3310"}) {
+			t.Errorf("Expected backends from the environment, got %v", got.Backend)
+		}
+	})
+
+	t.Run("Flags over environment", func(t *testing.T) {
+		t.Setenv("CLAMDPROXY_LOG_LEVEL", "debug")
+
+		got := parseConfigTarget(t, "--config", path, "--log-level", "error")
+		if got.LogLevel != "error" {
+			t.Errorf("Expected the flag to win, got %q", got.LogLevel)
+		}
+	})
+}
@@ -0,0 +1,154 @@
+// Package transcript implements a simple binary format for recording the
+// bytes exchanged on a single clamd connection, so that a session can be
+// replayed later with its original timing.
+//
+// A transcript starts with a fixed header followed by a sequence of records.
+// Each record is a direction byte, the offset from the start of the session
+// in nanoseconds (8 bytes, big-endian), the payload length (4 bytes,
+// big-endian) and the payload itself.
+package transcript
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// header identifies a transcript file and its format version
+const header = "CLAMDTX1"
+
+// maxRecordSize bounds a single record so a corrupt file can't force a huge allocation
+const maxRecordSize = 64 * 1024 * 1024
+
+// Direction tells which side of the connection sent a record's payload
+type Direction byte
+
+const (
+	// ClientToServer marks bytes sent by the client
+	ClientToServer Direction = 'C'
+	// ServerToClient marks bytes sent back to the client
+	ServerToClient Direction = 'S'
+)
+
+func (d Direction) String() string {
+	switch d {
+	case ClientToServer:
+		return "client->server"
+	case ServerToClient:
+		return "server->client"
+	default:
+		return fmt.Sprintf("Direction(%d)", byte(d))
+	}
+}
+
+// Record is a single chunk of data observed on the connection
+type Record struct {
+	Direction Direction
+	Offset    time.Duration // Time since the start of the session
+	Data      []byte
+}
+
+// Writer appends records to a transcript. It is safe for concurrent use,
+// so both directions of a connection can share one Writer.
+type Writer struct {
+	mu    sync.Mutex
+	w     io.Writer
+	start time.Time
+}
+
+// NewWriter writes the transcript header to w and returns a Writer whose
+// record offsets are measured from now.
+func NewWriter(w io.Writer) (*Writer, error) {
+	if _, err := io.WriteString(w, header); err != nil {
+		return nil, fmt.Errorf("failed to write transcript header: %w", err)
+	}
+	return &Writer{w: w, start: time.Now()}, nil
+}
+
+// Write records data sent in the given direction, stamped with the current time
+func (tw *Writer) Write(dir Direction, data []byte) error {
+	return tw.WriteRecord(Record{
+		Direction: dir,
+		Offset:    time.Since(tw.start),
+		Data:      data,
+	})
+}
+
+// WriteRecord appends a fully specified record to the transcript
+func (tw *Writer) WriteRecord(rec Record) error {
+	if len(rec.Data) > maxRecordSize {
+		return fmt.Errorf("record of %d bytes exceeds maximum of %d", len(rec.Data), maxRecordSize)
+	}
+
+	var hdr [13]byte
+	hdr[0] = byte(rec.Direction)
+	binary.BigEndian.PutUint64(hdr[1:9], uint64(rec.Offset))
+	binary.BigEndian.PutUint32(hdr[9:13], uint32(len(rec.Data)))
+
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if _, err := tw.w.Write(hdr[:]); err != nil {
+		return fmt.Errorf("failed to write record header: %w", err)
+	}
+	if _, err := tw.w.Write(rec.Data); err != nil {
+		return fmt.Errorf("failed to write record data: %w", err)
+	}
+	return nil
+}
+
+// Reader reads records from a transcript
+type Reader struct {
+	r *bufio.Reader
+}
+
+// NewReader validates the transcript header and returns a Reader positioned
+// at the first record.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+
+	var hdr [len(header)]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, fmt.Errorf("failed to read transcript header: %w", err)
+	}
+	if string(hdr[:]) != header {
+		return nil, errors.New("not a clamdproxy transcript")
+	}
+	return &Reader{r: br}, nil
+}
+
+// Next returns the next record, or io.EOF once the transcript is exhausted
+func (tr *Reader) Next() (Record, error) {
+	var hdr [13]byte
+	if _, err := io.ReadFull(tr.r, hdr[:]); err != nil {
+		if err == io.EOF {
+			return Record{}, io.EOF
+		}
+		return Record{}, fmt.Errorf("failed to read record header: %w", err)
+	}
+
+	dir := Direction(hdr[0])
+	if dir != ClientToServer && dir != ServerToClient {
+		return Record{}, fmt.Errorf("invalid record direction %q", hdr[0])
+	}
+
+	size := binary.BigEndian.Uint32(hdr[9:13])
+	if size > maxRecordSize {
+		return Record{}, fmt.Errorf("record of %d bytes exceeds maximum of %d", size, maxRecordSize)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(tr.r, data); err != nil {
+		return Record{}, fmt.Errorf("failed to read record data: %w", err)
+	}
+
+	return Record{
+		Direction: dir,
+		Offset:    time.Duration(binary.BigEndian.Uint64(hdr[1:9])),
+		Data:      data,
+	}, nil
+}
@@ -0,0 +1,72 @@
+package transcript
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoundTrip(t *testing.T) {
+	records := []Record{
+		{Direction: ClientToServer, Offset: 0, Data: []byte("zPING\x00")},
+		{Direction: ServerToClient, Offset: 3 * time.Millisecond, Data: []byte("PONG\x00")},
+		{Direction: ClientToServer, Offset: 2 * time.Second, Data: []byte{}},
+	}
+
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	for _, rec := range records {
+		if err := w.WriteRecord(rec); err != nil {
+			t.Fatalf("Failed to write record: %v", err)
+		}
+	}
+
+	r, err := NewReader(&buf)
+	if err != nil {
+		t.Fatalf("Failed to create reader: %v", err)
+	}
+	for i, want := range records {
+		got, err := r.Next()
+		if err != nil {
+			t.Fatalf("Record %d: unexpected error: %v", i, err)
+		}
+		if got.Direction != want.Direction || got.Offset != want.Offset || !bytes.Equal(got.Data, want.Data) {
+			t.Errorf("Record %d: expected %+v, got %+v", i, want, got)
+		}
+	}
+
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("Expected io.EOF after last record, got %v", err)
+	}
+}
+
+func TestNewReaderRejectsInvalidHeader(t *testing.T) {
+	if _, err := NewReader(strings.NewReader("NOTATRANSCRIPT")); err == nil {
+		t.Errorf("Expected an error for an invalid header")
+	}
+}
+
+func TestNextRejectsTruncatedRecord(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	if err := w.Write(ClientToServer, []byte("nVERSION\n")); err != nil {
+		t.Fatalf("Failed to write record: %v", err)
+	}
+
+	truncated := buf.Bytes()[:buf.Len()-3]
+	r, err := NewReader(bytes.NewReader(truncated))
+	if err != nil {
+		t.Fatalf("Failed to create reader: %v", err)
+	}
+	if _, err := r.Next(); err == nil || err == io.EOF {
+		t.Errorf("Expected a truncation error, got %v", err)
+	}
+}
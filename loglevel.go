@@ -0,0 +1,23 @@
+package main
+
+import "log/slog"
+
+// logLevel is the level of the logger built by getLogger. Unlike a level
+// baked into the handler it can be changed while the proxy runs, see
+// watchLogLevel.
+var logLevel = new(slog.LevelVar)
+
+// nextLogLevel returns the level SIGUSR1 switches to from level: one step more
+// verbose, wrapping around from debug to error
+func nextLogLevel(level slog.Level) slog.Level {
+	switch {
+	case level > slog.LevelWarn:
+		return slog.LevelWarn
+	case level > slog.LevelInfo:
+		return slog.LevelInfo
+	case level > slog.LevelDebug:
+		return slog.LevelDebug
+	default:
+		return slog.LevelError
+	}
+}
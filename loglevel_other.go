@@ -0,0 +1,6 @@
+//go:build windows || plan9
+
+package main
+
+// watchLogLevel does nothing: there is no SIGUSR1 on this platform
+func watchLogLevel() {}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestNextLogLevel(t *testing.T) {
+	level := slog.LevelWarn
+	var got []string
+	for range 4 {
+		level = nextLogLevel(level)
+		got = append(got, level.String())
+	}
+	if want := "INFO DEBUG ERROR WARN"; strings.Join(got, " ") != want {
+		t.Errorf("levels = %q, want %q", strings.Join(got, " "), want)
+	}
+}
+
+func TestLogLevelChange(t *testing.T) {
+	saved := logLevel.Level()
+	t.Cleanup(func() { logLevel.Set(saved) })
+
+	var buf bytes.Buffer
+	logLevel.Set(slog.LevelWarn)
+	log := slog.New(newLogHandler(&buf, "text"))
+
+	log.Debug("Before")
+	logLevel.Set(slog.LevelDebug)
+	log.Debug("During")
+	logLevel.Set(slog.LevelInfo)
+	log.Debug("After")
+
+	if out := buf.String(); strings.Contains(out, "Before") || !strings.Contains(out, "During") || strings.Contains(out, "After") {
+		t.Errorf("got %q, want only the debug message logged at debug level", out)
+	}
+}
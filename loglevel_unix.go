@@ -0,0 +1,25 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchLogLevel makes SIGUSR1 switch the log level to the next one, so debug
+// logs can be turned on and off again without a restart
+func watchLogLevel() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		for range signals {
+			level := nextLogLevel(logLevel.Level())
+			logLevel.Set(level)
+			// Logged at the new level so the change is always visible
+			logger.Log(context.Background(), level, "Log level changed", "level", level.String())
+		}
+	}()
+}
@@ -0,0 +1,34 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// watchOnce starts a single SIGUSR1 watcher however often the test runs, as
+// every further one would switch the level once more
+var watchOnce sync.Once
+
+func TestWatchLogLevel(t *testing.T) {
+	saved := logLevel.Level()
+	t.Cleanup(func() { logLevel.Set(saved) })
+
+	logLevel.Set(slog.LevelInfo)
+	watchOnce.Do(watchLogLevel)
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for logLevel.Level() != slog.LevelDebug {
+		if time.Now().After(deadline) {
+			t.Fatalf("level = %v after SIGUSR1, want DEBUG", logLevel.Level())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
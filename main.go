@@ -1,128 +1,139 @@
 // Package main implements a proxy server for ClamAV's clamd daemon
 // that filters unsafe commands and forwards safe ones to the backend.
+// The proxy itself lives in package proxy; this is its command line.
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/alecthomas/kong"
+	"github.com/miklosn/clamdproxy/proxy"
+	"io"
 	"log/slog"
-	"net"
-	"net/http"
-	_ "net/http/pprof" // Register pprof handlers
 	"os"
 	"strings"
 )
 
-
 // CLI configuration structure for Kong
 var cli struct {
-	Listen    string `name:"listen" help:"Address to listen on" default:"127.0.0.1:3310"`
-	Backend   string `name:"backend" help:"Address of the backend clamd server" default:"127.0.0.1:3311"`
-	LogLevel  string `name:"log-level" help:"Log level (debug, info, warn, error)" default:"warn" enum:"debug,info,warn,error"`
-	PprofAddr string `name:"pprof" help:"Address for pprof HTTP server (disabled if empty)" default:""`
+	Version    kong.VersionFlag `name:"version" help:"Print version information and exit" env:"-"`
+	ConfigFile kong.ConfigFlag  `name:"config" help:"JSON file with flag values, keyed by flag name (e.g. {\"log_level\": \"info\"})" type:"existingfile" placeholder:"FILE"`
+
+	Serve struct{} `cmd:"" default:"1" help:"Run the proxy (the default)"`
+	Check struct{} `cmd:"" help:"Validate the --whitelist file and print the commands it allows, without starting the proxy"`
+
+	LogLevel       string `name:"log-level" help:"Log level (debug, info, warn, error)" default:"warn" enum:"debug,info,warn,error"`
+	LogFormat      string `name:"log-format" help:"Log output format (text, json)" default:"text" enum:"text,json"`
+	LogOutput      string `name:"log-output" help:"Where to write logs (stdout, stderr, syslog)" default:"stdout" enum:"stdout,stderr,syslog"`
+	SyslogFacility string `name:"syslog-facility" help:"Syslog facility used with --log-output=syslog (e.g. daemon, local0)" default:"daemon"`
+	SyslogTag      string `name:"syslog-tag" help:"Syslog tag used with --log-output=syslog" default:"clamdproxy"`
+
+	Proxy proxy.Config `embed:""`
 }
 
-// Global logger used throughout the code
-var logger *slog.Logger
+// Logger of the command itself; the proxy is given the same one
+var logger = slog.Default()
 
-// getLogger creates and returns a logger with the specified log level
-func getLogger(logLevel string) *slog.Logger {
-	var level slog.Level
-	switch strings.ToLower(logLevel) {
+// getLogger creates and returns a logger with the specified log level, output
+// format (text or json) and destination (stdout, stderr or syslog). Syslog uses
+// the facility and tag from --syslog-facility and --syslog-tag. The level is
+// kept in logLevel, so it can be changed later.
+func getLogger(level, logFormat, logOutput string) (*slog.Logger, error) {
+	switch strings.ToLower(level) {
 	case "debug":
-		level = slog.LevelDebug
+		logLevel.Set(slog.LevelDebug)
 	case "info":
-		level = slog.LevelInfo
+		logLevel.Set(slog.LevelInfo)
 	case "warn":
-		level = slog.LevelWarn
+		logLevel.Set(slog.LevelWarn)
 	case "error":
-		level = slog.LevelError
+		logLevel.Set(slog.LevelError)
 	default:
-		level = slog.LevelWarn
+		logLevel.Set(slog.LevelWarn)
 	}
 
-	logHandler := slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
-		Level: level,
-	})
-	return slog.New(logHandler)
+	logFormat = strings.ToLower(logFormat)
+
+	var out io.Writer
+	switch strings.ToLower(logOutput) {
+	case "", "stdout":
+		out = os.Stdout
+	case "stderr":
+		out = os.Stderr
+	case "syslog":
+		w, err := openSyslog(cli.SyslogFacility, cli.SyslogTag)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open syslog: %w", err)
+		}
+		return slog.New(newSyslogHandler(w, logFormat, logLevel)), nil
+	default:
+		return nil, fmt.Errorf("unknown log output %q", logOutput)
+	}
+	return slog.New(newLogHandler(out, logFormat)), nil
+}
+
+// newLogHandler returns a text or json handler writing to out at logLevel
+func newLogHandler(out io.Writer, logFormat string) slog.Handler {
+	options := &slog.HandlerOptions{
+		Level: logLevel,
+	}
+	if logFormat == "json" {
+		return slog.NewJSONHandler(out, options)
+	}
+	return slog.NewTextHandler(out, options)
 }
 
 func main() {
 	// Parse command line arguments with Kong
-	ctx := kong.Parse(&cli)
-	_ = ctx // You can use ctx for subcommands if needed in the future
+	ctx := kong.Parse(&cli, cliOptions()...)
+	if ctx.Command() == "check" {
+		os.Exit(proxy.CheckWhitelist(os.Stdout, cli.Proxy.Whitelist))
+	}
 
 	// Configure logger with parsed arguments
-	logger = getLogger(cli.LogLevel)
-	slog.SetDefault(logger)
-
-	logger.Warn("Starting clamdproxy",
-		"listen", &cli.Listen,
-		"backend", &cli.Backend)
-
-	// Start pprof server if enabled
-	if cli.PprofAddr != "" {
-		go func() {
-			logger.Info("Starting pprof server",
-				"addr", &cli.PprofAddr,
-				"url", fmt.Sprintf("http://%s/debug/pprof/", cli.PprofAddr))
-			if err := http.ListenAndServe(cli.PprofAddr, nil); err != nil {
-				logger.Error("Failed to start pprof server", "error", err)
-			}
-		}()
+	var err error
+	logger, err = getLogger(cli.LogLevel, cli.LogFormat, cli.LogOutput)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "clamdproxy: %v\n", err)
+		os.Exit(1)
 	}
+	slog.SetDefault(logger)
+	watchLogLevel()
 
-	listener, err := net.Listen("tcp", cli.Listen)
+	cli.Proxy.Logger = logger
+	cli.Proxy.Version = versionString()
+	p, err := proxy.New(cli.Proxy)
 	if err != nil {
-		logger.Error("Failed to listen", "addr", cli.Listen, "error", err)
+		logger.Error("Invalid configuration", "error", err)
 		os.Exit(1)
 	}
-	defer func() {
-		if err := listener.Close(); err != nil {
-			logger.Error("Failed to close listener", "error", err)
-		}
-	}()
-
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			logger.Error("Error accepting connection", "error", err)
-			continue
-		}
-		go handleConnection(conn)
+	if cli.Proxy.Whitelist != "" {
+		watchWhitelistReload(p)
 	}
-}
 
-// handleConnection manages a client connection by establishing a backend connection
-// and setting up bidirectional proxying between them
-func handleConnection(clientConn net.Conn) {
-	defer func() {
-		if err := clientConn.Close(); err != nil {
-			logger.Error("Failed to close client connection", "error", err)
-		}
+	// Stop accepting on SIGINT or SIGTERM
+	serveCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-notifyShutdown()
+		cancel()
 	}()
-	clientAddr := clientConn.RemoteAddr()
 
-	logger.Info("Connection established", "client", &clientAddr)
-
-	backendConn, err := net.Dial("tcp", cli.Backend)
+	// Under systemd socket activation the listening socket is inherited,
+	// otherwise one is bound to each --listen address
+	listener, err := systemdListener()
 	if err != nil {
-		logger.Error("Failed to connect to backend",
-			"backend", &cli.Backend,
-			"client", &clientAddr,
-			"error", err)
-		return
+		logger.Error("Failed to listen", "error", err)
+		os.Exit(1)
+	}
+	if listener != nil {
+		logger.Info("Using the socket passed by systemd", "addr", listener.Addr().String())
+		err = p.Serve(serveCtx, listener)
+	} else {
+		err = p.ListenAndServe(serveCtx)
+	}
+	if err != nil {
+		logger.Error("Proxy failed", "error", err)
+		os.Exit(1)
 	}
-	defer func() {
-		if err := backendConn.Close(); err != nil {
-			logger.Error("Failed to close backend connection", "error", err)
-		}
-	}()
-
-	logger.Info("Connected to backend", "backend", &cli.Backend, "client", &clientAddr)
-
-	proxy := NewClamdProxy(clientConn, backendConn)
-	proxy.Start()
-
-	logger.Info("Connection closed", "client", &clientAddr)
 }
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Backoff between failed accepts, doubled on each consecutive failure
+const (
+	acceptRetryMinDelay = 5 * time.Millisecond
+	acceptRetryMaxDelay = time.Second
+)
+
+// acceptSleep waits between failed accepts; replaced in tests
+var acceptSleep = time.Sleep
+
+// acceptConnections accepts client connections and passes them to handle
+// until the listener is closed. While draining they are closed right away
+// instead. Temporary failures, such as running out of
+// file descriptors, are retried with exponential backoff so they don't turn
+// into a busy loop. It returns nil once the listener has been closed after
+// shutdown was signalled, and the error for any other failure, including the
+// listener being closed unexpectedly.
+func (p *Proxy) acceptConnections(listener net.Listener, shutdown <-chan struct{}, handle func(net.Conn)) error {
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err == nil {
+			delay = 0
+			if !p.refuseWhileDraining(conn) {
+				handle(conn)
+			}
+			continue
+		}
+
+		if errors.Is(err, net.ErrClosed) {
+			select {
+			case <-shutdown:
+				return nil
+			default:
+				return err
+			}
+		}
+		if !isTemporaryAcceptError(err) {
+			return err
+		}
+
+		if delay == 0 {
+			delay = acceptRetryMinDelay
+		} else {
+			delay = min(delay*2, acceptRetryMaxDelay)
+		}
+		p.logger.Error("Error accepting connection", "error", err, "retry_in", delay)
+		acceptSleep(delay)
+	}
+}
+
+// serveListeners runs acceptConnections on every listener, passing all of
+// their connections to handle along with the address of the listener that
+// accepted them, to tell local-socket traffic apart from TCP. A listener
+// failing for good closes the others as well and its error is returned once
+// they have all stopped; after shutdown was signalled and the listeners
+// closed it returns nil.
+func (p *Proxy) serveListeners(listeners []net.Listener, shutdown <-chan struct{}, handle func(conn net.Conn, listener string)) error {
+	var (
+		wg      sync.WaitGroup
+		failed  sync.Once
+		failure error
+	)
+	for _, listener := range listeners {
+		wg.Add(1)
+		go func(listener net.Listener) {
+			defer wg.Done()
+			label := listener.Addr().String()
+			err := p.acceptConnections(listener, shutdown, func(conn net.Conn) {
+				handle(conn, label)
+			})
+			if err == nil {
+				return
+			}
+			// The listeners closed here fail with net.ErrClosed in turn,
+			// so only the first error is the cause
+			failed.Do(func() {
+				failure = fmt.Errorf("listener %s: %w", listener.Addr(), err)
+				for _, l := range listeners {
+					_ = l.Close()
+				}
+			})
+		}(listener)
+	}
+	wg.Wait()
+	return failure
+}
+
+// isTemporaryAcceptError reports whether a failed accept is worth retrying:
+// the process or system ran out of resources, or the client went away
+// before the connection was accepted
+func isTemporaryAcceptError(err error) bool {
+	return errors.Is(err, syscall.EMFILE) ||
+		errors.Is(err, syscall.ENFILE) ||
+		errors.Is(err, syscall.ENOBUFS) ||
+		errors.Is(err, syscall.ENOMEM) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		isTimeout(err)
+}
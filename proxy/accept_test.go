@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// scriptedListener returns the given accept results in order, then
+// net.ErrClosed
+type scriptedListener struct {
+	net.Listener
+	results []error // nil accepts a connection
+}
+
+func (l *scriptedListener) Accept() (net.Conn, error) {
+	if len(l.results) == 0 {
+		return nil, net.ErrClosed
+	}
+	err := l.results[0]
+	l.results = l.results[1:]
+	if err != nil {
+		return nil, err
+	}
+	client, server := net.Pipe()
+	_ = client.Close()
+	return server, nil
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	var sleeps []time.Duration
+	acceptSleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+	defer func() { acceptSleep = time.Sleep }()
+
+	tooManyFiles := &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	results := []error{tooManyFiles, tooManyFiles, tooManyFiles, nil, tooManyFiles, nil}
+	for i := 0; i < 10; i++ {
+		results = append(results, tooManyFiles)
+	}
+
+	shutdown := make(chan struct{})
+	close(shutdown)
+	handled := 0
+	err := newTestProxy(t).acceptConnections(&scriptedListener{results: results}, shutdown, func(conn net.Conn) {
+		handled++
+		_ = conn.Close()
+	})
+	if err != nil {
+		t.Fatalf("Expected a clean stop after shutdown, got %v", err)
+	}
+	if handled != 2 {
+		t.Errorf("Expected 2 connections to be handled, got %d", handled)
+	}
+
+	// Doubling from the minimum, reset by each accepted connection, capped
+	expected := []time.Duration{5 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond, 5 * time.Millisecond}
+	for _, d := range []time.Duration{5, 10, 20, 40, 80, 160, 320, 640} {
+		expected = append(expected, d*time.Millisecond)
+	}
+	expected = append(expected, time.Second, time.Second)
+	if !reflect.DeepEqual(sleeps, expected) {
+		t.Errorf("Expected delays %v, got %v", expected, sleeps)
+	}
+}
+
+func TestAcceptFatalErrors(t *testing.T) {
+	acceptSleep = func(time.Duration) { t.Error("Expected no retry") }
+	defer func() { acceptSleep = time.Sleep }()
+	srv := newTestProxy(t)
+
+	// Closed without a shutdown signal
+	if err := srv.acceptConnections(&scriptedListener{}, make(chan struct{}), nil); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Expected %v, got %v", net.ErrClosed, err)
+	}
+
+	// Not a temporary condition
+	fatal := &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EINVAL)}
+	if err := srv.acceptConnections(&scriptedListener{results: []error{fatal}}, make(chan struct{}), nil); !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("Expected %v, got %v", syscall.EINVAL, err)
+	}
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+)
+
+// parseCIDRs parses a list of CIDR blocks such as 10.0.0.0/8 or fd00::/8
+// given with the named flag
+func parseCIDRs(flag string, cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --%s %q: %w", flag, cidr, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// isClientAllowed reports whether a client at addr may use the proxy. All
+// clients are allowed when no networks are configured, as are connections
+// that carry no IP address, such as Unix sockets.
+func (p *Proxy) isClientAllowed(addr net.Addr) bool {
+	return inNets(addr, p.allowedNets)
+}
+
+// isTrustedProxy reports whether the PROXY header of a peer at addr may be
+// believed, by the same rules as isClientAllowed
+func (p *Proxy) isTrustedProxy(addr net.Addr) bool {
+	return inNets(addr, p.trustedProxyNets)
+}
+
+// inNets reports whether addr is in one of nets, or nets is empty, or addr
+// carries no IP address
+func inNets(addr net.Addr, nets []*net.IPNet) bool {
+	if len(nets) == 0 {
+		return true
+	}
+
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UnixAddr:
+		return true
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return false
+		}
+		ip = net.ParseIP(host)
+	}
+	if ip == nil {
+		return false
+	}
+
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
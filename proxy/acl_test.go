@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestIsClientAllowed(t *testing.T) {
+	srv := newTestProxy(t, func(c *Config) { c.AllowCIDR = []string{"10.0.0.0/8", "fd00::/8"} })
+
+	tests := []struct {
+		name    string
+		addr    net.Addr
+		allowed bool
+	}{
+		{"IPv4 inside", &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}, true},
+		{"IPv4 outside", &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 1234}, false},
+		{"IPv4-mapped IPv6", &net.TCPAddr{IP: net.ParseIP("::ffff:10.1.2.3"), Port: 1234}, true},
+		{"IPv6 inside", &net.TCPAddr{IP: net.ParseIP("fd12::1"), Port: 1234}, true},
+		{"IPv6 outside", &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}, false},
+		{"Unix socket", &net.UnixAddr{Name: "/run/clamd.sock", Net: "unix"}, true},
+		{"Other address type", &mockAddr{}, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := srv.isClientAllowed(tc.addr); got != tc.allowed {
+				t.Errorf("Expected allowed=%v for %s, got %v", tc.allowed, tc.addr, got)
+			}
+		})
+	}
+}
+
+func TestIsClientAllowedWithoutList(t *testing.T) {
+	if !newTestProxy(t).isClientAllowed(&net.TCPAddr{IP: net.ParseIP("192.168.1.1")}) {
+		t.Errorf("Expected every client to be allowed without --allow-cidr")
+	}
+}
+
+func TestIsTrustedProxy(t *testing.T) {
+	srv := newTestProxy(t, func(c *Config) { c.TrustedProxyCIDR = []string{"192.0.2.0/24"} })
+
+	if !srv.isTrustedProxy(&net.TCPAddr{IP: net.ParseIP("192.0.2.10")}) {
+		t.Error("Expected a load balancer inside the list to be trusted")
+	}
+	if srv.isTrustedProxy(&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}) {
+		t.Error("Expected a peer outside the list not to be trusted")
+	}
+}
+
+func TestParseCIDRsInvalid(t *testing.T) {
+	_, err := parseCIDRs("allow-cidr", []string{"10.0.0.0/8", "10.0.0.1"})
+	if err == nil || !strings.Contains(err.Error(), "--allow-cidr") {
+		t.Errorf("Expected an error naming the flag for a bare address, got %v", err)
+	}
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Audit decisions
+const (
+	auditForwarded = "forwarded" // Sent to the backend
+	auditBlocked   = "blocked"   // Refused by the proxy
+	auditAnswered  = "answered"  // Answered by the proxy without the backend
+)
+
+// auditTrail is the --audit-log trail, kept apart from the operational logs.
+// It writes one JSON line per command decision. Each record is written to
+// the file as soon as it is logged, so nothing is held back in the process;
+// close syncs it to disk. A nil trail, with auditing disabled, records
+// nothing.
+type auditTrail struct {
+	mu     sync.Mutex
+	file   *os.File
+	logger *slog.Logger
+	closed bool
+}
+
+// openAuditTrail opens path for appending, creating it if needed
+func openAuditTrail(path string) (*auditTrail, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+
+	handler := slog.NewJSONHandler(file, &slog.HandlerOptions{
+		// Every record is an audit entry, a level would only be noise
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.LevelKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	return &auditTrail{file: file, logger: slog.New(handler)}, nil
+}
+
+// record logs a decision about cmd, received from client on connection
+// connID. reason explains decisions other than a plain forward and is
+// omitted when empty.
+func (a *auditTrail) record(client net.Addr, connID, cmd, decision, reason string) {
+	if a == nil {
+		return
+	}
+
+	attrs := []any{
+		"client_ip", auditClientIP(client),
+		"conn_id", connID,
+		"command", normalizedCommand(cmd),
+		"decision", decision,
+	}
+	if reason != "" {
+		attrs = append(attrs, "reason", reason)
+	}
+
+	// Serialized with close, so a connection finishing late can't write to
+	// a file that is already closed
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.closed {
+		a.logger.Info("command", attrs...)
+	}
+}
+
+// close syncs the audit log to disk and closes it. Later records are dropped.
+func (a *auditTrail) close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return nil
+	}
+	a.closed = true
+
+	if err := a.file.Sync(); err != nil {
+		_ = a.file.Close()
+		return fmt.Errorf("failed to sync audit log: %w", err)
+	}
+	return a.file.Close()
+}
+
+// closeAuditLog closes the audit log on shutdown, if there is one
+func (p *Proxy) closeAuditLog() {
+	if p.auditLog == nil {
+		return
+	}
+	if err := p.auditLog.close(); err != nil {
+		p.logger.Error("Failed to close audit log", "error", err)
+	}
+}
+
+// audit records a decision about a command of this connection
+func (p *ClamdProxy) audit(cmd, decision, reason string) {
+	p.server.auditLog.record(p.client.RemoteAddr(), p.connID, cmd, decision, reason)
+}
+
+// auditClientIP returns the IP address of a client, or the whole address if
+// it carries none, as with Unix sockets
+func auditClientIP(addr net.Addr) string {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	s := addr.String()
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return host
+	}
+	return s
+}
+
+// normalizedCommand returns cmd with the z/n prefix of its name dropped, as
+// in commandName, so variants of a command are audited alike. Arguments are
+// kept as sent.
+func normalizedCommand(cmd string) string {
+	name := commandName(cmd)
+	cmd = strings.TrimSpace(cmd)
+	if i := strings.IndexAny(cmd, " \t"); i >= 0 {
+		return name + cmd[i:]
+	}
+	return name
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNormalizedCommand(t *testing.T) {
+	tests := map[string]string{
+		"zVERSION":                  "VERSION",
+		"nSCAN /srv/files/a  b.txt": "SCAN /srv/files/a  b.txt",
+		"SHUTDOWN":                  "SHUTDOWN",
+		"zap":                       "zap",
+		"":                          "",
+		"  nINSTREAM":               "INSTREAM",
+	}
+	for cmd, expected := range tests {
+		if got := normalizedCommand(cmd); got != expected {
+			t.Errorf("Expected %q for %q, got %q", expected, cmd, got)
+		}
+	}
+}
+
+func TestAuditClientIP(t *testing.T) {
+	tests := []struct {
+		addr     net.Addr
+		expected string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}, "192.0.2.1"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}, "2001:db8::1"},
+		{&net.UnixAddr{Name: "/run/clamdproxy.sock", Net: "unix"}, "/run/clamdproxy.sock"},
+	}
+	for _, test := range tests {
+		if got := auditClientIP(test.addr); got != test.expected {
+			t.Errorf("Expected %q for %v, got %q", test.expected, test.addr, got)
+		}
+	}
+}
+
+// readAuditLog returns the entries of an audit log file
+func readAuditLog(t *testing.T, path string) []map[string]string {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer file.Close()
+
+	var entries []map[string]string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry map[string]string
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("Invalid audit entry %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	srv := newTestProxy(t, func(c *Config) { c.AuditLog = path })
+
+	clientSide, backendSide, done := startProxyWithPipes(t, srv)
+
+	go func() {
+		_, _ = clientSide.Write([]byte("nSHUTDOWN\n"))
+		_, _ = clientSide.Write([]byte("zVERSION\x00"))
+	}()
+
+	// The blocked command is answered by the proxy, VERSION is forwarded
+	blocked := make([]byte, len("UNKNOWN COMMAND\n"))
+	if _, err := io.ReadFull(clientSide, blocked); err != nil {
+		t.Fatalf("Failed to read blocked response: %v", err)
+	}
+	forwarded := make([]byte, len("zVERSION\x00"))
+	if _, err := io.ReadFull(backendSide, forwarded); err != nil {
+		t.Fatalf("Failed to read forwarded command: %v", err)
+	}
+
+	_ = clientSide.Close()
+	_ = backendSide.Close()
+	<-done
+	if err := srv.auditLog.close(); err != nil {
+		t.Fatalf("Failed to close audit log: %v", err)
+	}
+
+	// Records after closing are dropped rather than failing
+	srv.auditLog.record(&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1)}, "late", "PING", auditForwarded, "")
+
+	entries := readAuditLog(t, path)
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 audit entries, got %d: %v", len(entries), entries)
+	}
+	expected := []map[string]string{
+		{"command": "SHUTDOWN", "decision": auditBlocked, "reason": "filter"},
+		{"command": "VERSION", "decision": auditForwarded},
+	}
+	for i, entry := range entries {
+		for key, value := range expected[i] {
+			if entry[key] != value {
+				t.Errorf("Expected %s=%q in entry %d, got %q", key, value, i, entry[key])
+			}
+		}
+		for _, key := range []string{"time", "client_ip", "conn_id"} {
+			if _, ok := entry[key]; !ok {
+				t.Errorf("Expected %s in entry %d: %v", key, i, entry)
+			}
+		}
+		if _, ok := entry["level"]; ok {
+			t.Errorf("Expected no level in entry %d: %v", i, entry)
+		}
+	}
+	if _, ok := entries[1]["reason"]; ok {
+		t.Errorf("Expected no reason for a plain forward: %v", entries[1])
+	}
+}
@@ -0,0 +1,251 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"time"
+)
+
+// dialContext dials addr, giving up after --backend-dial-timeout so an
+// unreachable backend host doesn't hold the client for the OS connect
+// timeout, or as soon as ctx is done
+func (p *Proxy) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return p.backendDialer(p.cfg.BackendDialTimeout).DialContext(ctx, network, addr)
+}
+
+// backendDialer returns a dialer for backend connections giving up after
+// timeout, bound to --backend-source-addr if set
+func (p *Proxy) backendDialer(timeout time.Duration) *net.Dialer {
+	dialer := &net.Dialer{Timeout: timeout}
+	// Only set when there is an address: a nil *net.TCPAddr would still be a
+	// non-nil net.Addr
+	if p.sourceAddr != nil {
+		dialer.LocalAddr = p.sourceAddr
+	}
+	return dialer
+}
+
+// parseSourceAddr parses --backend-source-addr, an IP address of this host.
+// It is checked by binding to it, so an address the host doesn't have fails
+// at startup rather than on every dial. The port is left to the OS, since
+// each backend connection needs its own.
+func parseSourceAddr(s string) (*net.TCPAddr, error) {
+	if s == "" {
+		return nil, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", s)
+	}
+
+	addr := &net.TCPAddr{IP: ip}
+	listener, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("address %s is not usable on this host: %w", s, err)
+	}
+	_ = listener.Close()
+	return addr, nil
+}
+
+// Timing of the --unavailable-response reply
+const (
+	// unavailableCommandWait is how long to wait for the client's command,
+	// whose terminator the reply should use
+	unavailableCommandWait = 500 * time.Millisecond
+
+	// unavailableDrainTimeout bounds reading what the client still sends
+	// after the reply, see replyUnavailable
+	unavailableDrainTimeout = time.Second
+
+	// maxUnavailableDrain is the most read from the client after the
+	// reply; an INSTREAM upload is cut short rather than received
+	maxUnavailableDrain = 64 * 1024
+)
+
+// replyUnavailable answers a client whose backend couldn't be reached with
+// --unavailable-response instead of closing on it without a word. The reply
+// ends like clamd's to the client's command if one arrives in time, with a
+// newline otherwise. Unread data would make closing the connection reset it,
+// which can discard the reply before the client reads it, so the write side
+// is shut down first and the rest of the request drained.
+func (p *Proxy) replyUnavailable(conn net.Conn, connID string) {
+	if p.cfg.UnavailableResponse == "" {
+		return
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(unavailableCommandWait)); err != nil {
+		return
+	}
+
+	terminator := newlineDelimiter
+	var first [1]byte
+	if n, _ := conn.Read(first[:]); n == 1 && first[0] == 'z' {
+		terminator = nullDelimiter
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(unavailableDrainTimeout)); err != nil {
+		return
+	}
+	if _, err := io.WriteString(conn, p.cfg.UnavailableResponse+string(terminator)); err != nil {
+		p.logger.Debug("Error sending unavailable response", "conn_id", connID, "error", err)
+		return
+	}
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(conn, maxUnavailableDrain))
+}
+
+// backendOrder returns the order in which backends should be tried for a new
+// connection: starting at the next round-robin position and wrapping around,
+// so a failed backend falls through to the following one.
+func (p *Proxy) backendOrder(addrs []string) []string {
+	if len(addrs) <= 1 {
+		return addrs
+	}
+
+	start := int((p.backendCounter.Add(1) - 1) % uint64(len(addrs)))
+	order := make([]string, 0, len(addrs))
+	order = append(order, addrs[start:]...)
+	return append(order, addrs[:start]...)
+}
+
+// dialBackend opens a backend connection on behalf of a client, trying each of
+// the given backends in round-robin order until one accepts. If all of them
+// fail with a transient error the whole round is retried with exponential
+// backoff, up to --backend-retries times. With --breaker-threshold set,
+// repeated failures open the circuit breaker and later calls fail fast.
+// Cancelling ctx, the client connection's, ends a dial in progress or the
+// wait between retries.
+func (p *Proxy) dialBackend(ctx context.Context, addrs []string, clientAddr, connID string) (net.Conn, error) {
+	if p.cfg.BreakerThreshold <= 0 {
+		return p.dialBackendWithRetry(ctx, addrs, clientAddr, connID)
+	}
+
+	if !p.breaker.allow(p.cfg.BreakerCooldown) {
+		p.logger.Warn("Backend circuit breaker open, rejecting connection",
+			"conn_id", connID,
+			"client", clientAddr)
+		return nil, errBreakerOpen
+	}
+
+	conn, err := p.dialBackendWithRetry(ctx, addrs, clientAddr, connID)
+	if err != nil {
+		if ctx.Err() != nil {
+			// Given up by the client side, which says nothing about the backend
+			p.breaker.abandon()
+		} else {
+			p.breaker.failure(p.cfg.BreakerThreshold)
+		}
+		return nil, err
+	}
+	p.breaker.success()
+	return conn, nil
+}
+
+// dialBackendWithRetry tries each backend in round-robin order, retrying
+// whole rounds that failed with a transient error
+func (p *Proxy) dialBackendWithRetry(ctx context.Context, addrs []string, clientAddr, connID string) (net.Conn, error) {
+	order := p.backendOrder(addrs)
+	delay := p.cfg.BackendRetryDelay
+
+	for attempt := 0; ; attempt++ {
+		conn, err := p.dialBackendOnce(ctx, order, clientAddr, connID)
+		if err == nil {
+			return conn, nil
+		}
+
+		if attempt >= p.cfg.BackendRetries || !isRetryableDialError(err) {
+			p.logger.Error("Failed to connect to backend",
+				"conn_id", connID,
+				"backend", order,
+				"client", clientAddr,
+				"attempts", attempt+1,
+				"error", err)
+			return nil, err
+		}
+
+		p.logger.Debug("Retrying backend connection",
+			"conn_id", connID,
+			"client", clientAddr,
+			"attempt", attempt+1,
+			"delay", delay,
+			"error", err)
+		if err := waitRetry(ctx, delay); err != nil {
+			p.logger.Debug("Backend connection retry cancelled",
+				"conn_id", connID,
+				"client", clientAddr,
+				"error", err)
+			return nil, err
+		}
+
+		delay *= 2
+		if delay > p.cfg.BackendRetryMaxDelay {
+			delay = p.cfg.BackendRetryMaxDelay
+		}
+	}
+}
+
+// waitRetry waits delay before the next dial round, or returns the error of
+// ctx if that is done first, e.g. on shutdown or --max-conn-lifetime
+func waitRetry(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// dialBackendOnce tries each backend in order once and returns the first
+// successful connection, or the last error if none could be reached. Once
+// ctx is done it stops with the dial error.
+func (p *Proxy) dialBackendOnce(ctx context.Context, order []string, clientAddr, connID string) (net.Conn, error) {
+	lastErr := errors.New("no backend configured")
+	for _, addr := range order {
+		backendConn, err := p.netDial(ctx, "tcp", addr)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err // The next backend wouldn't be dialed either
+			}
+			if isTimeout(err) {
+				p.logger.Warn("Backend dial timed out",
+					"conn_id", connID,
+					"backend", addr,
+					"client", clientAddr,
+					"timeout", p.cfg.BackendDialTimeout)
+			} else {
+				p.logger.Warn("Backend unavailable",
+					"conn_id", connID,
+					"backend", addr,
+					"client", clientAddr,
+					"error", err)
+			}
+			lastErr = err
+			continue
+		}
+
+		if err := setKeepAlive(backendConn, p.cfg.TCPKeepAlivePeriod); err != nil {
+			p.logger.Debug("Failed to configure backend keepalive", "conn_id", connID, "backend", addr, "error", err)
+		}
+
+		p.logger.Info("Connected to backend", "conn_id", connID, "backend", addr, "client", clientAddr)
+		return backendConn, nil
+	}
+	return nil, lastErr
+}
+
+// isRetryableDialError reports whether a failed dial is worth retrying: the
+// backend refused the connection (e.g. clamd is restarting) or didn't answer
+// in time. Cancellation is never retried.
+func isRetryableDialError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || isTimeout(err)
+}
@@ -0,0 +1,348 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestBackendOrder(t *testing.T) {
+	srv := newTestProxy(t)
+	addrs := []string{"a:3310", "b:3310", "c:3310"}
+
+	expected := [][]string{
+		{"a:3310", "b:3310", "c:3310"},
+		{"b:3310", "c:3310", "a:3310"},
+		{"c:3310", "a:3310", "b:3310"},
+		{"a:3310", "b:3310", "c:3310"},
+	}
+	for i, want := range expected {
+		if got := srv.backendOrder(addrs); !reflect.DeepEqual(got, want) {
+			t.Errorf("Round %d: expected %v, got %v", i, want, got)
+		}
+	}
+
+	// A single backend never consumes the counter
+	single := []string{"only:3310"}
+	if got := srv.backendOrder(single); !reflect.DeepEqual(got, single) {
+		t.Errorf("Expected %v, got %v", single, got)
+	}
+}
+
+func TestDialBackendFailover(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer func() { _ = listener.Close() }()
+
+	// Reserve a port and close it again so dialing it is refused
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	deadAddr := closed.Addr().String()
+	_ = closed.Close()
+
+	srv := newTestProxy(t)
+	conn, err := srv.dialBackend(context.Background(), []string{deadAddr, listener.Addr().String()}, "127.0.0.1:1234", "test")
+	if err != nil {
+		t.Fatalf("Expected failover to the live backend, got %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	if conn.RemoteAddr().String() != listener.Addr().String() {
+		t.Errorf("Expected connection to %s, got %s", listener.Addr(), conn.RemoteAddr())
+	}
+
+	if _, err := srv.dialBackend(context.Background(), []string{deadAddr}, "127.0.0.1:1234", "test"); err == nil {
+		t.Errorf("Expected an error when every backend is down")
+	}
+	if _, err := srv.dialBackend(context.Background(), nil, "127.0.0.1:1234", "test"); err == nil {
+		t.Errorf("Expected an error with no backends")
+	}
+}
+
+func TestDialBackendRetry(t *testing.T) {
+	retries := func(c *Config) {
+		c.BackendRetries = 3
+		c.BackendRetryDelay = time.Millisecond
+		c.BackendRetryMaxDelay = 2 * time.Millisecond
+	}
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+
+	tests := []struct {
+		name          string
+		failures      int
+		err           error
+		expectedCalls int
+		expectSuccess bool
+	}{
+		{"Recovers after refusals", 2, refused, 3, true},
+		{"Gives up after retries", 10, refused, 4, false},
+		{"Does not retry other errors", 10, errors.New("no such host"), 1, false},
+		{"Does not retry cancellation", 10, context.Canceled, 1, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := newTestProxy(t, retries)
+			calls := 0
+			srv.netDial = func(_ context.Context, network, addr string) (net.Conn, error) {
+				calls++
+				if calls <= tc.failures {
+					return nil, tc.err
+				}
+				client, server := net.Pipe()
+				_ = server.Close()
+				return client, nil
+			}
+
+			conn, err := srv.dialBackend(context.Background(), []string{"backend:3310"}, "127.0.0.1:1234", "test")
+			if tc.expectSuccess && err != nil {
+				t.Fatalf("Expected success, got %v", err)
+			}
+			if !tc.expectSuccess && err == nil {
+				t.Fatalf("Expected an error")
+			}
+			if conn != nil {
+				_ = conn.Close()
+			}
+			if calls != tc.expectedCalls {
+				t.Errorf("Expected %d dial attempts, got %d", tc.expectedCalls, calls)
+			}
+		})
+	}
+}
+
+func TestDialBackendRetryCancelled(t *testing.T) {
+	srv := newTestProxy(t, func(c *Config) {
+		c.BackendRetries = 3
+		c.BackendRetryDelay = time.Hour
+		c.BackendRetryMaxDelay = time.Hour
+	})
+
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	srv.netDial = func(_ context.Context, network, addr string) (net.Conn, error) {
+		return nil, refused
+	}
+
+	// Closing the connection, e.g. on shutdown, ends the wait for the retry
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := srv.dialBackend(ctx, []string{"backend:3310"}, "127.0.0.1:1234", "test")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected %v, got %v", context.Canceled, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the retry wait to end on cancellation, took %s", elapsed)
+	}
+}
+
+func TestDialBackendTimeout(t *testing.T) {
+	srv := newTestProxy(t, func(c *Config) { c.BackendDialTimeout = 100 * time.Millisecond })
+
+	// Non-routable, so the SYN goes unanswered rather than being refused
+	const unroutable = "10.255.255.1:3310"
+
+	start := time.Now()
+	conn, err := srv.dialBackendOnce(context.Background(), []string{unroutable}, "127.0.0.1:1234", "test")
+	elapsed := time.Since(start)
+	if err == nil {
+		_ = conn.Close()
+		t.Skip("Unroutable address accepted the connection")
+	}
+	if !isTimeout(err) {
+		t.Skipf("No route to %s in this environment: %v", unroutable, err)
+	}
+	if elapsed > time.Second {
+		t.Errorf("Expected the dial to give up after about 100ms, took %v", elapsed)
+	}
+	if !isRetryableDialError(err) {
+		t.Errorf("Expected a timed out dial to be retryable, got %v", err)
+	}
+}
+
+func TestDialBackendCancelled(t *testing.T) {
+	srv := newTestProxy(t, func(c *Config) {
+		c.BackendRetries = 3
+		c.BackendRetryDelay = time.Millisecond
+	})
+
+	// A dial in progress ends with the connection, and neither the other
+	// backends nor a retry are tried
+	var calls atomic.Int32
+	srv.netDial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		calls.Add(1)
+		<-ctx.Done()
+		return nil, &net.OpError{Op: "dial", Net: network, Err: ctx.Err()}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err := srv.dialBackend(ctx, []string{"backend1:3310", "backend2:3310"}, "127.0.0.1:1234", "test")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected %v, got %v", context.Canceled, err)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("Expected 1 dial, got %d", got)
+	}
+}
+
+func TestDialContextCancelled(t *testing.T) {
+	srv := newTestProxy(t, func(c *Config) { c.BackendDialTimeout = 10 * time.Second })
+
+	// Non-routable, so the dial hangs until cancelled
+	const unroutable = "10.255.255.1:3310"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	conn, err := srv.dialContext(ctx, "tcp", unroutable)
+	if err == nil {
+		_ = conn.Close()
+		t.Skip("Unroutable address accepted the connection")
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Skipf("No route to %s in this environment: %v", unroutable, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the dial to end on cancellation, took %v", elapsed)
+	}
+	if isRetryableDialError(err) {
+		t.Errorf("Expected a cancelled dial not to be retried, got %v", err)
+	}
+}
+
+func TestParseSourceAddr(t *testing.T) {
+	tests := []struct {
+		input string
+		valid bool
+	}{
+		{"", true},
+		{"127.0.0.1", true},
+		{"not-an-ip", false},
+		{"127.0.0.1:4000", false},
+		{"192.0.2.1", false}, // Documentation range, not assigned to this host
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.input, func(t *testing.T) {
+			addr, err := parseSourceAddr(tc.input)
+			if (err == nil) != tc.valid {
+				t.Fatalf("Expected valid=%v, got %v", tc.valid, err)
+			}
+			if tc.input == "" && addr != nil {
+				t.Errorf("Expected no source address, got %v", addr)
+			}
+		})
+	}
+}
+
+func TestBackendSourceAddr(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	// Linux answers on all of 127.0.0.0/8, other systems may only have
+	// 127.0.0.1
+	source, err := parseSourceAddr("127.0.0.2")
+	if err != nil {
+		t.Skipf("No second loopback address in this environment: %v", err)
+	}
+	srv := newTestProxy(t, func(c *Config) { c.BackendDialTimeout = time.Second })
+	srv.sourceAddr = source
+
+	accepted := make(chan net.Addr, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		accepted <- conn.RemoteAddr()
+		_ = conn.Close()
+	}()
+
+	conn, err := srv.dialContext(context.Background(), "tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	remote, ok := (<-accepted).(*net.TCPAddr)
+	if !ok || !remote.IP.Equal(source.IP) {
+		t.Errorf("Expected the connection to come from %s, got %v", source.IP, remote)
+	}
+}
+
+func TestUnavailableResponse(t *testing.T) {
+	// A port nothing listens on
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	down := closed.Addr().String()
+	_ = closed.Close()
+
+	tests := []struct {
+		name     string
+		deferred bool
+		request  string
+		expected string
+	}{
+		{"Null-terminated command", false, "zPING\x00", "ERROR: service unavailable\x00"},
+		{"Newline-terminated command", false, "nPING\n", "ERROR: service unavailable\n"},
+		{"No command", false, "", "ERROR: service unavailable\n"},
+		{"Deferred dial", true, "zVERSION\x00", "ERROR: service unavailable\x00"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := newTestProxy(t, func(c *Config) {
+				c.Backend = []string{down}
+				c.UnavailableResponse = "ERROR: service unavailable"
+				c.LocalPing = tc.deferred
+			})
+			clientSide, proxyClient := tcpPair(t)
+
+			done := make(chan struct{})
+			srv.activeConns.Add(1)
+			go func() {
+				defer close(done)
+				srv.handleConnection(context.Background(), proxyClient, "test")
+			}()
+
+			if tc.request != "" {
+				if _, err := clientSide.Write([]byte(tc.request)); err != nil {
+					t.Fatalf("Client write failed: %v", err)
+				}
+			}
+			_ = clientSide.SetReadDeadline(time.Now().Add(2 * time.Second))
+			reply := make([]byte, len(tc.expected))
+			if _, err := io.ReadFull(clientSide, reply); err != nil {
+				t.Fatalf("Failed to read reply, got %q: %v", reply, err)
+			}
+			if string(reply) != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, reply)
+			}
+
+			// Nothing follows but a clean close once the client is done
+			_ = clientSide.CloseWrite()
+			if rest, err := io.ReadAll(clientSide); err != nil || len(rest) > 0 {
+				t.Errorf("Expected a clean close, got %q: %v", rest, err)
+			}
+			<-done
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// errBreakerOpen is returned instead of dialing while the circuit breaker is open
+var errBreakerOpen = errors.New("backend circuit breaker open")
+
+// breakerState is the state of the backend circuit breaker
+type breakerState int
+
+const (
+	breakerClosed   breakerState = iota // Dialing normally
+	breakerOpen                         // Failing fast until the cooldown has passed
+	breakerHalfOpen                     // A single probe dial is in flight
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker stops dialing the backends after repeated failures, so that
+// clients fail fast during an outage instead of each waiting out the dial
+// timeouts and retries. It is shared by all connections of a Proxy.
+type circuitBreaker struct {
+	mu       sync.Mutex
+	state    breakerState
+	failures int       // Consecutive failed dials while closed
+	openedAt time.Time // When the breaker last opened
+
+	now    func() time.Time // Replaced in tests
+	logger *slog.Logger
+}
+
+// allow reports whether a dial may be attempted. Once the cooldown of an open
+// breaker has passed, exactly one caller is let through as a probe.
+func (b *circuitBreaker) allow(cooldown time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.logger.Info("Probing backend after circuit breaker cooldown")
+		return true
+	case breakerHalfOpen:
+		return false // Wait for the probe's outcome
+	default:
+		return true
+	}
+}
+
+// closed reports whether the breaker lets dials through without probing
+func (b *circuitBreaker) closed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state == breakerClosed
+}
+
+// success records a successful dial and closes the breaker
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != breakerClosed {
+		b.logger.Warn("Backend recovered, circuit breaker closed")
+	}
+	b.state = breakerClosed
+	b.failures = 0
+}
+
+// abandon records a dial given up by its caller rather than failed by the
+// backend. A half-open breaker goes back to open with its cooldown already
+// passed, so the next dial probes the backend instead.
+func (b *circuitBreaker) abandon() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerHalfOpen {
+		b.state = breakerOpen
+	}
+}
+
+// failure records a failed dial. The breaker opens once threshold dials in a
+// row have failed, or right away if the probe of a half-open breaker fails.
+func (b *circuitBreaker) failure(threshold int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= threshold) {
+		if b.state == breakerClosed {
+			b.logger.Warn("Backend circuit breaker opened", "failures", b.failures)
+		}
+		b.state = breakerOpen
+		b.openedAt = b.now()
+	}
+}
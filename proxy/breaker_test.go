@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := &circuitBreaker{now: func() time.Time { return now }, logger: newTestProxy(t).logger}
+	const cooldown = 10 * time.Second
+
+	b.failure(2)
+	if !b.allow(cooldown) {
+		t.Fatal("Expected the breaker to stay closed below the threshold")
+	}
+	b.failure(2)
+	if b.allow(cooldown) {
+		t.Fatal("Expected the breaker to open at the threshold")
+	}
+
+	// After the cooldown exactly one probe is let through
+	now = now.Add(cooldown)
+	if !b.allow(cooldown) {
+		t.Fatal("Expected a probe after the cooldown")
+	}
+	if b.allow(cooldown) {
+		t.Fatal("Expected only a single probe")
+	}
+
+	// A failed probe reopens the breaker for another cooldown
+	b.failure(2)
+	if b.state != breakerOpen || b.allow(cooldown) {
+		t.Fatalf("Expected the breaker to reopen, got %s", b.state)
+	}
+
+	// A successful probe closes it
+	now = now.Add(cooldown)
+	if !b.allow(cooldown) {
+		t.Fatal("Expected a probe after the second cooldown")
+	}
+	b.success()
+	if b.state != breakerClosed || !b.allow(cooldown) {
+		t.Fatalf("Expected the breaker to close, got %s", b.state)
+	}
+}
+
+func TestCircuitBreakerAbandon(t *testing.T) {
+	now := time.Now()
+	b := &circuitBreaker{now: func() time.Time { return now }, logger: newTestProxy(t).logger}
+	const cooldown = time.Second
+
+	b.failure(1)
+	now = now.Add(cooldown)
+	if !b.allow(cooldown) {
+		t.Fatal("Expected a probe after the cooldown")
+	}
+
+	// A probe given up by its client lets the next dial probe instead
+	b.abandon()
+	if b.state != breakerOpen || !b.allow(cooldown) {
+		t.Errorf("Expected another probe, got %s", b.state)
+	}
+}
+
+func TestDialBackendBreaker(t *testing.T) {
+	srv := newTestProxy(t, func(c *Config) {
+		c.BreakerThreshold = 1
+		c.BreakerCooldown = time.Hour
+	})
+
+	calls := 0
+	srv.netDial = func(_ context.Context, network, addr string) (net.Conn, error) {
+		calls++
+		return nil, errors.New("no such host")
+	}
+
+	if _, err := srv.dialBackend(context.Background(), []string{"backend:3310"}, "127.0.0.1:1234", "test"); err == nil {
+		t.Fatal("Expected the first dial to fail")
+	}
+	if _, err := srv.dialBackend(context.Background(), []string{"backend:3310"}, "127.0.0.1:1234", "test"); !errors.Is(err, errBreakerOpen) {
+		t.Fatalf("Expected errBreakerOpen, got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("Expected the open breaker to skip dialing, got %d dials", calls)
+	}
+}
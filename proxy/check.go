@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// maxSuggestDistance is the largest edit distance between an unknown
+// whitelist entry and a clamd command for which the command is suggested
+const maxSuggestDistance = 2
+
+// CheckWhitelist implements the check command: it loads the whitelist file
+// at path through the same parser as the proxy and writes the commands it
+// allows to out, flagging names clamd doesn't know. It returns the exit
+// status, which is non-zero if the file can't be loaded or lists unknown
+// commands. Without a file the built-in whitelist is shown.
+func CheckWhitelist(out io.Writer, path string) int {
+	set := builtinWhitelist
+	source := "built-in whitelist"
+	if path != "" {
+		var err error
+		if set, err = loadWhitelist(path, false); err != nil {
+			fmt.Fprintf(out, "Invalid whitelist: %v\n", err)
+			return 1
+		}
+		source = path
+	}
+
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(out, "%s allows %d commands:\n", source, len(names))
+	var unknown []string
+	for _, name := range names {
+		line := "  " + name
+		if set[name].args {
+			line += " (with arguments)"
+		}
+		if !clamdCommands[name] {
+			line += " (unknown)"
+			unknown = append(unknown, name)
+		}
+		fmt.Fprintln(out, line)
+	}
+
+	for _, name := range unknown {
+		if suggestion := suggestCommand(name); suggestion != "" {
+			fmt.Fprintf(out, "Unknown command %q, did you mean %s?\n", name, suggestion)
+		} else {
+			fmt.Fprintf(out, "Unknown command %q, clamd will never accept it\n", name)
+		}
+	}
+	if len(unknown) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// suggestCommand returns the clamd command closest to a misspelled name,
+// or "" if none is close enough. Names are compared case-insensitively and
+// without a z/n prefix, as whitelists list bare upper case names.
+func suggestCommand(name string) string {
+	upper := strings.ToUpper(name)
+	candidates := []string{upper}
+	if len(upper) > 1 && (upper[0] == 'Z' || upper[0] == 'N') {
+		candidates = append(candidates, upper[1:])
+	}
+
+	best, bestDistance := "", maxSuggestDistance+1
+	for command := range clamdCommands {
+		for _, candidate := range candidates {
+			d := editDistance(candidate, command)
+			if d < bestDistance || (d == bestDistance && command < best) {
+				best, bestDistance = command, d
+			}
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeWhitelist writes a whitelist file and returns its path
+func writeWhitelist(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "whitelist")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write whitelist: %v", err)
+	}
+	return path
+}
+
+func TestCheckWhitelist(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		status   int
+		expected []string
+	}{
+		{
+			name:   "Valid file",
+			path:   writeWhitelist(t, "# Scanning only\nPING\nINSTREAM\nSCAN\nSTATS *\n"),
+			status: 0,
+			expected: []string{
+				"allows 4 commands:\n",
+				"  INSTREAM\n  PING\n  SCAN (with arguments)\n  STATS (with arguments)\n",
+			},
+		},
+		{
+			name:   "Typos",
+			path:   writeWhitelist(t, "PING\nINSTRAEM\nzVERSION\nFOO\n"),
+			status: 1,
+			expected: []string{
+				"  INSTRAEM (unknown)\n",
+				`Unknown command "INSTRAEM", did you mean INSTREAM?`,
+				`Unknown command "zVERSION", did you mean VERSION?`,
+				`Unknown command "FOO", clamd will never accept it`,
+			},
+		},
+		{
+			name:     "Parse error",
+			path:     writeWhitelist(t, "PING\nSCAN /etc\n"),
+			status:   1,
+			expected: []string{"Invalid whitelist: ", `:2: expected a command name`},
+		},
+		{
+			name:     "Unreadable file",
+			path:     t.TempDir(), // A directory opens but can't be read
+			status:   1,
+			expected: []string{"Invalid whitelist: "},
+		},
+		{
+			name:     "Built-in whitelist",
+			status:   0,
+			expected: []string{"built-in whitelist allows 6 commands:\n"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var out strings.Builder
+			if status := CheckWhitelist(&out, tc.path); status != tc.status {
+				t.Errorf("Expected status %d, got %d", tc.status, status)
+			}
+			for _, expected := range tc.expected {
+				if !strings.Contains(out.String(), expected) {
+					t.Errorf("Expected %q in output:\n%s", expected, out.String())
+				}
+			}
+		})
+	}
+}
+
+func TestSuggestCommand(t *testing.T) {
+	tests := map[string]string{
+		"SACN":      "SCAN",
+		"ping":      "PING",
+		"nINSTREAM": "INSTREAM",
+		"VERSON":    "VERSION",
+		"FOO":       "",
+		"SHUTDOWNX": "SHUTDOWN",
+	}
+	for name, expected := range tests {
+		if got := suggestCommand(name); got != expected {
+			t.Errorf("Expected %q for %q, got %q", expected, name, got)
+		}
+	}
+}
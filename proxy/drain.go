@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+)
+
+// drainHandler starts draining, on POST /drain on the stats server: new
+// connections are closed as soon as they are accepted and /readyz fails, so
+// a load balancer stops routing to this instance, while connections already
+// open finish. POST /undrain clears it.
+func (p *Proxy) drainHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowPost(w, r) {
+		return
+	}
+	if !p.draining.Swap(true) {
+		p.logger.Warn("Draining, new connections are refused",
+			"active", p.metrics.connectionsActive.Load())
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = io.WriteString(w, "draining\n")
+}
+
+// undrainHandler stops draining, accepting new connections again
+func (p *Proxy) undrainHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowPost(w, r) {
+		return
+	}
+	if p.draining.Swap(false) {
+		p.logger.Warn("Draining stopped, accepting new connections")
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = io.WriteString(w, "accepting\n")
+}
+
+// allowPost answers anything but a POST with 405 and reports whether the
+// request may proceed, so a stray GET from a browser or crawler doesn't
+// take the instance out of rotation
+func allowPost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == http.MethodPost {
+		return true
+	}
+	w.Header().Set("Allow", http.MethodPost)
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+// refuseWhileDraining closes a newly accepted connection while draining and
+// reports whether it did
+func (p *Proxy) refuseWhileDraining(conn net.Conn) bool {
+	if !p.draining.Load() {
+		return false
+	}
+	p.logger.Debug("Refused connection while draining", "client", conn.RemoteAddr().String())
+	_ = conn.Close()
+	return true
+}
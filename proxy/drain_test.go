@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDrainHandlers(t *testing.T) {
+	healthy := startFakeBackend(t, "PONG\x00")
+	srv := newTestProxy(t, func(c *Config) { c.Backend = []string{healthy} })
+
+	readyz := func() int {
+		recorder := httptest.NewRecorder()
+		srv.readyzHandler(recorder, httptest.NewRequest("GET", "/readyz", nil))
+		return recorder.Code
+	}
+
+	// A GET must not take the instance out of rotation
+	recorder := httptest.NewRecorder()
+	srv.drainHandler(recorder, httptest.NewRequest("GET", "/drain", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for GET, got %d", recorder.Code)
+	}
+	if srv.draining.Load() {
+		t.Fatal("GET /drain started draining")
+	}
+
+	recorder = httptest.NewRecorder()
+	srv.drainHandler(recorder, httptest.NewRequest("POST", "/drain", nil))
+	if recorder.Code != http.StatusOK || !srv.draining.Load() {
+		t.Fatalf("Expected POST /drain to start draining, got %d", recorder.Code)
+	}
+	if code := readyz(); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 from /readyz while draining, got %d", code)
+	}
+
+	recorder = httptest.NewRecorder()
+	srv.undrainHandler(recorder, httptest.NewRequest("POST", "/undrain", nil))
+	if recorder.Code != http.StatusOK || srv.draining.Load() {
+		t.Fatalf("Expected POST /undrain to stop draining, got %d", recorder.Code)
+	}
+	if code := readyz(); code != http.StatusOK {
+		t.Errorf("Expected 200 from /readyz after undrain, got %d", code)
+	}
+}
+
+func TestAcceptWhileDraining(t *testing.T) {
+	tests := []struct {
+		name     string
+		draining bool
+		handled  int
+	}{
+		{"Accepting", false, 2},
+		{"Draining", true, 0},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := newTestProxy(t)
+			srv.draining.Store(tc.draining)
+
+			listener := &scriptedListener{results: []error{nil, nil}}
+			shutdown := make(chan struct{})
+			close(shutdown)
+
+			handled := 0
+			err := srv.acceptConnections(listener, shutdown, func(conn net.Conn) {
+				handled++
+				_ = conn.Close()
+			})
+			if err != nil {
+				t.Fatalf("Expected a clean stop after shutdown, got %v", err)
+			}
+			if handled != tc.handled {
+				t.Errorf("Expected %d connections to be handled, got %d", tc.handled, handled)
+			}
+		})
+	}
+}
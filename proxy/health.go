@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// healthProbeCommand is sent to the backend by the readiness check
+const healthProbeCommand = "zPING"
+
+// healthProbeTimeout bounds a single backend readiness probe, dial included
+const healthProbeTimeout = 2 * time.Second
+
+// healthMux serves the liveness and readiness endpoints, on a server of
+// their own, kept apart from the pprof and metrics servers so probes
+// keep working when those are disabled or busy.
+func (p *Proxy) healthMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", p.readyzHandler)
+	return mux
+}
+
+// healthzHandler reports that the process is alive
+func healthzHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = io.WriteString(w, "ok\n")
+}
+
+// readyzHandler reports whether a backend answers PING, so traffic is only
+// routed to the proxy once it can actually be served. It fails while
+// draining, without probing.
+func (p *Proxy) readyzHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+
+	if p.draining.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = io.WriteString(w, "draining\n")
+		return
+	}
+
+	var err error
+	for _, addr := range p.cfg.Backend {
+		if err = p.probeBackend(addr, healthProbeTimeout); err == nil {
+			_, _ = io.WriteString(w, "ok\n")
+			return
+		}
+		p.logger.Debug("Readiness probe failed", "backend", addr, "error", err)
+	}
+	if err == nil {
+		err = errors.New("no backend configured")
+	}
+
+	w.WriteHeader(http.StatusServiceUnavailable)
+	_, _ = fmt.Fprintf(w, "backend not ready: %v\n", err)
+}
+
+// probeBackend sends PING to the backend at addr and expects PONG within timeout
+func (p *Proxy) probeBackend(addr string, timeout time.Duration) error {
+	conn, err := p.backendDialer(timeout).Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+
+	terminator := responseTerminator(healthProbeCommand)
+	if _, err := conn.Write(append([]byte(healthProbeCommand), terminator)); err != nil {
+		return fmt.Errorf("failed to send PING: %w", err)
+	}
+
+	// Nothing but PONG and its terminator is expected, so read just enough
+	// to tell a valid reply from anything else
+	expected := append([]byte("PONG"), terminator)
+	reply := make([]byte, len(expected))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("failed to read PING reply: %w", err)
+	}
+	if !bytes.Equal(reply, expected) {
+		return fmt.Errorf("unexpected PING reply %q", reply)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// startFakeBackend accepts connections on a local port and answers the first
+// command with reply, returning the address it listens on
+func startFakeBackend(t *testing.T, reply string) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				cmd := make([]byte, len(healthProbeCommand)+1)
+				if _, err := io.ReadFull(conn, cmd); err != nil {
+					return
+				}
+				_, _ = io.WriteString(conn, reply)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestHealthz(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	healthzHandler(recorder, httptest.NewRequest("GET", "/healthz", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected 200, got %d", recorder.Code)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	healthy := startFakeBackend(t, "PONG\x00")
+	broken := startFakeBackend(t, "UNKNOWN COMMAND\x00")
+
+	// A port nothing listens on
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	down := closed.Addr().String()
+	_ = closed.Close()
+
+	tests := []struct {
+		name     string
+		backends []string
+		expected int
+	}{
+		{"Healthy backend", []string{healthy}, http.StatusOK},
+		{"Unexpected reply", []string{broken}, http.StatusServiceUnavailable},
+		{"Backend down", []string{down}, http.StatusServiceUnavailable},
+		{"Fallback to healthy backend", []string{down, healthy}, http.StatusOK},
+		{"No backend", nil, http.StatusServiceUnavailable},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := newTestProxy(t, func(c *Config) { c.Backend = tc.backends })
+
+			recorder := httptest.NewRecorder()
+			srv.readyzHandler(recorder, httptest.NewRequest("GET", "/readyz", nil))
+
+			if recorder.Code != tc.expected {
+				t.Errorf("Expected %d, got %d: %s", tc.expected, recorder.Code, recorder.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,284 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// eicar is the EICAR test signature, which every virus scanner reports
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeClamd is a clamd stand-in answering PING, VERSION and INSTREAM over
+// TCP, one command per connection like clamd outside of a session. It
+// records every command it receives.
+type fakeClamd struct {
+	addr string
+
+	mu       sync.Mutex
+	received []string
+}
+
+// startFakeClamd starts a fake clamd on a loopback port
+func startFakeClamd(t *testing.T) *fakeClamd {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	f := &fakeClamd{addr: listener.Addr().String()}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+// serve answers a single command, then closes the connection
+func (f *fakeClamd) serve(conn net.Conn) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	// A connection the proxy opened but never used just ends
+	first, err := reader.Peek(1)
+	if err != nil {
+		return
+	}
+	terminator := newlineDelimiter
+	if first[0] == 'z' {
+		terminator = nullDelimiter
+	}
+	cmd, err := reader.ReadString(terminator)
+	if err != nil {
+		return
+	}
+	cmd = strings.TrimSuffix(cmd, string(terminator))
+
+	f.mu.Lock()
+	f.received = append(f.received, cmd)
+	f.mu.Unlock()
+
+	var reply string
+	switch commandName(cmd) {
+	case "PING":
+		reply = "PONG"
+	case "VERSION":
+		reply = "ClamAV 1.4.1/27500/Mon Jan 1 00:00:00 2024"
+	case "INSTREAM":
+		data, err := readStream(reader)
+		if err != nil {
+			return
+		}
+		reply = "stream: OK"
+		if bytes.Contains(data, []byte("EICAR-STANDARD-ANTIVIRUS-TEST-FILE")) {
+			reply = "stream: Eicar-Test-Signature FOUND"
+		}
+	default:
+		reply = "UNKNOWN COMMAND"
+	}
+	_, _ = io.WriteString(conn, reply+string(terminator))
+}
+
+// commands returns the commands received so far
+func (f *fakeClamd) commands() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.received...)
+}
+
+// readStream reads INSTREAM chunks up to the zero-length one
+func readStream(r io.Reader) ([]byte, error) {
+	var data []byte
+	for {
+		var size uint32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return data, nil
+		}
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return nil, err
+		}
+		data = append(data, chunk...)
+	}
+}
+
+// streamRequest returns a zINSTREAM command sending data in chunks of at
+// most chunkSize bytes
+func streamRequest(data []byte, chunkSize int) []byte {
+	req := []byte("zINSTREAM\x00")
+	for len(data) > 0 {
+		n := min(chunkSize, len(data))
+		req = binary.BigEndian.AppendUint32(req, uint32(n))
+		req = append(req, data[:n]...)
+		data = data[n:]
+	}
+	return binary.BigEndian.AppendUint32(req, 0)
+}
+
+// startIntegrationProxy runs the proxy's accept loop on a loopback port,
+// forwarding to backend, and stops it once the test is done
+func startIntegrationProxy(t *testing.T, backend string) string {
+	t.Helper()
+
+	srv := newTestProxy(t, func(c *Config) { c.Backend = []string{backend} })
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	shutdown := make(chan struct{})
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.serveListeners([]net.Listener{listener}, shutdown, func(conn net.Conn, listener string) {
+			srv.dispatchConnection(ctx, conn, listener)
+		})
+	}()
+
+	t.Cleanup(func() {
+		close(shutdown)
+		_ = listener.Close()
+		if err := <-served; err != nil {
+			t.Errorf("Expected a clean stop, got %v", err)
+		}
+		if !srv.waitForConnections(2 * time.Second) {
+			t.Error("Connections still active after the test")
+		}
+		cancel()
+	})
+	return listener.Addr().String()
+}
+
+// roundTrip sends request to the proxy on a new connection and returns the
+// reply up to and including terminator
+func roundTrip(t *testing.T, addr string, request []byte, terminator byte) string {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect to the proxy: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write(request); err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	reply, err := bufio.NewReader(conn).ReadString(terminator)
+	if err != nil {
+		t.Fatalf("Failed to read reply, got %q: %v", reply, err)
+	}
+	return reply
+}
+
+func TestIntegration(t *testing.T) {
+	backend := startFakeClamd(t)
+	proxy := startIntegrationProxy(t, backend.addr)
+
+	t.Run("Allowed commands", func(t *testing.T) {
+		tests := []struct {
+			request  string
+			expected string
+		}{
+			{"zPING\x00", "PONG\x00"},
+			{"nPING\n", "PONG\n"},
+			{"zVERSION\x00", "ClamAV 1.4.1/27500/Mon Jan 1 00:00:00 2024\x00"},
+		}
+		for _, tc := range tests {
+			terminator := tc.expected[len(tc.expected)-1]
+			if got := roundTrip(t, proxy, []byte(tc.request), terminator); got != tc.expected {
+				t.Errorf("Expected %q for %q, got %q", tc.expected, tc.request, got)
+			}
+		}
+	})
+
+	t.Run("Blocked commands", func(t *testing.T) {
+		for _, request := range []string{"zSHUTDOWN\x00", "nRELOAD\n", "zSCAN /etc/passwd\x00"} {
+			terminator := request[len(request)-1]
+			expected := defaultBlockedResponse + string(terminator)
+			if got := roundTrip(t, proxy, []byte(request), terminator); got != expected {
+				t.Errorf("Expected %q for %q, got %q", expected, request, got)
+			}
+		}
+		for _, cmd := range backend.commands() {
+			if name := commandName(cmd); name == "SHUTDOWN" || name == "RELOAD" || name == "SCAN" {
+				t.Errorf("Blocked command %q reached the backend", cmd)
+			}
+		}
+	})
+
+	t.Run("INSTREAM", func(t *testing.T) {
+		tests := []struct {
+			name     string
+			data     []byte
+			expected string
+		}{
+			{"EICAR", []byte(eicar), "stream: Eicar-Test-Signature FOUND\x00"},
+			{"Clean", bytes.Repeat([]byte("clean data "), 10000), "stream: OK\x00"},
+		}
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				// Small chunks, so the signature spans several of them
+				if got := roundTrip(t, proxy, streamRequest(tc.data, 16), nullDelimiter); got != tc.expected {
+					t.Errorf("Expected %q, got %q", tc.expected, got)
+				}
+			})
+		}
+	})
+
+	t.Run("Concurrent clients", func(t *testing.T) {
+		var wg sync.WaitGroup
+		errs := make(chan error, 20)
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				data, expected := []byte(fmt.Sprintf("client %d", i)), "stream: OK\x00"
+				if i%2 == 0 {
+					data, expected = []byte(eicar), "stream: Eicar-Test-Signature FOUND\x00"
+				}
+
+				conn, err := net.Dial("tcp", proxy)
+				if err != nil {
+					errs <- err
+					return
+				}
+				defer conn.Close()
+				_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+				if _, err := conn.Write(streamRequest(data, 7)); err != nil {
+					errs <- err
+					return
+				}
+				reply, err := bufio.NewReader(conn).ReadString(nullDelimiter)
+				if err != nil || reply != expected {
+					errs <- fmt.Errorf("client %d: expected %q, got %q (%v)", i, expected, reply, err)
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Error(err)
+		}
+	})
+}
@@ -0,0 +1,26 @@
+package proxy
+
+import (
+	"net"
+	"time"
+)
+
+// setKeepAlive configures TCP keepalive on conn so dead peers behind a
+// firewall are noticed: probes start after period of silence, and a period of
+// 0 turns keepalive off. Connections that aren't plain TCP, such as Unix
+// sockets, are left alone. Nagle's algorithm needs no tuning, since the net
+// package already disables it for every TCP connection.
+func setKeepAlive(conn net.Conn, period time.Duration) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	if period <= 0 {
+		return tcpConn.SetKeepAlive(false)
+	}
+	if err := tcpConn.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return tcpConn.SetKeepAlivePeriod(period)
+}
@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSetKeepAlive(t *testing.T) {
+	dialed, accepted := tcpPair(t)
+
+	if err := setKeepAlive(dialed, 30*time.Second); err != nil {
+		t.Errorf("Expected keepalive to be enabled on a TCP connection, got %v", err)
+	}
+	if err := setKeepAlive(accepted, 0); err != nil {
+		t.Errorf("Expected keepalive to be disabled on a TCP connection, got %v", err)
+	}
+
+	// Other connection types are skipped
+	pipeClient, pipeServer := net.Pipe()
+	defer pipeClient.Close()
+	defer pipeServer.Close()
+	if err := setKeepAlive(pipeClient, 30*time.Second); err != nil {
+		t.Errorf("Expected non-TCP connections to be skipped, got %v", err)
+	}
+
+	// The connection still works afterwards
+	if _, err := dialed.Write([]byte("zPING\x00")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	buf := make([]byte, 6)
+	_ = accepted.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := accepted.Read(buf); err != nil {
+		t.Errorf("Failed to read after configuring keepalive: %v", err)
+	}
+}
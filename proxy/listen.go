@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// listenAddress returns the network and address to bind a --listen value
+// to. Unix sockets are given as unix:/path or as an absolute path, anything
+// else is a TCP host:port.
+func listenAddress(addr string) (network, address string) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return "unix", path
+	}
+	if strings.HasPrefix(addr, "/") {
+		return "unix", addr
+	}
+	return "tcp", addr
+}
+
+// listenAll binds every --listen address. If any of them fails, the ones
+// already bound are closed again and the error names the failing address.
+func (p *Proxy) listenAll(addrs []string) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		listener, err := net.Listen(listenAddress(addr))
+		if err != nil {
+			p.closeListeners(listeners)
+			return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// closeListeners closes every listener, logging failures
+func (p *Proxy) closeListeners(listeners []net.Listener) {
+	for _, listener := range listeners {
+		if err := listener.Close(); err != nil {
+			p.logger.Error("Failed to close listener", "addr", listener.Addr().String(), "error", err)
+		}
+	}
+}
+
+// listenAddrs returns the addresses the listeners are bound to, for logging
+func listenAddrs(listeners []net.Listener) []string {
+	addrs := make([]string, 0, len(listeners))
+	for _, listener := range listeners {
+		addrs = append(addrs, listener.Addr().String())
+	}
+	return addrs
+}
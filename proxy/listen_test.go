@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestListenAddress(t *testing.T) {
+	tests := []struct {
+		addr    string
+		network string
+		address string
+	}{
+		{"127.0.0.1:3310", "tcp", "127.0.0.1:3310"},
+		{"[::1]:3310", "tcp", "[::1]:3310"},
+		{"unix:/run/clamdproxy.sock", "unix", "/run/clamdproxy.sock"},
+		{"/run/clamdproxy.sock", "unix", "/run/clamdproxy.sock"},
+	}
+	for _, test := range tests {
+		network, address := listenAddress(test.addr)
+		if network != test.network || address != test.address {
+			t.Errorf("Expected %s %s for %q, got %s %s", test.network, test.address, test.addr, network, address)
+		}
+	}
+}
+
+func TestListenAll(t *testing.T) {
+	srv := newTestProxy(t)
+	socket := filepath.Join(t.TempDir(), "clamdproxy.sock")
+	listeners, err := srv.listenAll([]string{"127.0.0.1:0", "unix:" + socket})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	if len(listeners) != 2 {
+		t.Fatalf("Expected 2 listeners, got %d", len(listeners))
+	}
+	defer srv.closeListeners(listeners[1:])
+	if network := listeners[1].Addr().Network(); network != "unix" {
+		t.Errorf("Expected a unix listener, got %s", network)
+	}
+
+	// A failing address is named and the ones bound before it are released
+	tcpAddr := listeners[0].Addr().String()
+	srv.closeListeners(listeners[:1])
+	_, err = srv.listenAll([]string{tcpAddr, "unix:" + socket})
+	if err == nil || !strings.Contains(err.Error(), socket) {
+		t.Fatalf("Expected an error naming %s, got %v", socket, err)
+	}
+	listener, err := net.Listen("tcp", tcpAddr)
+	if err != nil {
+		t.Fatalf("Expected %s to be released, got %v", tcpAddr, err)
+	}
+	_ = listener.Close()
+}
+
+func TestServeListeners(t *testing.T) {
+	srv := newTestProxy(t)
+	socket := filepath.Join(t.TempDir(), "clamdproxy.sock")
+	listeners, err := srv.listenAll([]string{"127.0.0.1:0", "unix:" + socket})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	shutdown := make(chan struct{})
+	handled := make(chan string, 2)
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.serveListeners(listeners, shutdown, func(conn net.Conn, listener string) {
+			handled <- listener
+			_ = conn.Close()
+		})
+	}()
+
+	// Connections on every listener reach the same handler, along with the
+	// address of the listener
+	for _, listener := range listeners {
+		conn, err := net.Dial(listener.Addr().Network(), listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to connect to %s: %v", listener.Addr(), err)
+		}
+		_, _ = conn.Read(make([]byte, 1)) // Returns once the handler closed it
+		_ = conn.Close()
+		if got := <-handled; got != listener.Addr().String() {
+			t.Errorf("Expected listener %s, got %s", listener.Addr(), got)
+		}
+	}
+
+	close(shutdown)
+	srv.closeListeners(listeners)
+	if err := <-served; err != nil {
+		t.Errorf("Expected a clean stop after shutdown, got %v", err)
+	}
+}
+
+func TestServeListenersFailure(t *testing.T) {
+	srv := newTestProxy(t)
+	listeners, err := srv.listenAll([]string{"127.0.0.1:0", "127.0.0.1:0"})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	fatal := &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EINVAL)}
+	failing := &scriptedListener{Listener: listeners[1], results: []error{fatal}}
+
+	// One failing listener closes the other too, reporting the failure
+	err = srv.serveListeners([]net.Listener{listeners[0], failing}, make(chan struct{}), nil)
+	if !errors.Is(err, syscall.EINVAL) {
+		t.Fatalf("Expected %v, got %v", syscall.EINVAL, err)
+	}
+	if !strings.Contains(err.Error(), failing.Addr().String()) {
+		t.Errorf("Expected the error to name %s, got %v", failing.Addr(), err)
+	}
+}
@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// proxyMetrics holds the counters describing the activity of a Proxy.
+// All fields are updated atomically and may be read at any time.
+type proxyMetrics struct {
+	connectionsActive   atomic.Int64 // Client connections currently being handled
+	connectionsTotal    atomic.Int64 // Client connections accepted since start
+	connectionsRejected atomic.Int64 // Client connections turned away by the worker pool
+	commandsBlocked     atomic.Int64 // Commands refused by the filter
+	commandsWouldBlock  atomic.Int64 // Commands forwarded in dry-run mode that the filter would refuse
+	commandsUnknown     atomic.Int64 // Blocked commands clamd doesn't know either, likely protocol errors
+
+	instreamClientBytes    atomic.Int64 // INSTREAM payload bytes received from clients
+	instreamBackendBytes   atomic.Int64 // INSTREAM payload bytes forwarded to backends
+	instreamUnpooledChunks atomic.Int64 // INSTREAM chunks too large for a pooled buffer
+
+	// Completed INSTREAM streams by size, see streamCompleted
+	streamSizes     [len(streamSizeBuckets) + 1]atomic.Int64 // Per bucket, the last one unbounded
+	streamSizeTotal atomic.Int64                             // Sum of all stream sizes
+
+	scansClean    atomic.Int64 // Scans the backend reported as OK
+	scansInfected atomic.Int64 // Scans the backend reported as FOUND
+	scansError    atomic.Int64 // Scans the backend failed with an ERROR
+
+	blockedMu        sync.Mutex
+	blockedByCommand map[string]int64 // Blocked commands by metric label, see commandLabel
+
+	listenerMu            sync.Mutex
+	connectionsByListener map[string]int64 // Accepted connections by listener address
+}
+
+// snapshot returns the current counter values keyed by metric name
+func (m *proxyMetrics) snapshot() map[string]int64 {
+	return map[string]int64{
+		"connections_active":       m.connectionsActive.Load(),
+		"connections_total":        m.connectionsTotal.Load(),
+		"connections_rejected":     m.connectionsRejected.Load(),
+		"commands_blocked":         m.commandsBlocked.Load(),
+		"commands_would_block":     m.commandsWouldBlock.Load(),
+		"commands_unknown":         m.commandsUnknown.Load(),
+		"instream_client_bytes":    m.instreamClientBytes.Load(),
+		"instream_backend_bytes":   m.instreamBackendBytes.Load(),
+		"instream_unpooled_chunks": m.instreamUnpooledChunks.Load(),
+		"scans_clean":              m.scansClean.Load(),
+		"scans_infected":           m.scansInfected.Load(),
+		"scans_error":              m.scansError.Load(),
+	}
+}
+
+// streamSizeBuckets are the upper bounds, in bytes, of the INSTREAM stream
+// size histogram
+var streamSizeBuckets = [...]int64{1 << 20, 10 << 20, 25 << 20}
+
+// streamCompleted records the size of a stream forwarded in full in the
+// first bucket it fits
+func (m *proxyMetrics) streamCompleted(size int64) {
+	i := 0
+	for i < len(streamSizeBuckets) && size > streamSizeBuckets[i] {
+		i++
+	}
+	m.streamSizes[i].Add(1)
+	m.streamSizeTotal.Add(size)
+}
+
+// commandLabel returns the metric label for a command name: the name itself
+// for commands clamd knows and "other" for anything else, so clients can't
+// create an unbounded number of metric labels
+func commandLabel(name string) string {
+	if clamdCommands[name] {
+		return name
+	}
+	return "other"
+}
+
+// commandBlocked records a command refused by the filter. Names clamd
+// doesn't know are also counted as unknown, so a malformed client can be
+// told apart from a policy block.
+func (m *proxyMetrics) commandBlocked(name string) {
+	m.commandsBlocked.Add(1)
+	if !clamdCommands[name] {
+		m.commandsUnknown.Add(1)
+	}
+
+	m.blockedMu.Lock()
+	defer m.blockedMu.Unlock()
+	if m.blockedByCommand == nil {
+		m.blockedByCommand = make(map[string]int64)
+	}
+	m.blockedByCommand[commandLabel(name)]++
+}
+
+// blockedCommands returns a copy of the blocked command counts by label
+func (m *proxyMetrics) blockedCommands() map[string]int64 {
+	m.blockedMu.Lock()
+	defer m.blockedMu.Unlock()
+
+	counts := make(map[string]int64, len(m.blockedByCommand))
+	for label, count := range m.blockedByCommand {
+		counts[label] = count
+	}
+	return counts
+}
+
+// connectionOpened records a new client connection accepted by listener and
+// warns when the number of active connections reaches one of the configured
+// high-water marks
+func (p *Proxy) connectionOpened(listener string) {
+	m := &p.metrics
+	m.connectionsTotal.Add(1)
+	active := m.connectionsActive.Add(1)
+
+	m.listenerMu.Lock()
+	if m.connectionsByListener == nil {
+		m.connectionsByListener = make(map[string]int64)
+	}
+	m.connectionsByListener[listener]++
+	m.listenerMu.Unlock()
+
+	for _, mark := range p.cfg.ActiveHighWater {
+		if active == int64(mark) {
+			p.logger.Warn("Active connections reached high-water mark",
+				"active", active,
+				"mark", mark)
+		}
+	}
+}
+
+// listenerConnections returns a copy of the connection counts by listener.
+// Listeners are fixed at startup, so there are only as many as --listen
+// addresses.
+func (m *proxyMetrics) listenerConnections() map[string]int64 {
+	m.listenerMu.Lock()
+	defer m.listenerMu.Unlock()
+
+	counts := make(map[string]int64, len(m.connectionsByListener))
+	for listener, count := range m.connectionsByListener {
+		counts[listener] = count
+	}
+	return counts
+}
+
+// connectionClosed records the end of a client connection
+func (m *proxyMetrics) connectionClosed() {
+	m.connectionsActive.Add(-1)
+}
+
+// statsResponse is the JSON document served by the stats endpoint
+type statsResponse struct {
+	Active    int64            `json:"active"`
+	Total     int64            `json:"total"`
+	Blocked   int64            `json:"blocked"`
+	Unknown   int64            `json:"unknown"`
+	ByCommand map[string]int64 `json:"blocked_by_command"` // Keyed by commandLabel
+	Listeners map[string]int64 `json:"connections_by_listener"`
+}
+
+// statsHandler serves the connection and command counters as JSON
+func (p *Proxy) statsHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	stats := statsResponse{
+		Active:    p.metrics.connectionsActive.Load(),
+		Total:     p.metrics.connectionsTotal.Load(),
+		Blocked:   p.metrics.commandsBlocked.Load(),
+		Unknown:   p.metrics.commandsUnknown.Load(),
+		ByCommand: p.metrics.blockedCommands(),
+		Listeners: p.metrics.listenerConnections(),
+	}
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		p.logger.Debug("Error writing stats response", "error", err)
+	}
+}
+
+// varsHandler serves /debug/vars like expvar.Handler, with the counters of
+// this Proxy added as "clamdproxy"
+func (p *Proxy) varsHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	vars := map[string]json.RawMessage{
+		"clamdproxy": json.RawMessage(expvar.Func(func() interface{} {
+			return p.metrics.snapshot()
+		}).String()),
+	}
+	expvar.Do(func(kv expvar.KeyValue) {
+		vars[kv.Key] = json.RawMessage(kv.Value.String())
+	})
+	if err := json.NewEncoder(w).Encode(vars); err != nil {
+		p.logger.Debug("Error writing vars response", "error", err)
+	}
+}
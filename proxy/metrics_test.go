@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestConnectionGauge(t *testing.T) {
+	srv := newTestProxy(t)
+
+	srv.connectionOpened("test")
+	srv.connectionOpened("test")
+	if got := srv.metrics.connectionsActive.Load(); got != 2 {
+		t.Errorf("Expected 2 active connections, got %d", got)
+	}
+
+	srv.metrics.connectionClosed()
+	if got := srv.metrics.connectionsActive.Load(); got != 1 {
+		t.Errorf("Expected 1 active connection, got %d", got)
+	}
+	if got := srv.metrics.connectionsTotal.Load(); got != 2 {
+		t.Errorf("Expected 2 total connections, got %d", got)
+	}
+}
+
+func TestStatsHandler(t *testing.T) {
+	srv := newTestProxy(t)
+	srv.connectionOpened("test")
+	for _, cmd := range []string{"SCAN /etc", "zSCAN /tmp", "nSCAN /var", "zSHUTDOWN"} {
+		srv.metrics.commandBlocked(commandName(cmd))
+	}
+
+	recorder := httptest.NewRecorder()
+	srv.statsHandler(recorder, httptest.NewRequest("GET", "/stats", nil))
+
+	if ct := recorder.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected JSON content type, got %q", ct)
+	}
+
+	var stats statsResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("Invalid JSON response %q: %v", recorder.Body.String(), err)
+	}
+	if stats.Active != 1 || stats.Total != 1 || stats.Blocked != 4 {
+		t.Errorf("Expected 1 active, 1 total and 4 blocked, got %+v", stats)
+	}
+
+	// Prefixed variants are counted under the same name
+	if got := stats.ByCommand["SCAN"]; got != 3 {
+		t.Errorf("Expected 3 blocked SCAN commands, got %d", got)
+	}
+	if got := stats.ByCommand["SHUTDOWN"]; got != 1 {
+		t.Errorf("Expected 1 blocked SHUTDOWN command, got %d", got)
+	}
+}
+
+func TestStreamSizeHistogram(t *testing.T) {
+	tests := []struct {
+		size   int64
+		bucket int
+	}{
+		{0, 0},
+		{1 << 20, 0},
+		{1<<20 + 1, 1},
+		{10 << 20, 1},
+		{20 << 20, 2},
+		{30 << 20, 3},
+	}
+
+	for _, tc := range tests {
+		var m proxyMetrics
+		m.streamCompleted(tc.size)
+		if got := m.streamSizes[tc.bucket].Load(); got != 1 {
+			t.Errorf("Expected a %d byte stream in bucket %d, got %d there", tc.size, tc.bucket, got)
+		}
+		if got := m.streamSizeTotal.Load(); got != tc.size {
+			t.Errorf("Expected the sum to grow by %d, got %d", tc.size, got)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Backend pool tuning
+const (
+	// clamd drops connections that send no command within its
+	// CommandReadTimeout, 30s by default, so idle connections are replaced
+	// well before that
+	backendPoolMaxIdle = 20 * time.Second
+
+	// backendPoolProbe is how long evictStale reads a pooled connection to
+	// tell a live one, which stays silent, from one clamd has closed
+	backendPoolProbe = time.Millisecond
+)
+
+// errBackendParked ends the backend reader of a proxy whose unused backend
+// connection is kept for reuse, see ClamdProxy.closeBackend
+var errBackendParked = errors.New("backend connection parked for reuse")
+
+// backendPool keeps up to --backend-pool-size idle backend connections open,
+// so clients don't wait for a dial. clamd closes a connection once it has
+// answered a command outside of a session, so only connections that never
+// carried a command are returned to the pool; any other is closed and a
+// fresh one dialed in its place.
+type backendPool struct {
+	server *Proxy
+	addrs  []string
+	idle   chan pooledConn
+	now    func() time.Time
+
+	ctx    context.Context // Of the refill dials, cancelled by close
+	cancel context.CancelFunc
+
+	filling atomic.Bool   // A refill is running
+	wake    chan struct{} // Signals run to refill
+	stop    chan struct{} // Closed by close
+	done    chan struct{} // Closed once run has returned
+}
+
+// pooledConn is an idle backend connection and when it was opened or
+// returned
+type pooledConn struct {
+	conn  net.Conn
+	since time.Time
+}
+
+// backendPoolFor returns the shared pool for the given backends, starting
+// it on first use. Clients routed to different backends by SNI get
+// connections from different pools.
+func (p *Proxy) backendPoolFor(addrs []string) *backendPool {
+	key := strings.Join(addrs, ",")
+
+	p.poolsMu.Lock()
+	defer p.poolsMu.Unlock()
+
+	pool, ok := p.pools[key]
+	if !ok {
+		pool = p.newBackendPool(addrs, p.cfg.BackendPoolSize)
+		go pool.run()
+		p.pools[key] = pool
+	}
+	return pool
+}
+
+// closeBackendPools stops every pool and closes its idle connections
+func (p *Proxy) closeBackendPools() {
+	p.poolsMu.Lock()
+	defer p.poolsMu.Unlock()
+
+	for key, pool := range p.pools {
+		pool.close()
+		delete(p.pools, key)
+	}
+}
+
+// newBackendPool returns a pool holding up to size connections to addrs.
+// Call run to fill it and keep it filled.
+func (p *Proxy) newBackendPool(addrs []string, size int) *backendPool {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &backendPool{
+		server: p,
+		addrs:  addrs,
+		idle:   make(chan pooledConn, size),
+		now:    time.Now,
+		ctx:    ctx,
+		cancel: cancel,
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// run fills the pool, then refills it whenever a connection is taken and
+// replaces connections idle for too long, until close
+func (p *backendPool) run() {
+	defer close(p.done)
+
+	ticker := time.NewTicker(backendPoolMaxIdle / 4)
+	defer ticker.Stop()
+
+	for {
+		p.refill()
+		select {
+		case <-ticker.C:
+			p.evictStale()
+		case <-p.wake:
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// close stops run, without waiting for a refill dial in progress, and
+// closes the idle connections
+func (p *backendPool) close() {
+	p.cancel()
+	close(p.stop)
+	<-p.done
+	for {
+		select {
+		case pc := <-p.idle:
+			_ = pc.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// get returns an idle connection from the pool, or dials a new one within
+// ctx if there is none left
+func (p *backendPool) get(ctx context.Context, clientAddr, connID string) (net.Conn, error) {
+	defer p.signalRefill()
+
+	for {
+		select {
+		case pc := <-p.idle:
+			if p.now().Sub(pc.since) >= backendPoolMaxIdle {
+				_ = pc.conn.Close()
+				continue
+			}
+			p.server.logger.Debug("Using pooled backend connection",
+				"conn_id", connID,
+				"client", clientAddr,
+				"backend", pc.conn.RemoteAddr().String())
+			return pc.conn, nil
+		default:
+			return p.server.dialBackend(ctx, p.addrs, clientAddr, connID)
+		}
+	}
+}
+
+// put returns a connection that never carried a command to the pool, or
+// closes it if the pool is full. Whether it is still usable is left to
+// evictStale, so neither put nor get waits on a probe.
+func (p *backendPool) put(conn net.Conn) {
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		_ = conn.Close()
+		return
+	}
+
+	select {
+	case p.idle <- pooledConn{conn, p.now()}:
+	default:
+		_ = conn.Close()
+	}
+}
+
+// signalRefill asks run to top the pool up again
+func (p *backendPool) signalRefill() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// refill dials connections until the pool is full. A failed dial stops it
+// until the next signal or tick; clients then dial for themselves, with the
+// usual retries. With --breaker-threshold set, refill dials count towards the
+// circuit breaker and none are made unless it is closed: client dials probe
+// the backend, and the pool fills up again once it has recovered.
+func (p *backendPool) refill() {
+	if !p.filling.CompareAndSwap(false, true) {
+		return
+	}
+	defer p.filling.Store(false)
+
+	useBreaker := p.server.cfg.BreakerThreshold > 0
+	for len(p.idle) < cap(p.idle) {
+		if useBreaker && !p.server.breaker.closed() {
+			return
+		}
+		conn, err := p.server.dialBackendOnce(p.ctx, p.server.backendOrder(p.addrs), "", "pool")
+		if err != nil {
+			if useBreaker && p.ctx.Err() == nil {
+				p.server.breaker.failure(p.server.cfg.BreakerThreshold)
+			}
+			return
+		}
+		if useBreaker {
+			p.server.breaker.success()
+		}
+		select {
+		case p.idle <- pooledConn{conn, p.now()}:
+		default:
+			_ = conn.Close() // Filled up by returned connections meanwhile
+			return
+		}
+	}
+}
+
+// evictStale closes connections that have been idle for too long, before
+// clamd times them out, and those clamd has closed or sent something on
+// meanwhile. It runs every few seconds off the client path, as the check
+// blocks for backendPoolProbe on each connection.
+func (p *backendPool) evictStale() {
+	for n := len(p.idle); n > 0; n-- {
+		select {
+		case pc := <-p.idle:
+			if p.now().Sub(pc.since) >= backendPoolMaxIdle || !isIdleConnAlive(pc.conn) {
+				_ = pc.conn.Close()
+				continue
+			}
+			select {
+			case p.idle <- pc:
+			default:
+				_ = pc.conn.Close()
+			}
+		default:
+			return
+		}
+	}
+}
+
+// isIdleConnAlive reports whether an idle backend connection can still be
+// used: clamd hasn't closed it and it has nothing unread
+func isIdleConnAlive(conn net.Conn) bool {
+	if err := conn.SetReadDeadline(time.Now().Add(backendPoolProbe)); err != nil {
+		return false
+	}
+	var b [1]byte
+	_, err := conn.Read(b[:])
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return false
+	}
+	return isTimeout(err)
+}
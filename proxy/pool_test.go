@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBackendListener accepts connections like a clamd waiting for commands
+// and returns them on the channel
+func fakeBackendListener(t *testing.T) (string, <-chan net.Conn) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	accepted := make(chan net.Conn, 16)
+	var conns []net.Conn
+	var mu sync.Mutex
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			accepted <- conn
+		}
+	}()
+	t.Cleanup(func() {
+		_ = ln.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			_ = conn.Close()
+		}
+	})
+	return ln.Addr().String(), accepted
+}
+
+func TestBackendPoolBreaker(t *testing.T) {
+	srv := newTestProxy(t, func(c *Config) {
+		c.BreakerThreshold = 1
+		c.BreakerCooldown = time.Hour
+	})
+
+	calls := 0
+	srv.netDial = func(_ context.Context, network, addr string) (net.Conn, error) {
+		calls++
+		return nil, errors.New("no such host")
+	}
+
+	pool := srv.newBackendPool([]string{"backend:3310"}, 2)
+	defer pool.close()
+	close(pool.done) // run isn't started, the test refills by hand
+
+	// A failed refill opens the breaker, after which refills stop dialing
+	pool.refill()
+	if srv.breaker.closed() {
+		t.Fatal("Expected the failed refill to open the breaker")
+	}
+	pool.refill()
+	if calls != 1 {
+		t.Errorf("Expected the open breaker to stop refills, got %d dials", calls)
+	}
+}
+
+func TestBackendPoolBorrowReturn(t *testing.T) {
+	addr, accepted := fakeBackendListener(t)
+	pool := newTestProxy(t).newBackendPool([]string{addr}, 1)
+	defer pool.close()
+	close(pool.done) // run isn't started, the test refills by hand
+
+	pool.refill()
+	<-accepted
+	if len(pool.idle) != 1 {
+		t.Fatalf("Expected 1 idle connection, got %d", len(pool.idle))
+	}
+
+	conn, err := pool.get(context.Background(), "client", "test")
+	if err != nil {
+		t.Fatalf("Failed to get a connection: %v", err)
+	}
+	if len(pool.idle) != 0 {
+		t.Errorf("Expected the pool to be empty, got %d", len(pool.idle))
+	}
+	select {
+	case <-pool.wake:
+	default:
+		t.Error("Expected taking a connection to signal a refill")
+	}
+
+	// A returned connection is handed out again without a new dial
+	pool.put(conn)
+	again, err := pool.get(context.Background(), "client", "test")
+	if err != nil {
+		t.Fatalf("Failed to get a connection: %v", err)
+	}
+	if again != conn {
+		t.Error("Expected the returned connection to be reused")
+	}
+	select {
+	case <-accepted:
+		t.Error("Expected no further dial")
+	default:
+	}
+
+	// An empty pool dials for the client
+	fresh, err := pool.get(context.Background(), "client", "test")
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer fresh.Close()
+	if fresh == conn {
+		t.Error("Expected a freshly dialed connection")
+	}
+	_ = conn.Close()
+}
+
+func TestBackendPoolDiscardsUnusable(t *testing.T) {
+	addr, accepted := fakeBackendListener(t)
+	pool := newTestProxy(t).newBackendPool([]string{addr}, 2)
+	defer pool.close()
+	close(pool.done)
+
+	now := time.Now()
+	pool.now = func() time.Time { return now }
+
+	// Closed by clamd while idle
+	pool.refill()
+	closed := <-accepted
+	_ = closed.Close()
+	<-accepted
+	time.Sleep(10 * time.Millisecond) // Let the FIN arrive
+
+	pool.evictStale()
+	if len(pool.idle) != 1 {
+		t.Fatalf("Expected only the closed connection to be evicted, got %d idle", len(pool.idle))
+	}
+
+	// Idle for too long
+	now = now.Add(backendPoolMaxIdle)
+	pool.evictStale()
+	if len(pool.idle) != 0 {
+		t.Fatalf("Expected stale connections to be evicted, got %d", len(pool.idle))
+	}
+
+	// Returned with a reply or after the backend went away; put doesn't
+	// probe them, the next eviction run does
+	pool.refill()
+	withData, withDataPeer := <-accepted, <-accepted
+	conn1, _ := pool.get(context.Background(), "client", "test")
+	conn2, _ := pool.get(context.Background(), "client", "test")
+	_, _ = withData.Write([]byte("PONG\n"))
+	_ = withDataPeer.Close()
+	time.Sleep(10 * time.Millisecond)
+	pool.put(conn1)
+	pool.put(conn2)
+	if len(pool.idle) != 2 {
+		t.Fatalf("Expected put to return both connections, got %d", len(pool.idle))
+	}
+	pool.evictStale()
+	if len(pool.idle) != 0 {
+		t.Errorf("Expected unusable connections to be discarded, got %d", len(pool.idle))
+	}
+}
+
+func TestBackendReusable(t *testing.T) {
+	tests := []struct {
+		name        string
+		request     string
+		idleTimeout time.Duration
+		reusable    bool
+	}{
+		{"Client sent nothing", "", 0, true},
+		{"Client sent nothing with idle timeout", "", time.Minute, true},
+		{"Command forwarded", "zVERSION\x00", 0, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := newTestProxy(t, func(c *Config) { c.IdleTimeout = tc.idleTimeout })
+			clientSide, proxyClient := tcpPair(t)
+			proxyBackend, backendSide := tcpPair(t)
+
+			p := srv.NewClamdProxy(proxyClient, proxyBackend)
+			p.parkBackend = true
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				p.Start()
+				_ = proxyClient.Close()
+				<-p.clientDone
+			}()
+
+			if tc.request != "" {
+				_, _ = clientSide.Write([]byte(tc.request))
+				forwarded := make([]byte, len(tc.request))
+				if _, err := io.ReadFull(backendSide, forwarded); err != nil {
+					t.Fatalf("Failed to read forwarded command: %v", err)
+				}
+				// clamd answers and closes, as outside of a session
+				_, _ = backendSide.Write([]byte("ClamAV 1.4.2\x00"))
+				_ = backendSide.Close()
+			}
+			_ = clientSide.Close()
+
+			select {
+			case <-done:
+			case <-time.After(2 * time.Second):
+				t.Fatal("Proxy did not finish after client closed")
+			}
+			if got := p.backendReusable(); got != tc.reusable {
+				t.Errorf("Expected reusable %v, got %v", tc.reusable, got)
+			}
+			if tc.reusable && !isIdleConnAlive(proxyBackend) {
+				t.Error("Expected the parked connection to stay open")
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"bufio"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// promMetric describes one metric family of the Prometheus exposition
+type promMetric struct {
+	name    string
+	help    string
+	kind    string // counter or gauge
+	samples []promSample
+}
+
+// promHistogram is a histogram metric family
+type promHistogram struct {
+	name   string
+	help   string
+	bounds []int64 // Upper bounds of the buckets but the unbounded last one
+	counts []int64 // Observations per bucket, not cumulative, one more than bounds
+	sum    int64
+}
+
+// promSample is a single value of a metric family, with an optional label
+type promSample struct {
+	label string // Label name, empty for an unlabeled sample
+	value string // Label value
+	count int64
+}
+
+// promMetrics collects the current counters as Prometheus metric families
+func (p *Proxy) promMetrics() []promMetric {
+	blocked := p.metrics.blockedCommands()
+	labels := make([]string, 0, len(blocked))
+	for label := range blocked {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	blockedSamples := make([]promSample, 0, len(labels))
+	for _, label := range labels {
+		blockedSamples = append(blockedSamples, promSample{"command", label, blocked[label]})
+	}
+
+	byListener := p.metrics.listenerConnections()
+	listeners := make([]string, 0, len(byListener))
+	for listener := range byListener {
+		listeners = append(listeners, listener)
+	}
+	sort.Strings(listeners)
+
+	listenerSamples := make([]promSample, 0, len(listeners))
+	for _, listener := range listeners {
+		listenerSamples = append(listenerSamples, promSample{"listener", listener, byListener[listener]})
+	}
+
+	return []promMetric{
+		{"clamdproxy_connections_total", "Client connections accepted since start.", "counter",
+			[]promSample{{count: p.metrics.connectionsTotal.Load()}}},
+		{"clamdproxy_listener_connections_total", "Client connections accepted since start, by listener address.", "counter",
+			listenerSamples},
+		{"clamdproxy_connections_active", "Client connections currently being handled.", "gauge",
+			[]promSample{{count: p.metrics.connectionsActive.Load()}}},
+		{"clamdproxy_connections_rejected_total", "Client connections closed because the worker queue was full.", "counter",
+			[]promSample{{count: p.metrics.connectionsRejected.Load()}}},
+		{"clamdproxy_commands_blocked_total", "Commands refused by the filter, by command.", "counter",
+			blockedSamples},
+		{"clamdproxy_commands_unknown_total", "Blocked commands that are not clamd commands at all, likely client protocol errors.", "counter",
+			[]promSample{{count: p.metrics.commandsUnknown.Load()}}},
+		{"clamdproxy_instream_bytes_total", "INSTREAM payload bytes received from clients and forwarded to backends.", "counter",
+			[]promSample{
+				{"direction", "client", p.metrics.instreamClientBytes.Load()},
+				{"direction", "backend", p.metrics.instreamBackendBytes.Load()},
+			}},
+		{"clamdproxy_instream_unpooled_chunks_total", "INSTREAM chunks read into a buffer of their own, of up to 1MB, because they did not fit a pooled buffer.", "counter",
+			[]promSample{{count: p.metrics.instreamUnpooledChunks.Load()}}},
+		{"clamdproxy_scans_total", "INSTREAM scans by verdict.", "counter",
+			[]promSample{
+				{"result", verdictClean.String(), p.metrics.scansClean.Load()},
+				{"result", verdictInfected.String(), p.metrics.scansInfected.Load()},
+				{"result", verdictError.String(), p.metrics.scansError.Load()},
+			}},
+	}
+}
+
+// promHistograms collects the current histograms
+func (p *Proxy) promHistograms() []promHistogram {
+	sizes := promHistogram{
+		name:   "clamdproxy_instream_stream_bytes",
+		help:   "Size of INSTREAM streams forwarded in full.",
+		bounds: streamSizeBuckets[:],
+		counts: make([]int64, len(p.metrics.streamSizes)),
+		sum:    p.metrics.streamSizeTotal.Load(),
+	}
+	for i := range p.metrics.streamSizes {
+		sizes.counts[i] = p.metrics.streamSizes[i].Load()
+	}
+	return []promHistogram{sizes}
+}
+
+// promHandler serves the counters in the Prometheus text exposition format
+func (p *Proxy) promHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	out := bufio.NewWriter(w)
+	for _, m := range p.promMetrics() {
+		writePromMetric(out, m)
+	}
+	for _, h := range p.promHistograms() {
+		writePromHistogram(out, h)
+	}
+	if err := out.Flush(); err != nil {
+		p.logger.Debug("Error writing metrics response", "error", err)
+	}
+}
+
+// promLabelEscaper escapes a label value, e.g. a socket path, the way the
+// text format requires: only backslashes, quotes and newlines are escaped,
+// anything else, including UTF-8, is written as it is
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writePromMetric writes a metric family with its HELP and TYPE lines
+func writePromMetric(out *bufio.Writer, m promMetric) {
+	out.WriteString("# HELP " + m.name + " " + m.help + "\n")
+	out.WriteString("# TYPE " + m.name + " " + m.kind + "\n")
+	for _, s := range m.samples {
+		out.WriteString(m.name)
+		if s.label != "" {
+			out.WriteString("{" + s.label + "=\"" + promLabelEscaper.Replace(s.value) + "\"}")
+		}
+		out.WriteString(" " + strconv.FormatInt(s.count, 10) + "\n")
+	}
+}
+
+// writePromHistogram writes a histogram family with its HELP and TYPE lines:
+// the cumulative buckets followed by the sum and count
+func writePromHistogram(out *bufio.Writer, h promHistogram) {
+	name := h.name
+	out.WriteString("# HELP " + name + " " + h.help + "\n")
+	out.WriteString("# TYPE " + name + " histogram\n")
+
+	var cumulative int64
+	for i, count := range h.counts {
+		cumulative += count
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = strconv.FormatInt(h.bounds[i], 10)
+		}
+		out.WriteString(name + "_bucket{le=\"" + le + "\"} " + strconv.FormatInt(cumulative, 10) + "\n")
+	}
+	out.WriteString(name + "_sum " + strconv.FormatInt(h.sum, 10) + "\n")
+	out.WriteString(name + "_count " + strconv.FormatInt(cumulative, 10) + "\n")
+}
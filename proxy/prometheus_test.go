@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPromHandler(t *testing.T) {
+	srv := newTestProxy(t)
+	srv.metrics.commandBlocked("SHUTDOWN")
+	srv.metrics.commandBlocked("NOTACOMMAND")
+	srv.metrics.scansInfected.Add(1)
+	srv.connectionOpened(`/run/clamd "proxy".sock`)
+	srv.metrics.connectionClosed()
+
+	recorder := httptest.NewRecorder()
+	srv.promHandler(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := recorder.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Expected text content type, got %q", ct)
+	}
+
+	body := recorder.Body.String()
+	for _, expected := range []string{
+		"# TYPE clamdproxy_connections_total counter\n",
+		"# TYPE clamdproxy_connections_active gauge\n",
+		`clamdproxy_listener_connections_total{listener="/run/clamd \"proxy\".sock"} `,
+		"clamdproxy_commands_blocked_total{command=\"SHUTDOWN\"} ",
+		"clamdproxy_commands_blocked_total{command=\"other\"} ",
+		"# TYPE clamdproxy_commands_unknown_total counter\n",
+		"clamdproxy_instream_bytes_total{direction=\"client\"} ",
+		"# TYPE clamdproxy_instream_unpooled_chunks_total counter\n",
+		"clamdproxy_scans_total{result=\"FOUND\"} ",
+		"clamdproxy_instream_stream_bytes_bucket{le=\"+Inf\"} ",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected %q in metrics output:\n%s", expected, body)
+		}
+	}
+}
+
+func TestWritePromMetricLabelEscaping(t *testing.T) {
+	var buf bytes.Buffer
+	out := bufio.NewWriter(&buf)
+	writePromMetric(out, promMetric{"test_total", "Test.", "counter",
+		[]promSample{{"listener", "/run/clamdé\tpath\\a\"b\"\n", 1}}})
+	_ = out.Flush()
+
+	// UTF-8 and control characters other than newline pass through
+	expected := "test_total{listener=\"/run/clamdé\tpath\\\\a\\\"b\\\"\\n\"} 1\n"
+	if got := strings.SplitAfterN(buf.String(), "\n", 3)[2]; got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+}
+
+func TestWritePromHistogram(t *testing.T) {
+	var buf bytes.Buffer
+	out := bufio.NewWriter(&buf)
+	writePromHistogram(out, promHistogram{
+		name:   "test_bytes",
+		help:   "Test sizes.",
+		bounds: []int64{10, 100},
+		counts: []int64{2, 0, 1},
+		sum:    215,
+	})
+	_ = out.Flush()
+
+	expected := `# HELP test_bytes Test sizes.
+# TYPE test_bytes histogram
+test_bytes_bucket{le="10"} 2
+test_bytes_bucket{le="100"} 2
+test_bytes_bucket{le="+Inf"} 3
+test_bytes_sum 215
+test_bytes_count 3
+`
+	if got := buf.String(); got != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, got)
+	}
+}
@@ -0,0 +1,1577 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/miklosn/clamdproxy/internal/transcript"
+)
+
+// cmdBufPool holds the buffers commands are read into. The other buffer
+// pools are sized by the flags and kept by each Proxy.
+var cmdBufPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, 256) // Most commands are small
+		return &buf
+	},
+}
+
+// defaultBufferSize is the default size of the client and backend writers
+// and of the buffer backend replies are read into
+const defaultBufferSize = 64 * 1024
+
+// minBufferSize is the smallest --client-buffer-size and --backend-buffer-size
+// accepted
+const minBufferSize = 1024
+
+// defaultChunkBufSize is the size of pooled INSTREAM chunk buffers. 32KB is
+// a good balance for most virus scanning.
+const defaultChunkBufSize = 32 * 1024
+
+// maxBufferedChunk is the largest INSTREAM chunk read in full before it is
+// forwarded, and the size of the pieces larger ones are forwarded in, see
+// forwardLargeChunk
+const maxBufferedChunk = 1024 * 1024
+
+// chunkBufferSize returns the pooled chunk buffer size for --max-chunk-bytes.
+// There is no point in buffers larger than the largest chunk accepted.
+func chunkBufferSize(maxChunkBytes int) int {
+	if maxChunkBytes > 0 {
+		return min(defaultChunkBufSize, maxChunkBytes)
+	}
+	return defaultChunkBufSize
+}
+
+// newChunkBuf allocates a chunk buffer for chunkBufPool
+func (p *Proxy) newChunkBuf() interface{} {
+	buf := make([]byte, p.chunkBufSize)
+	return &buf
+}
+
+// pooledChunkBuf returns a pooled buffer with room for size bytes, or nil if
+// the chunk is too large for the pool and needs a buffer of its own
+func (p *Proxy) pooledChunkBuf(size int) *[]byte {
+	if size > p.chunkBufSize {
+		return nil
+	}
+	bufPtr := p.chunkBufPool.Get().(*[]byte)
+	if cap(*bufPtr) < size {
+		// Never trust the pool to hand out what chunkBufSize promises
+		p.chunkBufPool.Put(bufPtr)
+		return nil
+	}
+	return bufPtr
+}
+
+// getWriter returns a buffered writer of the given size for w from pool
+func getWriter(pool *sync.Pool, w io.Writer, size int) *bufio.Writer {
+	if bw, ok := pool.Get().(*bufio.Writer); ok {
+		bw.Reset(w)
+		return bw
+	}
+	return bufio.NewWriterSize(w, size)
+}
+
+// putWriter returns a buffered writer to pool, dropping any unflushed data
+// and its reference to the underlying connection
+func putWriter(pool *sync.Pool, bw *bufio.Writer) {
+	bw.Reset(nil)
+	pool.Put(bw)
+}
+
+// getCopyBuf returns a pooled buffer of --client-buffer-size for reading
+// backend replies
+func (p *Proxy) getCopyBuf() *[]byte {
+	if bufPtr, ok := p.copyBufPool.Get().(*[]byte); ok {
+		return bufPtr
+	}
+	buf := make([]byte, p.cfg.ClientBufferSize)
+	return &buf
+}
+
+// Protocol constants
+const (
+	nullDelimiter    = byte(0)
+	newlineDelimiter = byte('\n')
+)
+
+// instreamProgressInterval is the number of INSTREAM chunks between progress
+// log lines at debug level
+const instreamProgressInterval = 100
+
+// errCommandTooLong is returned by readCommand when a command exceeds the length limit
+var errCommandTooLong = errors.New("command too long")
+
+// commandTooLongResponse is sent to clients whose command exceeded --max-command-length
+const commandTooLongResponse = "Command too long. ERROR"
+
+// backendUnavailableResponse is sent when the backend fails before answering a scan
+const backendUnavailableResponse = "ERROR: backend unavailable"
+
+// commandLimitResponse is sent before closing a connection that exceeded
+// --max-commands-per-conn
+const commandLimitResponse = "Command limit exceeded. ERROR"
+
+// errTooManyChunks is returned by handleInstream when a stream exceeds --max-stream-chunks
+var errTooManyChunks = errors.New("too many INSTREAM chunks")
+
+// tooManyChunksResponse answers a stream aborted for exceeding --max-stream-chunks
+const tooManyChunksResponse = "INSTREAM chunk limit exceeded. ERROR"
+
+// errChunkTooLarge is returned by handleInstream when a chunk exceeds --max-chunk-bytes
+var errChunkTooLarge = errors.New("INSTREAM chunk too large")
+
+// chunkTooLargeResponse answers a stream aborted for a chunk over --max-chunk-bytes
+const chunkTooLargeResponse = "INSTREAM chunk size limit exceeded. ERROR"
+
+// defaultBlockedResponse is clamd's own reply to a command it doesn't know
+const defaultBlockedResponse = "UNKNOWN COMMAND"
+
+// controlCharsResponse answers commands refused for containing control characters
+const controlCharsResponse = "Command contains control characters. ERROR"
+
+// clamdCommands are the command names clamd understands
+var clamdCommands = map[string]bool{
+	"PING": true, "VERSION": true, "VERSIONCOMMANDS": true, "RELOAD": true,
+	"SHUTDOWN": true, "SCAN": true, "CONTSCAN": true, "MULTISCAN": true,
+	"ALLMATCHSCAN": true, "INSTREAM": true, "FILDES": true, "STATS": true,
+	"IDSESSION": true, "SESSION": true, "END": true,
+}
+
+// pathCommands are the clamd commands that take a path argument
+var pathCommands = map[string]bool{
+	"SCAN": true, "CONTSCAN": true, "MULTISCAN": true, "ALLMATCHSCAN": true,
+}
+
+// commandRule describes how a whitelisted command may be used
+type commandRule struct {
+	args bool // The command may carry arguments; without, "PING /etc/passwd" is refused
+}
+
+// defaultRule returns the rule for a whitelisted command: only the commands
+// clamd expects a path with may carry arguments
+func defaultRule(name string) commandRule {
+	return commandRule{args: pathCommands[name]}
+}
+
+// builtinWhitelist defines the only commands that are permitted to be
+// forwarded to the backend for security reasons, unless a --whitelist file
+// replaces it. It is never modified.
+var builtinWhitelist = map[string]commandRule{
+	"PING":            {},
+	"INSTREAM":        {},
+	"VERSION":         {},
+	"VERSIONCOMMANDS": {},
+	"IDSESSION":       {}, // Each command within the session is still filtered
+	"END":             {},
+}
+
+// ClamdProxy handles bidirectional proxying between client and backend clamd server.
+// It filters commands to prevent unsafe operations from reaching the backend.
+type ClamdProxy struct {
+	server     *Proxy        // The Proxy that accepted the connection
+	connID     string        // Short random ID tagging this connection's log lines
+	client     net.Conn      // Connection to the client
+	backend    net.Conn      // Connection to the backend clamd server
+	backendBuf *bufio.Writer // Buffered writer for backend
+	clientBuf  *bufio.Writer // Buffered writer for client
+	clientMu   sync.Mutex    // Serializes writes to clientBuf from both directions
+	cmdBuf     []byte        // Reused to frame commands for forwarding
+	forwarded  int           // Commands forwarded, only used by the client->backend goroutine
+	backendEnd bool          // closeBackend has been called, only used by the client->backend goroutine
+
+	// pendingScans counts forwarded scans whose verdict hasn't been seen yet
+	pendingScans   atomic.Int32
+	scanTerminator atomic.Int32      // Reply terminator of the latest INSTREAM
+	clientFailed   atomic.Bool       // The client broke off or stalled mid-stream
+	responses      responseAssembler // Only used by the backend->client loop
+	sanitizer      responseSanitizer // Only used by the backend->client loop
+	session        sessionState      // Request numbering of an IDSESSION
+
+	// span traces the whole connection and scanSpans its scans awaiting a
+	// verdict, oldest first; both stay empty unless --otel-endpoint is set.
+	// streamSpan is the scan being streamed, only used by the client->backend
+	// goroutine.
+	span       *span
+	scanSpans  spanQueue
+	streamSpan *span
+
+	// clientDone is closed once the client->backend goroutine has exited
+	clientDone chan struct{}
+
+	// ctx is the connection's context, set by StartContext. Cancelling it
+	// closes the connection.
+	ctx context.Context
+
+	// lastActivity is the time of the last successful read in either
+	// direction, in Unix nanoseconds, used to enforce the idle timeout
+	lastActivity atomic.Int64
+
+	// For deferred connections, dial opens the backend on first use and
+	// backendReady is closed once it is available
+	dial         func() (net.Conn, error)
+	backendReady chan struct{}
+
+	// versionCache answers VERSION locally with --version-cache-ttl
+	versionCache *versionCache
+
+	// backendPreamble is sent ahead of the first command on the backend
+	// connection, see --forward-client-ip
+	backendPreamble []byte
+
+	// With --backend-pool-size, parkBackend keeps a backend connection that
+	// never carried a command open for reuse, see closeBackend
+	parkBackend bool
+	backendUsed atomic.Bool // A command has been forwarded to the backend
+	parked      atomic.Bool // The unused backend connection was kept open
+
+	// replies tracks what clamd still owes for the response timeouts and
+	// --max-response-bytes
+	replies replyWatch
+
+	// recording receives a copy of everything the client sends and is sent
+	// with --record-dir, see record
+	recording *recording
+
+	// With --retry-first-command, redial replaces a backend that fails
+	// before sending anything, see retryBackend
+	redial     func() (net.Conn, error)
+	retryArmed atomic.Bool
+	retryMu    sync.Mutex
+	retryCmd   []byte // First forwarded command, replayed on retry
+
+	// running counts the directions of Start still using the pooled
+	// writers; the last one to finish returns them to their pools
+	running atomic.Int32
+	pooled  bool
+}
+
+// NewClamdProxy creates a new proxy instance with the given client and backend connections
+func (p *Proxy) NewClamdProxy(client, backend net.Conn) *ClamdProxy {
+	c := &ClamdProxy{
+		server:     p,
+		client:     client,
+		backend:    backend,
+		backendBuf: getWriter(&p.backendWriterPool, backend, p.cfg.BackendBufferSize),
+		clientBuf:  getWriter(&p.clientWriterPool, client, p.cfg.ClientBufferSize),
+		clientDone: make(chan struct{}),
+		pooled:     true,
+	}
+	c.touch()
+	return c
+}
+
+// NewDeferredClamdProxy creates a proxy instance that only dials the backend
+// once a command actually needs to be forwarded, so clients answered locally
+// never cost a backend connection.
+func (p *Proxy) NewDeferredClamdProxy(client net.Conn, dial func() (net.Conn, error)) *ClamdProxy {
+	c := &ClamdProxy{
+		server:       p,
+		client:       client,
+		clientBuf:    getWriter(&p.clientWriterPool, client, p.cfg.ClientBufferSize),
+		dial:         dial,
+		backendReady: make(chan struct{}),
+		clientDone:   make(chan struct{}),
+		pooled:       true,
+	}
+	c.touch()
+	return c
+}
+
+// releaseWriters is called as each direction of Start finishes and returns
+// the pooled writers once neither uses them any more
+func (p *ClamdProxy) releaseWriters() {
+	if p.running.Add(-1) > 0 || !p.pooled {
+		return
+	}
+	putWriter(&p.server.clientWriterPool, p.clientBuf)
+	if p.backendBuf != nil {
+		putWriter(&p.server.backendWriterPool, p.backendBuf)
+	}
+	p.clientBuf, p.backendBuf = nil, nil
+}
+
+// connectBackend dials the backend of a deferred proxy if that hasn't happened
+// yet. It checks backendBuf rather than backend, which retryBackend may be
+// replacing concurrently.
+func (p *ClamdProxy) connectBackend() error {
+	if p.backendBuf != nil {
+		return nil
+	}
+
+	conn, err := p.dial()
+	if err != nil {
+		return err
+	}
+	p.backend = conn
+	p.backendBuf = getWriter(&p.server.backendWriterPool, conn, p.server.cfg.BackendBufferSize)
+	close(p.backendReady)
+	return nil
+}
+
+// record tees everything the client sends, as read before any filtering, and
+// everything the proxy sends back into rec from now on, without changing
+// either. It must be called before Start.
+func (p *ClamdProxy) record(rec *recording) {
+	p.recording = rec
+	p.clientBuf.Reset(io.MultiWriter(p.client, rec.writer(transcript.ServerToClient)))
+}
+
+// Start begins bidirectional proxying between client and backend.
+// It launches a goroutine to handle client->backend traffic and
+// directly processes backend->client traffic in the current goroutine.
+// Either direction ending ends the other: the client goroutine closes the
+// backend on its way out, and Start closes the client connection before it
+// returns.
+func (p *ClamdProxy) Start() {
+	p.StartContext(context.Background())
+}
+
+// StartContext is like Start, but cancelling ctx closes the client connection,
+// which promptly ends both directions and closes the backend too.
+func (p *ClamdProxy) StartContext(ctx context.Context) {
+	p.ctx = ctx
+	clientAddr := p.client.RemoteAddr().String()
+	p.server.logger.Info("Starting proxy", "conn_id", p.connID, "client", clientAddr)
+
+	// Only the client connection is closed here: the backend may still be
+	// dialed by the client goroutine, which closes it once its read fails
+	stop := context.AfterFunc(ctx, func() {
+		if err := p.client.Close(); err != nil {
+			p.server.logger.Debug("Error closing cancelled client connection", "conn_id", p.connID, "error", err)
+		}
+	})
+	defer stop()
+
+	p.running.Store(2)
+	defer p.releaseWriters()
+	p.retryArmed.Store(p.redial != nil)
+
+	// Handle client -> backend in a separate goroutine
+	go func() {
+		defer close(p.clientDone)
+		defer p.releaseWriters()
+		p.handleClientToBackend()
+		// However the loop ended, the backend must learn of it, or the
+		// read below would wait for clamd to time out
+		if !p.backendEnd {
+			p.closeBackend(false)
+		}
+	}()
+
+	// A deferred proxy has no backend to read from until the first
+	// forwarded command, and may never get one
+	if p.dial != nil {
+		select {
+		case <-p.backendReady:
+		case <-p.clientDone:
+			p.server.logger.Info("Proxy completed without backend", "conn_id", p.connID, "client", clientAddr)
+			return
+		}
+	}
+
+	// Handle backend -> client in the current goroutine
+	// Use buffered copy instead of direct io.Copy
+	bufPtr := p.server.getCopyBuf()
+	defer p.server.copyBufPool.Put(bufPtr)
+	buf := *bufPtr
+	bytesWritten := int64(0)
+	received := false
+	var err error
+
+	for {
+		if p.cancelled() {
+			err = p.ctx.Err()
+			break
+		}
+
+		nr, er := p.readBackend(buf)
+		if nr > 0 {
+			if !received {
+				received = true
+				p.disarmRetry()
+			}
+			if ew := p.replyReceived(buf[:nr]); ew != nil {
+				err = ew
+				break
+			}
+			p.observeResponse(buf[:nr])
+			out := p.session.rewrite(buf[:nr])
+			if p.server.cfg.SanitizeResponses {
+				out = p.sanitizer.rewrite(out)
+			}
+
+			p.clientMu.Lock()
+			nw, ew := p.writeClientBuf(out)
+			p.clientMu.Unlock()
+			if nw > 0 {
+				bytesWritten += int64(nw)
+			}
+			if ew != nil {
+				err = ew
+				break
+			}
+			if nw != len(out) {
+				err = io.ErrShortWrite
+				break
+			}
+		}
+		if er != nil {
+			if !received && isConnectionClosed(er) && p.retryBackend(er) {
+				continue
+			}
+			if er != io.EOF && !errors.Is(er, errBackendParked) {
+				err = er
+			}
+			break
+		}
+
+		// Flush once a reply is complete: in a session clamd keeps the
+		// connection open, so replies must not wait for the buffer to fill up
+		if !p.holdClientFlush(buf[:nr]) {
+			p.clientMu.Lock()
+			ew := p.flushClient()
+			p.clientMu.Unlock()
+			if ew != nil {
+				err = ew
+				break
+			}
+		}
+	}
+
+	// A reply clamd never terminated was held back by the sanitizer
+	if rest := p.sanitizer.flush(); len(rest) > 0 && err == nil {
+		p.clientMu.Lock()
+		if _, ew := p.writeClientBuf(rest); ew != nil {
+			p.server.logger.Debug("Error writing final reply to client", "conn_id", p.connID, "error", ew)
+		}
+		p.clientMu.Unlock()
+	}
+
+	// The backend went away before answering a scan, so the client would
+	// otherwise wait for a verdict that never comes. Not so if the client
+	// itself stalled or broke off, or the connection was cancelled.
+	if p.pendingScans.Load() > 0 && !p.clientFailed.Load() && !isTimeout(err) && !p.cancelled() {
+		p.failPendingScan()
+	}
+
+	// Final flush
+	p.clientMu.Lock()
+	if err := p.flushClient(); err != nil {
+		p.server.logger.Debug("Error flushing final buffer to client", "conn_id", p.connID, "error", err)
+	}
+	p.clientMu.Unlock()
+
+	if errors.Is(context.Cause(p.ctx), errConnLifetimeExpired) {
+		p.server.logger.Info("Connection lifetime expired",
+			"conn_id", p.connID,
+			"client", clientAddr,
+			"lifetime", p.server.cfg.MaxConnLifetime,
+			"bytesTransferred", bytesWritten)
+	} else if p.cancelled() {
+		p.server.logger.Info("Connection cancelled",
+			"conn_id", p.connID,
+			"client", clientAddr,
+			"error", p.ctx.Err())
+	} else if err != nil {
+		if errors.Is(err, errClientWriteTimeout) {
+			p.server.logger.Info("Client write timeout",
+				"conn_id", p.connID,
+				"client", clientAddr,
+				"timeout", p.server.cfg.WriteTimeout)
+		} else if errors.Is(err, errResponseTimeout) {
+			p.server.logger.Info("Backend response timeout",
+				"conn_id", p.connID,
+				"client", clientAddr,
+				"timeout", p.replyTimeout())
+		} else if errors.Is(err, errResponseTooLarge) {
+			p.server.logger.Info("Backend response too large",
+				"conn_id", p.connID,
+				"client", clientAddr,
+				"limit", p.server.cfg.MaxResponseBytes)
+		} else if isTimeout(err) {
+			p.server.logger.Info("Connection idle timeout",
+				"conn_id", p.connID,
+				"client", clientAddr,
+				"timeout", p.server.cfg.IdleTimeout)
+		} else if isConnectionClosed(err) {
+			p.server.logger.Info("Backend connection closed",
+				"conn_id", p.connID,
+				"client", clientAddr,
+				"error", err)
+		} else {
+			p.server.logger.Debug("Error copying from backend to client",
+				"conn_id", p.connID,
+				"client", clientAddr,
+				"error", err)
+		}
+	} else {
+		p.server.logger.Info("Proxy completed",
+			"conn_id", p.connID,
+			"client", clientAddr,
+			"bytesTransferred", bytesWritten)
+	}
+
+	// Nothing more can reach the client, so don't leave the client->backend
+	// goroutine waiting for a command
+	if err := p.client.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		p.server.logger.Debug("Error closing client connection", "conn_id", p.connID, "error", err)
+	}
+
+	p.span.setAttr("clamdproxy.bytes_to_client", bytesWritten)
+	p.scanSpans.finishAll("connection closed before verdict")
+}
+
+// handleClientToBackend processes commands from client to backend,
+// filtering out disallowed commands and handling special protocol cases.
+func (p *ClamdProxy) handleClientToBackend() {
+	var source io.Reader = p.client
+	if p.recording != nil {
+		// Record the raw bytes, so blocked commands replay too
+		source = io.TeeReader(p.client, p.recording.writer(transcript.ClientToServer))
+	}
+	reader := bufio.NewReader(source)
+	clientAddr := p.client.RemoteAddr().String()
+
+	for {
+		if p.cancelled() {
+			p.closeBackend(false)
+			break
+		}
+
+		// Try to read a command
+		cmd, delim, err := p.readClientCommand(reader)
+		if errors.Is(err, errCommandTooLong) && p.rejectOversizedCommand(reader, cmd) {
+			continue
+		}
+		if err != nil {
+			if isTimeout(err) {
+				p.server.logger.Info("Client idle timeout", "conn_id", p.connID, "client", clientAddr, "timeout", p.server.cfg.IdleTimeout)
+			} else if err == io.EOF {
+				// Normal client disconnection, log at debug level
+				p.server.logger.Info("Client disconnected", "conn_id", p.connID, "client", clientAddr)
+			} else {
+				// Only log as error if it's not a connection reset or broken pipe
+				if isConnectionClosed(err) {
+					p.server.logger.Info("Client connection closed", "conn_id", p.connID, "client", clientAddr, "error", err)
+				} else {
+					p.server.logger.Debug("Error reading command", "conn_id", p.connID, "client", clientAddr, "error", err)
+				}
+			}
+			// Signal the backend we're done. On a clean EOF only the write
+			// side is shut so a verdict still in flight reaches the client.
+			p.closeBackend(err == io.EOF)
+			break
+		}
+
+		// Only log commands at appropriate levels
+		p.server.logger.Debug("Command received", "conn_id", p.connID, "client", clientAddr, "command", cmd)
+
+		// clamd only knows its commands in upper case, so a client's "zping"
+		// is filtered and forwarded as "zPING"
+		if p.server.cfg.CaseInsensitive {
+			cmd = canonicalCommand(cmd)
+		}
+
+		// Answer health checks without involving the backend. Whatever the
+		// client pipelined after the PING stays buffered in reader for the
+		// next iteration, so a following INSTREAM is forwarded intact.
+		if p.server.cfg.LocalPing && isPingCommand(cmd) {
+			p.audit(cmd, auditAnswered, "local PING")
+			if err := p.replyLocal("PONG", responseTerminator(cmd)); err != nil {
+				p.server.logger.Debug("Error sending local PONG", "conn_id", p.connID, "error", err)
+				break
+			}
+			continue
+		}
+
+		// Answer version polls from the cache, as long as the filter
+		// allows VERSION at all
+		if p.versionCache != nil && isVersionCommand(cmd) && p.server.isCommandAllowed(cmd) {
+			if reply, ok := p.versionCache.get(p.server.cfg.VersionCacheTTL); ok {
+				p.audit(cmd, auditAnswered, "cached VERSION")
+				if err := p.replyLocal(reply, responseTerminator(cmd)); err != nil {
+					p.server.logger.Debug("Error sending cached VERSION", "conn_id", p.connID, "error", err)
+					break
+				}
+				continue
+			}
+		}
+
+		// Check if command is allowed. In dry-run mode disallowed commands
+		// are only reported and forwarded anyway.
+		allowed := p.server.isCommandAllowed(cmd)
+		auditReason := ""
+		if !allowed && p.server.cfg.DryRun {
+			p.server.logger.Warn("Command would be blocked",
+				"conn_id", p.connID,
+				"client", clientAddr,
+				"command", commandName(cmd))
+			p.server.metrics.commandsWouldBlock.Add(1)
+			auditReason = "dry run, would be blocked"
+			allowed = true
+		}
+
+		if allowed {
+			// An INSTREAM counts once, however many chunks follow. Replies
+			// to commands already forwarded are still relayed.
+			p.forwarded++
+			if p.server.cfg.MaxCommandsPerConn > 0 && p.forwarded > p.server.cfg.MaxCommandsPerConn {
+				p.server.logger.Warn("Command limit exceeded, closing connection",
+					"conn_id", p.connID,
+					"client", clientAddr,
+					"command", commandName(cmd),
+					"limit", p.server.cfg.MaxCommandsPerConn)
+				p.audit(cmd, auditBlocked, "command limit")
+				if err := p.replyLocal(commandLimitResponse, responseTerminator(cmd)); err != nil {
+					p.server.logger.Debug("Error sending command limit response", "conn_id", p.connID, "error", err)
+				}
+				p.closeBackend(true)
+				break
+			}
+			p.audit(cmd, auditForwarded, auditReason)
+
+			if err := p.connectBackend(); err != nil {
+				p.server.logger.Debug("Error connecting deferred backend", "conn_id", p.connID, "client", clientAddr, "error", err)
+				if p.server.cfg.UnavailableResponse != "" {
+					if err := p.replyLocal(p.server.cfg.UnavailableResponse, responseTerminator(cmd)); err != nil {
+						p.server.logger.Debug("Error sending unavailable response", "conn_id", p.connID, "error", err)
+					}
+				}
+				break
+			}
+
+			// Keep the session's request numbering in step before clamd can reply
+			switch commandName(cmd) {
+			case "IDSESSION":
+				p.session.begin(responseTerminator(cmd))
+			case "SESSION":
+				// Legacy session replies carry no request numbers, so there
+				// is nothing to keep in step. Commands simply keep flowing
+				// over this connection until END.
+				p.server.logger.Debug("Legacy session started", "conn_id", p.connID, "client", clientAddr)
+			case "END":
+				p.session.end()
+			default:
+				p.session.forwarded()
+			}
+
+			// Count the scan before clamd can possibly answer or fail it
+			if isInstreamCommand(cmd) {
+				p.scanTerminator.Store(int32(responseTerminator(cmd)))
+				p.streamSpan = p.server.tracer.startSpan("clamd.instream", p.span)
+				p.scanSpans.push(p.streamSpan)
+				p.pendingScans.Add(1)
+			}
+			p.expectReply(cmd)
+
+			// Some clients end a zCOMMAND with a newline, or the other way
+			// round, and clamd then waits for the terminator it expects.
+			// Only the terminator changes, so INSTREAM data still follows
+			// it directly.
+			if p.server.cfg.NormalizeDelimiters {
+				if expected := responseTerminator(cmd); delim != expected {
+					p.server.logger.Debug("Normalized command terminator",
+						"conn_id", p.connID,
+						"client", clientAddr,
+						"command", commandName(cmd),
+						"received", fmt.Sprintf("%q", delim),
+						"forwarded", fmt.Sprintf("%q", expected))
+					delim = expected
+				}
+			}
+
+			// Forward the command to backend using buffered writer
+			if err := p.forwardCommand(p.frameCommand(cmd, delim)); err != nil {
+				p.server.logger.Debug("Error forwarding command", "conn_id", p.connID, "error", err)
+				break
+			}
+
+			// After END clamd answers what is still outstanding and closes.
+			// Stop reading commands and only half-close, so the Start loop
+			// relays the final replies before the client is disconnected.
+			if commandName(cmd) == "END" {
+				p.server.logger.Debug("Session ended, draining backend", "conn_id", p.connID, "client", clientAddr)
+				p.closeBackend(true)
+				break
+			}
+
+			// Handle special case for INSTREAM command (file streaming)
+			if isInstreamCommand(cmd) {
+				p.server.logger.Debug("Processing INSTREAM data", "conn_id", p.connID, "client", clientAddr)
+				if err := p.handleInstream(reader); err != nil {
+					// clamd may close a stream early, e.g. once it exceeds
+					// StreamMaxLength, with its reply already on the way.
+					// Stop forwarding but keep reading so the reply still
+					// reaches the client.
+					if errors.As(err, new(backendWriteError)) && isConnectionClosed(err) {
+						p.server.logger.Info("Backend closed the stream early",
+							"conn_id", p.connID,
+							"client", clientAddr,
+							"error", err)
+						p.closeBackend(true)
+						break
+					}
+
+					p.server.logger.Debug("Error handling INSTREAM data",
+						"conn_id", p.connID,
+						"client", clientAddr,
+						"error", err)
+					// A client that failed mid-stream can't be told about it.
+					// Either way abort rather than half-close so the backend
+					// never scans a truncated stream.
+					if errors.Is(err, errTooManyChunks) {
+						p.abortStream(tooManyChunksResponse)
+					} else if errors.Is(err, errChunkTooLarge) {
+						p.abortStream(chunkTooLargeResponse)
+					} else if errors.Is(err, errStreamTooSlow) {
+						p.abortStream(streamTooSlowResponse)
+					} else if !errors.As(err, new(backendWriteError)) {
+						p.clientFailed.Store(true)
+					}
+					p.closeBackend(false)
+					break
+				}
+				p.streamUploaded()
+			}
+		} else {
+			name := commandName(cmd)
+			if isKnownCommand(cmd) {
+				p.server.logger.Info("Blocked command", "conn_id", p.connID, "client", clientAddr, "command", cmd, "name", name)
+				reason := "filter"
+				if p.server.cfg.DisableInstream && name == "INSTREAM" {
+					reason = "INSTREAM disabled"
+				}
+				p.audit(cmd, auditBlocked, reason)
+			} else {
+				// Not a policy decision: the client sent something that is
+				// no clamd command, e.g. a wrong prefix or another protocol
+				p.server.logger.Warn("Blocked unknown command, possible client protocol error",
+					"conn_id", p.connID,
+					"client", clientAddr,
+					"command", fmt.Sprintf("%q", cmd),
+					"name", name)
+				p.audit(cmd, auditBlocked, "unknown command")
+			}
+			p.server.metrics.commandBlocked(name)
+			// Send error response to client using buffered writer
+			if err := p.replyLocal(p.server.blockedResponse(cmd), responseTerminator(cmd)); err != nil {
+				p.server.logger.Debug("Error sending error response", "conn_id", p.connID, "error", err)
+				break
+			}
+		}
+	}
+}
+
+// closeBackend ends the client->backend direction. With halfClose set and a
+// backend that supports it (*net.TCPConn), only the write side is shut down and
+// the Start loop keeps relaying until the backend closes; otherwise the
+// connection is closed outright. With parkBackend set, a connection that never
+// carried a command is left open instead, see backendReusable.
+func (p *ClamdProxy) closeBackend(halfClose bool) {
+	p.backendEnd = true
+	p.disarmRetry()
+	if p.backend == nil {
+		return
+	}
+
+	// Stop the backend reader with an expired deadline rather than closing
+	// an unused connection that can go back to the pool
+	if p.parkBackend && !p.backendUsed.Load() {
+		p.parked.Store(true)
+		if err := p.backend.SetReadDeadline(time.Now()); err == nil {
+			return
+		}
+		p.parked.Store(false)
+	}
+
+	if cw, ok := p.backend.(interface{ CloseWrite() error }); ok && halfClose {
+		if err := cw.CloseWrite(); err != nil {
+			p.server.logger.Debug("Error half-closing backend connection", "conn_id", p.connID, "error", err)
+		}
+		return
+	}
+
+	if err := p.backend.Close(); err != nil {
+		p.server.logger.Debug("Error closing backend connection", "conn_id", p.connID, "error", err)
+	}
+}
+
+// backendReusable reports whether the backend connection ended unused and
+// still open, so it can be returned to the backend pool once Start is done
+func (p *ClamdProxy) backendReusable() bool {
+	return p.parked.Load() && !p.backendUsed.Load()
+}
+
+// failPendingScan tells the client that its scan can't complete because the
+// backend connection failed, terminated like the reply to its INSTREAM
+func (p *ClamdProxy) failPendingScan() {
+	p.pendingScans.Add(-1)
+	p.server.metrics.scansError.Add(1)
+	finishScanSpan(p.scanSpans.pop(), verdictError, backendUnavailableResponse)
+	p.server.logger.Warn("Backend failed during scan",
+		"conn_id", p.connID,
+		"client", p.client.RemoteAddr().String())
+
+	if err := p.writeClient(backendUnavailableResponse, byte(p.scanTerminator.Load())); err != nil {
+		p.server.logger.Debug("Error sending backend failure response", "conn_id", p.connID, "error", err)
+	}
+}
+
+// abortStream answers a stream the proxy refused to forward in full with an
+// error response in place of clamd's verdict
+func (p *ClamdProxy) abortStream(response string) {
+	p.pendingScans.Add(-1)
+	p.server.metrics.scansError.Add(1)
+	finishScanSpan(p.scanSpans.pop(), verdictError, response)
+
+	if err := p.writeClient(response, byte(p.scanTerminator.Load())); err != nil {
+		p.server.logger.Debug("Error sending stream abort response", "conn_id", p.connID, "error", err)
+	}
+}
+
+// forwardCommand writes a framed command to the backend and flushes it
+// immediately. While a backend retry is possible, the first command is kept
+// for replay and any later one ends the retry window.
+func (p *ClamdProxy) forwardCommand(frame []byte) error {
+	// Part of the first frame, so a retry replays it to the new backend
+	if p.backendPreamble != nil && !p.backendUsed.Load() {
+		frame = append(append([]byte(nil), p.backendPreamble...), frame...)
+	}
+	p.backendUsed.Store(true)
+	if p.retryArmed.Load() {
+		return p.forwardRetryable(frame)
+	}
+	if _, err := p.backendBuf.Write(frame); err != nil {
+		return err
+	}
+	return p.backendBuf.Flush()
+}
+
+// frameCommand returns cmd terminated by delim, ready to be forwarded. The
+// result lives in a per-connection buffer that grows as needed and is only
+// valid until the next call.
+func (p *ClamdProxy) frameCommand(cmd string, delim byte) []byte {
+	p.cmdBuf = append(p.cmdBuf[:0], cmd...)
+	p.cmdBuf = append(p.cmdBuf, delim)
+	return p.cmdBuf
+}
+
+// writeClient sends a response generated by the proxy itself to the client,
+// terminated by the given delimiter, and flushes it immediately.
+func (p *ClamdProxy) writeClient(response string, delim byte) error {
+	p.clientMu.Lock()
+	defer p.clientMu.Unlock()
+
+	if err := p.armWriteDeadline(); err != nil {
+		return err
+	}
+	if _, err := p.clientBuf.WriteString(response); err != nil {
+		return err
+	}
+	if err := p.clientBuf.WriteByte(delim); err != nil {
+		return err
+	}
+	return p.flushClient()
+}
+
+// writeClientBuf writes data read from the backend into the client buffer,
+// which may send it on to the client within the write timeout. clientMu must
+// be held.
+func (p *ClamdProxy) writeClientBuf(data []byte) (int, error) {
+	if err := p.armWriteDeadline(); err != nil {
+		return 0, err
+	}
+	n, err := p.clientBuf.Write(data)
+	return n, clientWriteError(err)
+}
+
+// flushClient sends the buffered client data within the write timeout.
+// clientMu must be held.
+func (p *ClamdProxy) flushClient() error {
+	if err := p.armWriteDeadline(); err != nil {
+		return err
+	}
+	return clientWriteError(p.clientBuf.Flush())
+}
+
+// holdClientFlush reports whether the client writer can wait for more of a
+// reply before flushing, with --client-flush-bytes: the backend read in data
+// ended mid-reply and less than the threshold is buffered
+func (p *ClamdProxy) holdClientFlush(data []byte) bool {
+	if p.server.cfg.ClientFlushBytes <= 0 || len(data) == 0 || isResponseTerminator(data[len(data)-1]) {
+		return false
+	}
+	p.clientMu.Lock()
+	defer p.clientMu.Unlock()
+	return p.clientBuf.Buffered() < p.server.cfg.ClientFlushBytes
+}
+
+// armWriteDeadline gives the client one write timeout from now to accept
+// pending data, so a client that stops reading can't hold the backend open
+func (p *ClamdProxy) armWriteDeadline() error {
+	if p.server.cfg.WriteTimeout <= 0 {
+		return nil
+	}
+	return p.client.SetWriteDeadline(time.Now().Add(p.server.cfg.WriteTimeout))
+}
+
+// clientWriteError tells a write timeout apart from the idle timeout, which
+// shows up as the same deadline error on the backend read
+func clientWriteError(err error) error {
+	if err != nil && isTimeout(err) {
+		return fmt.Errorf("%w: %w", errClientWriteTimeout, err)
+	}
+	return err
+}
+
+// replyLocal answers a command with a response generated by the proxy. Inside
+// a session the response carries the request number and terminator the client
+// expects from clamd instead of the given delimiter.
+func (p *ClamdProxy) replyLocal(response string, delim byte) error {
+	if id, sessionDelim, ok := p.session.local(); ok {
+		response = strconv.Itoa(id) + ": " + response
+		delim = sessionDelim
+	}
+	return p.writeClient(response, delim)
+}
+
+// blockedResponse returns the reply to a blocked command, built from the
+// --blocked-response template with {command} replaced by the command name.
+// Commands with control characters get a fixed reply instead, so none are
+// echoed back to the client.
+func (p *Proxy) blockedResponse(cmd string) string {
+	if hasControlChars(cmd) {
+		return controlCharsResponse
+	}
+	template := p.cfg.BlockedResponse
+	if template == "" {
+		template = defaultBlockedResponse
+	}
+	return strings.ReplaceAll(template, "{command}", commandName(cmd))
+}
+
+// responseTerminator returns the delimiter clamd uses to terminate its reply to
+// cmd: null for z-prefixed commands and newline for everything else. It is
+// also the terminator clamd expects on cmd itself.
+func responseTerminator(cmd string) byte {
+	if strings.HasPrefix(cmd, "z") {
+		return nullDelimiter
+	}
+	return newlineDelimiter
+}
+
+// isPingCommand determines if a command is PING in any of its protocol variants
+func isPingCommand(cmd string) bool {
+	return cmd == "PING" || cmd == "zPING" || cmd == "nPING"
+}
+
+// isInstreamCommand determines if a command is an INSTREAM command
+// which requires special handling for the data stream that follows.
+// Only the exact names count, so a command such as zFOOINSTREAM never
+// starts reading a stream, whatever the filter made of it. clamd only
+// accepts INSTREAM with a z or n prefix.
+func isInstreamCommand(cmd string) bool {
+	return cmd == "zINSTREAM" || cmd == "nINSTREAM"
+}
+
+// readCommand reads a command from the reader, handling both null and newline delimiters.
+// Returns the command string, the delimiter that terminated it, and any error encountered.
+// If maxLength is positive and the command grows beyond it, reading stops with
+// errCommandTooLong and the partial command read so far.
+func readCommand(reader *bufio.Reader, maxLength int) (string, byte, error) {
+	// Get buffer from pool
+	bufPtr := cmdBufPool.Get().(*[]byte)
+	cmdBytes := (*bufPtr)[:0] // Reset length but keep capacity
+
+	var delim byte
+
+	// Read until null or newline
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			cmdBufPool.Put(bufPtr) // Return buffer to pool on error
+			return "", 0, err
+		}
+
+		if b == nullDelimiter || b == newlineDelimiter {
+			delim = b
+			break
+		}
+
+		if maxLength > 0 && len(cmdBytes) >= maxLength {
+			cmd := string(cmdBytes)
+			cmdBufPool.Put(bufPtr)
+			return cmd, 0, errCommandTooLong
+		}
+
+		cmdBytes = append(cmdBytes, b)
+		*bufPtr = cmdBytes // Update the pointer
+	}
+
+	// Copy to string before returning buffer to pool
+	cmd := string(cmdBytes)
+	cmdBufPool.Put(bufPtr)
+
+	return cmd, delim, nil
+}
+
+// rejectOversizedCommand answers a command that exceeded --max-command-length
+// with an error. With --drain-oversized the rest of the command is discarded,
+// up to --max-drain-bytes, so the connection can carry on with the next
+// command; it returns true in that case and false if the connection should close.
+func (p *ClamdProxy) rejectOversizedCommand(reader *bufio.Reader, partial string) bool {
+	clientAddr := p.client.RemoteAddr().String()
+	terminator := responseTerminator(partial)
+	p.audit(partial, auditBlocked, "command too long")
+
+	if p.server.cfg.DrainOversized {
+		err := drainCommand(reader, p.server.cfg.MaxDrainBytes)
+		if err == nil {
+			p.server.logger.Info("Rejected oversized command", "conn_id", p.connID, "client", clientAddr, "limit", p.server.cfg.MaxCommandLength)
+			if err := p.writeClient(commandTooLongResponse, terminator); err != nil {
+				p.server.logger.Debug("Error sending error response", "conn_id", p.connID, "error", err)
+				return false
+			}
+			return true
+		}
+		p.server.logger.Info("Failed to drain oversized command", "conn_id", p.connID, "client", clientAddr, "error", err)
+	}
+
+	p.server.logger.Info("Closing connection after oversized command", "conn_id", p.connID, "client", clientAddr, "limit", p.server.cfg.MaxCommandLength)
+	if err := p.writeClient(commandTooLongResponse, terminator); err != nil {
+		p.server.logger.Debug("Error sending error response", "conn_id", p.connID, "error", err)
+	}
+	return false
+}
+
+// drainCommand discards the remainder of a command up to and including its
+// delimiter, giving up once more than limit bytes have been skipped
+func drainCommand(reader *bufio.Reader, limit int) error {
+	for skipped := 0; ; skipped++ {
+		if skipped > limit {
+			return fmt.Errorf("command still unterminated after %d bytes", limit)
+		}
+		b, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b == nullDelimiter || b == newlineDelimiter {
+			return nil
+		}
+	}
+}
+
+// isCommandAllowed checks if a command is allowed to be forwarded to the backend.
+// It extracts the actual command name, handling protocol prefixes, and checks it
+// against the whitelist or, in deny mode, the --denylist.
+func (p *Proxy) isCommandAllowed(cmd string) bool {
+	actualCmd := commandName(cmd)
+	if actualCmd == "" {
+		return false // Empty commands are not allowed
+	}
+	// The lists are upper-cased as well, see commandSet and loadWhitelist
+	if p.cfg.CaseInsensitive {
+		actualCmd = strings.ToUpper(actualCmd)
+	}
+
+	// No clamd command contains control characters, and a tab or CR may be
+	// parsed differently by clamd than by the checks below
+	if hasControlChars(cmd) {
+		return false
+	}
+
+	// Overrides the whitelist and deny mode alike, so no file can be
+	// streamed whatever else is allowed
+	if p.cfg.DisableInstream && actualCmd == "INSTREAM" {
+		return false
+	}
+
+	// With --scan-allow-prefix, SCAN and CONTSCAN are allowed in either mode
+	// as long as they stay within the configured directories
+	if len(p.scanPrefixes) > 0 && isPathScanCommand(actualCmd) {
+		if p.cfg.Mode == "deny" && p.denied[actualCmd] {
+			return false
+		}
+		return p.isScanPathAllowed(cmd)
+	}
+
+	if p.cfg.Mode == "deny" {
+		return !p.denied[actualCmd]
+	}
+
+	// The legacy session is opt-in rather than part of the whitelist, since
+	// current clamd clients only use IDSESSION
+	if actualCmd == "SESSION" && p.cfg.LegacySession {
+		return !hasArguments(cmd)
+	}
+
+	// Check if command is in allowed list, and that it carries no arguments
+	// unless it may
+	rule, ok := p.allowedRule(actualCmd)
+	return ok && (rule.args || !hasArguments(cmd))
+}
+
+// isKnownCommand reports whether cmd names a clamd command at all, with or
+// without a z/n prefix, whether or not it is allowed. A blocked command that
+// isn't is more likely a client protocol error than a policy block.
+func isKnownCommand(cmd string) bool {
+	return clamdCommands[commandName(cmd)]
+}
+
+// hasControlChars reports whether cmd contains ASCII control characters. The
+// command's terminator has already been removed.
+func hasControlChars(cmd string) bool {
+	for i := 0; i < len(cmd); i++ {
+		if c := cmd[i]; c < 0x20 || c == 0x7f {
+			return true
+		}
+	}
+	return false
+}
+
+// hasArguments reports whether cmd carries anything after the command name
+func hasArguments(cmd string) bool {
+	return len(strings.Fields(cmd)) > 1
+}
+
+// commandName extracts the actual command name from a raw command, dropping
+// its arguments and any z/n protocol prefix
+func commandName(cmd string) string {
+	cmdParts := strings.Fields(cmd)
+	if len(cmdParts) == 0 {
+		return ""
+	}
+
+	// Handle commands with z/n prefix (protocol variations). The prefix is
+	// only stripped from known commands, so "zap" stays "zap" and can't be
+	// mistaken for "ap".
+	actualCmd := cmdParts[0]
+	if strings.HasPrefix(actualCmd, "z") || strings.HasPrefix(actualCmd, "n") {
+		if clamdCommands[actualCmd[1:]] {
+			return actualCmd[1:]
+		}
+	}
+	return actualCmd
+}
+
+// canonicalCommand spells the name of a clamd command in cmd the way clamd
+// expects it, upper case with a lower case z/n prefix, so "Zping" becomes
+// "zPING". Arguments and names clamd doesn't know are left alone.
+func canonicalCommand(cmd string) string {
+	token, rest := cmd, ""
+	if i := strings.IndexByte(cmd, ' '); i >= 0 {
+		token, rest = cmd[:i], cmd[i:]
+	}
+
+	upper := strings.ToUpper(token)
+	switch {
+	case clamdCommands[upper]:
+		return upper + rest
+	case len(upper) > 1 && (upper[0] == 'Z' || upper[0] == 'N') && clamdCommands[upper[1:]]:
+		return strings.ToLower(upper[:1]) + upper[1:] + rest
+	}
+	return cmd
+}
+
+// commandSet builds a lookup set from a list of command names, upper-cased
+// with --case-insensitive
+func (p *Proxy) commandSet(names []string) map[string]bool {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name != "" {
+			if p.cfg.CaseInsensitive {
+				name = strings.ToUpper(name)
+			}
+			set[name] = true
+		}
+	}
+	return set
+}
+
+// readClientCommand reads the next command from the client, enforcing the idle
+// timeout. While waiting for the first byte the deadline is re-armed as long
+// as the backend is still active (e.g. a long scan); once a command has
+// started it must be completed within the idle timeout.
+func (p *ClamdProxy) readClientCommand(reader *bufio.Reader) (string, byte, error) {
+	if p.server.cfg.IdleTimeout <= 0 {
+		return readCommand(reader, p.server.cfg.MaxCommandLength)
+	}
+
+	for {
+		if err := p.client.SetReadDeadline(p.idleDeadline()); err != nil {
+			return "", 0, err
+		}
+		// Peek doesn't consume anything, so retrying after a timeout is safe
+		_, err := reader.Peek(1)
+		if err == nil {
+			break
+		}
+		if !isTimeout(err) || p.idleExpired() {
+			return "", 0, err
+		}
+	}
+
+	if err := p.armClientDeadline(); err != nil {
+		return "", 0, err
+	}
+	cmd, delim, err := readCommand(reader, p.server.cfg.MaxCommandLength)
+	if err == nil {
+		p.touch()
+	}
+	return cmd, delim, err
+}
+
+// readBackend reads from the backend, enforcing the idle and response
+// timeouts. An idle timeout is only reported once neither side has been
+// active for the idle timeout, so a client uploading a long stream doesn't
+// trip the backend deadline.
+func (p *ClamdProxy) readBackend(buf []byte) (int, error) {
+	if p.server.cfg.IdleTimeout <= 0 && !p.server.watchResponses() {
+		n, err := p.backend.Read(buf)
+		if err != nil && p.parked.Load() {
+			return n, errBackendParked
+		}
+		return n, err
+	}
+
+	for {
+		if err := p.armBackendDeadline(); err != nil {
+			return 0, err
+		}
+		// Checked after the deadline is set, which would otherwise undo the
+		// one closeBackend set to park the connection
+		if p.parked.Load() {
+			return 0, errBackendParked
+		}
+		n, err := p.backend.Read(buf)
+		if n > 0 {
+			p.touch()
+		}
+		if err != nil && isTimeout(err) && n == 0 {
+			if p.replyOverdue() {
+				return 0, errResponseTimeout
+			}
+			if p.server.cfg.IdleTimeout <= 0 || !p.idleExpired() {
+				continue
+			}
+		}
+		return n, err
+	}
+}
+
+// armClientDeadline gives the client one idle timeout from now to send more data
+func (p *ClamdProxy) armClientDeadline() error {
+	if p.server.cfg.IdleTimeout <= 0 {
+		return nil
+	}
+	return p.client.SetReadDeadline(time.Now().Add(p.server.cfg.IdleTimeout))
+}
+
+// cancelled reports whether the context of the connection has been cancelled
+func (p *ClamdProxy) cancelled() bool {
+	return p.ctx != nil && p.ctx.Err() != nil
+}
+
+// touch records activity on the connection
+func (p *ClamdProxy) touch() {
+	p.lastActivity.Store(time.Now().UnixNano())
+}
+
+// idleDeadline returns the point at which the connection becomes idle
+func (p *ClamdProxy) idleDeadline() time.Time {
+	return time.Unix(0, p.lastActivity.Load()).Add(p.server.cfg.IdleTimeout)
+}
+
+// idleExpired reports whether the connection has been idle for the idle timeout
+func (p *ClamdProxy) idleExpired() bool {
+	return !time.Now().Before(p.idleDeadline())
+}
+
+// errClientWriteTimeout marks a client that didn't accept data within --write-timeout
+var errClientWriteTimeout = errors.New("client write timeout")
+
+// isTimeout checks if an error is a deadline expiry
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// isConnectionClosed checks if an error indicates that the connection was closed by the client
+func isConnectionClosed(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	// Check for specific network error types
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		// Only check for timeout errors, not temporary (which is deprecated)
+		if netErr.Timeout() {
+			return false
+		}
+	}
+
+	// Check for specific syscall errors that indicate closed connections
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+
+	// Check for EOF which indicates clean connection close
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
+
+// handleInstream handles the special INSTREAM command data forwarding.
+// INSTREAM protocol: 4-byte size header followed by chunk data, repeating until a zero-size chunk.
+func (p *ClamdProxy) handleInstream(reader *bufio.Reader) (err error) {
+	clientAddr := p.client.RemoteAddr().String()
+	totalBytes := 0
+	chunks := 0
+
+	// A completed stream is recorded before its terminator is forwarded,
+	// since clamd's verdict may end the span any time after that
+	defer func() {
+		if err != nil {
+			recordStream(p.streamSpan, chunks, totalBytes)
+			p.streamSpan.setError(err.Error())
+		}
+	}()
+
+	// Payload bytes read from the client and written to the backend. With a
+	// single backend these must match for every completed stream.
+	var clientBytes, backendBytes int64
+
+	// Size buffer is small and frequently reused, so we'll keep it local
+	sizeBytes := make([]byte, 4)
+
+	// Stream data isn't kept, so it can't be replayed to another backend
+	p.disarmRetry()
+
+	var throughput *streamThroughput
+	slowWarned := false
+	if p.server.cfg.MinStreamThroughput > 0 {
+		throughput = newStreamThroughput(int64(p.server.cfg.MinStreamThroughput), p.server.cfg.StreamThroughputWindow)
+	}
+
+	for {
+		if p.cancelled() {
+			return p.ctx.Err()
+		}
+
+		// Read chunk size (4 bytes in network byte order). The idle
+		// timeout applies between chunks so a half-sent stream expires.
+		if err := p.armClientDeadline(); err != nil {
+			return fmt.Errorf("failed to set read deadline: %w", err)
+		}
+		if _, err := io.ReadFull(reader, sizeBytes); err != nil {
+			return fmt.Errorf("failed to read chunk size: %w", err)
+		}
+
+		// Calculate chunk size (big-endian)
+		size := int(sizeBytes[0])<<24 | int(sizeBytes[1])<<16 | int(sizeBytes[2])<<8 | int(sizeBytes[3])
+
+		// If size is 0, we're done with the stream
+		if size == 0 {
+			recordStream(p.streamSpan, chunks, totalBytes)
+			p.server.metrics.streamCompleted(int64(totalBytes))
+			if _, err := p.backendBuf.Write(sizeBytes); err != nil {
+				return backendWriteError{fmt.Errorf("failed to forward chunk size: %w", err)}
+			}
+			p.server.logger.Debug("INSTREAM completed",
+				"conn_id", p.connID,
+				"client", clientAddr,
+				"totalBytes", totalBytes,
+				"chunks", chunks)
+			if clientBytes != backendBytes {
+				p.server.logger.Warn("INSTREAM byte count mismatch",
+					"conn_id", p.connID,
+					"client", clientAddr,
+					"clientBytes", clientBytes,
+					"backendBytes", backendBytes)
+			}
+			break
+		}
+
+		// A declared size is checked before anything of the chunk is
+		// forwarded, so a client can't make the proxy relay gigabytes
+		if p.server.cfg.MaxChunkBytes > 0 && size > p.server.cfg.MaxChunkBytes {
+			p.server.logger.Warn("INSTREAM chunk size limit exceeded",
+				"conn_id", p.connID,
+				"client", clientAddr,
+				"size", size,
+				"limit", p.server.cfg.MaxChunkBytes,
+				"chunks", chunks)
+			return errChunkTooLarge
+		}
+
+		// Many tiny chunks cost CPU and backend syscalls out of proportion
+		// to the data they carry
+		if p.server.cfg.MaxStreamChunks > 0 && chunks >= p.server.cfg.MaxStreamChunks {
+			p.server.logger.Warn("INSTREAM chunk limit exceeded",
+				"conn_id", p.connID,
+				"client", clientAddr,
+				"chunks", chunks,
+				"limit", p.server.cfg.MaxStreamChunks,
+				"totalBytes", totalBytes)
+			return errTooManyChunks
+		}
+
+		// Handle the chunk data
+		if chunkPtr := p.server.pooledChunkBuf(size); chunkPtr != nil {
+			chunk := *chunkPtr
+
+			// Read chunk data into the buffer
+			nr, err := io.ReadFull(reader, chunk[:size])
+			p.countInstreamRead(&clientBytes, nr)
+			if err != nil {
+				p.server.chunkBufPool.Put(chunkPtr) // Return buffer to pool on error
+				return fmt.Errorf("failed to read chunk data: %w", err)
+			}
+
+			// Forward the size only once the whole chunk has arrived, so
+			// a client failing mid-chunk leaves nothing partial behind
+			if _, err := p.backendBuf.Write(sizeBytes); err != nil {
+				p.server.chunkBufPool.Put(chunkPtr) // Return buffer to pool on error
+				return backendWriteError{fmt.Errorf("failed to forward chunk size: %w", err)}
+			}
+
+			// Forward chunk data using buffered writer
+			nw, err := p.backendBuf.Write(chunk[:size])
+			p.countInstreamWrite(&backendBytes, nw)
+			if err != nil {
+				p.server.chunkBufPool.Put(chunkPtr) // Return buffer to pool on error
+				return backendWriteError{fmt.Errorf("failed to forward chunk data: %w", err)}
+			}
+
+			// Return buffer to pool immediately after use
+			p.server.chunkBufPool.Put(chunkPtr)
+		} else {
+			p.server.metrics.instreamUnpooledChunks.Add(1)
+			if err := p.forwardLargeChunk(reader, sizeBytes, size, &clientBytes, &backendBytes); err != nil {
+				return err
+			}
+		}
+
+		p.touch()
+		totalBytes += size
+		chunks++
+
+		// A client trickling its upload holds a backend connection for as
+		// long as it takes. Fast streams only pay for reading the clock.
+		if throughput != nil {
+			if rate, slow := throughput.add(size); slow {
+				if !slowWarned {
+					slowWarned = true
+					p.server.logger.Warn("Slow INSTREAM upload",
+						"conn_id", p.connID,
+						"client", clientAddr,
+						"rate", rate,
+						"min", p.server.cfg.MinStreamThroughput,
+						"window", p.server.cfg.StreamThroughputWindow,
+						"chunks", chunks,
+						"totalBytes", totalBytes)
+				}
+				if p.server.cfg.AbortSlowStreams {
+					return errStreamTooSlow
+				}
+			}
+		}
+
+		// Only log chunk details at the most verbose level and only occasionally
+		if chunks%instreamProgressInterval == 0 {
+			p.server.logger.Debug("INSTREAM progress",
+				"conn_id", p.connID,
+				"client", clientAddr,
+				"chunks", chunks,
+				"totalBytes", totalBytes)
+		}
+
+		// Flush periodically to balance between batching and responsiveness
+		if chunks%p.server.cfg.StreamFlushChunks == 0 {
+			if err := p.backendBuf.Flush(); err != nil {
+				return backendWriteError{fmt.Errorf("failed to flush data: %w", err)}
+			}
+		}
+	}
+
+	// Final flush to ensure all data is sent
+	if err := p.backendBuf.Flush(); err != nil {
+		return backendWriteError{fmt.Errorf("failed to flush final data: %w", err)}
+	}
+
+	return nil
+}
+
+// forwardLargeChunk forwards an INSTREAM chunk too large for the pooled
+// buffers, whose size header sizeBytes has been checked already. Up to
+// maxBufferedChunk it is read in full first, like a pooled one, so a client
+// failing mid-chunk leaves nothing partial behind. Larger chunks are forwarded
+// in pieces of maxBufferedChunk as they arrive, which bounds what a client can
+// make the proxy hold whatever --max-chunk-bytes allows. Should the client
+// fail partway through one, the backend connection is closed rather than
+// half-closed, so clamd never scans the part it got.
+func (p *ClamdProxy) forwardLargeChunk(reader io.Reader, sizeBytes []byte, size int, clientBytes, backendBytes *int64) error {
+	buf := make([]byte, min(size, maxBufferedChunk))
+	for forwarded := 0; forwarded < size; {
+		piece := buf[:min(size-forwarded, len(buf))]
+		nr, err := io.ReadFull(reader, piece)
+		p.countInstreamRead(clientBytes, nr)
+		if err != nil {
+			return fmt.Errorf("failed to read chunk data: %w", err)
+		}
+
+		if forwarded == 0 {
+			if _, err := p.backendBuf.Write(sizeBytes); err != nil {
+				return backendWriteError{fmt.Errorf("failed to forward chunk size: %w", err)}
+			}
+		}
+		nw, err := p.backendBuf.Write(piece)
+		p.countInstreamWrite(backendBytes, nw)
+		if err != nil {
+			return backendWriteError{fmt.Errorf("failed to forward chunk data: %w", err)}
+		}
+		forwarded += nw
+	}
+	return nil
+}
+
+// recordStream adds the size of a stream to its scan span
+func recordStream(s *span, chunks, totalBytes int) {
+	s.setAttr("clamdproxy.instream.chunks", chunks)
+	s.setAttr("clamdproxy.instream.bytes", totalBytes)
+}
+
+// countInstreamRead records n INSTREAM payload bytes received from the client
+// in both the per-stream total and the Proxy counter.
+func (p *ClamdProxy) countInstreamRead(total *int64, n int) {
+	*total += int64(n)
+	p.server.metrics.instreamClientBytes.Add(int64(n))
+}
+
+// countInstreamWrite records n INSTREAM payload bytes forwarded to the backend
+// in both the per-stream total and the Proxy counter.
+func (p *ClamdProxy) countInstreamWrite(total *int64, n int) {
+	*total += int64(n)
+	p.server.metrics.instreamBackendBytes.Add(int64(n))
+}
+
+// backendWriteError marks an INSTREAM failure caused by writing to the
+// backend rather than by the client
+type backendWriteError struct{ err error }
+
+func (e backendWriteError) Error() string { return e.err.Error() }
+func (e backendWriteError) Unwrap() error { return e.err }
@@ -0,0 +1,2091 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// newTestProxy returns a Proxy set up by New with the settings tests rely on
+// left at zero, the few New insists on at their defaults and a logger quiet
+// below errors, after applying configure
+func newTestProxy(tb testing.TB, configure ...func(c *Config)) *Proxy {
+	tb.Helper()
+	c := Config{
+		Denylist:          []string{"SHUTDOWN", "RELOAD"},
+		StreamFlushChunks: 10,
+		ClientBufferSize:  defaultBufferSize,
+		BackendBufferSize: defaultBufferSize,
+		Logger:            slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelError})), // Use error level to minimize test output
+	}
+	for _, fn := range configure {
+		fn(&c)
+	}
+	p, err := New(c)
+	if err != nil {
+		tb.Fatalf("Failed to set up proxy: %v", err)
+	}
+	return p
+}
+
+func TestReadCommand(t *testing.T) {
+	tests := []struct {
+		name          string
+		input         string
+		expectedCmd   string
+		expectedDelim byte
+		expectError   bool
+	}{
+		{
+			name:          "Null terminated command",
+			input:         "PING\x00",
+			expectedCmd:   "PING",
+			expectedDelim: nullDelimiter,
+			expectError:   false,
+		},
+		{
+			name:          "Newline terminated command",
+			input:         "VERSION\n",
+			expectedCmd:   "VERSION",
+			expectedDelim: newlineDelimiter,
+			expectError:   false,
+		},
+		{
+			name:          "Prefixed command",
+			input:         "zVERSIONCOMMANDS\x00",
+			expectedCmd:   "zVERSIONCOMMANDS",
+			expectedDelim: nullDelimiter,
+			expectError:   false,
+		},
+		{
+			name:          "Empty command",
+			input:         "\n",
+			expectedCmd:   "",
+			expectedDelim: newlineDelimiter,
+			expectError:   false,
+		},
+		{
+			name:        "Incomplete command",
+			input:       "PING",
+			expectError: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			reader := bufio.NewReader(strings.NewReader(tc.input))
+			cmd, delim, err := readCommand(reader, 0)
+
+			if tc.expectError && err == nil {
+				t.Fatalf("Expected error but got none")
+			}
+
+			if !tc.expectError && err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if !tc.expectError {
+				if cmd != tc.expectedCmd {
+					t.Errorf("Expected command %q, got %q", tc.expectedCmd, cmd)
+				}
+				if delim != tc.expectedDelim {
+					t.Errorf("Expected delimiter %v, got %v", tc.expectedDelim, delim)
+				}
+			}
+		})
+	}
+}
+
+func FuzzReadCommand(f *testing.F) {
+	// Seeds from TestReadCommand, plus pipelined and length-limited input
+	for _, seed := range []string{"PING\x00", "VERSION\n", "zVERSIONCOMMANDS\x00", "\n", "PING"} {
+		f.Add([]byte(seed), uint8(0))
+	}
+	f.Add([]byte("zIDSESSION\x00zPING\x00nVERSION\n"), uint8(0))
+	f.Add([]byte("zVERSIONCOMMANDS\x00zPING\x00"), uint8(8))
+
+	f.Fuzz(func(t *testing.T, data []byte, maxLength uint8) {
+		reader := bufio.NewReader(bytes.NewReader(data))
+
+		// Successive commands must reassemble into the consumed input
+		var consumed []byte
+		for {
+			cmd, delim, err := readCommand(reader, int(maxLength))
+			if err == errCommandTooLong {
+				if maxLength == 0 || len(cmd) != int(maxLength) {
+					t.Fatalf("Oversized command %q doesn't match limit %d", cmd, maxLength)
+				}
+				consumed = append(consumed, cmd...)
+				if !bytes.HasPrefix(data, consumed) {
+					t.Fatalf("Partial command %q doesn't match input %q", cmd, data)
+				}
+				return
+			}
+			if err != nil {
+				if err != io.EOF {
+					t.Fatalf("Unexpected error %v", err)
+				}
+				return
+			}
+
+			if strings.ContainsAny(cmd, "\x00\n") {
+				t.Fatalf("Command %q contains a delimiter", cmd)
+			}
+			if delim != nullDelimiter && delim != newlineDelimiter {
+				t.Fatalf("Invalid delimiter %q", delim)
+			}
+			if maxLength > 0 && len(cmd) > int(maxLength) {
+				t.Fatalf("Command %q exceeds limit %d", cmd, maxLength)
+			}
+
+			consumed = append(append(consumed, cmd...), delim)
+			if !bytes.HasPrefix(data, consumed) {
+				t.Fatalf("Command %q doesn't match input %q", cmd, data)
+			}
+		}
+	})
+}
+
+func TestIsCommandAllowed(t *testing.T) {
+	allowedCmds := []string{
+		"PING", "VERSION", "VERSIONCOMMANDS", "INSTREAM",
+		"zPING", "zVERSION", "zVERSIONCOMMANDS", "zINSTREAM",
+		"nPING", "nVERSION", "nVERSIONCOMMANDS", "nINSTREAM",
+	}
+
+	disallowedCmds := []string{
+		"SCAN /etc/passwd", "RELOAD", "SHUTDOWN", "CONTSCAN /etc",
+		"MULTISCAN /var", "STATS", "zSTATS", "nSTATS",
+		"", "UNKNOWN",
+	}
+
+	srv := newTestProxy(t)
+	for _, cmd := range allowedCmds {
+		t.Run("Allow "+cmd, func(t *testing.T) {
+			if !srv.isCommandAllowed(cmd) {
+				t.Errorf("Command %q should be allowed", cmd)
+			}
+		})
+	}
+
+	for _, cmd := range disallowedCmds {
+		t.Run("Block "+cmd, func(t *testing.T) {
+			if srv.isCommandAllowed(cmd) {
+				t.Errorf("Command %q should be blocked", cmd)
+			}
+		})
+	}
+}
+
+func TestControlCharacters(t *testing.T) {
+	commands := []string{
+		"PI\tNG", "PING\t", "PING\r", "zVERSION\r", "VER\rSION",
+		"PING\x01", "\x1bPING", "nINSTREAM\x0b", "VERSION\x7f", "IDSESSION\f",
+	}
+
+	for _, mode := range []string{"allow", "deny"} {
+		srv := newTestProxy(t, func(c *Config) {
+			c.Mode = mode
+			c.Denylist = []string{"SHUTDOWN"}
+		})
+		for _, cmd := range commands {
+			if srv.isCommandAllowed(cmd) {
+				t.Errorf("Command %q should be blocked in %s mode", cmd, mode)
+			}
+			if got := srv.blockedResponse(cmd); got != controlCharsResponse {
+				t.Errorf("Expected %q for %q, got %q", controlCharsResponse, cmd, got)
+			}
+		}
+
+		// Printable commands, including non-ASCII paths, are unaffected
+		if !srv.isCommandAllowed("zPING") {
+			t.Errorf("Command %q should be allowed in %s mode", "zPING", mode)
+		}
+	}
+	if hasControlChars("SCAN /srv/dateien/größe") {
+		t.Error("Expected non-ASCII bytes not to count as control characters")
+	}
+}
+
+func TestNormalizeDelimiters(t *testing.T) {
+	stream := string(instreamPayload(6, 4))
+	for _, tc := range []struct {
+		name      string
+		normalize bool
+		input     string
+		expected  string
+	}{
+		{"z command with newline", true, "zPING\n", "zPING\x00"},
+		{"n command with null", true, "nVERSION\x00", "nVERSION\n"},
+		{"Bare command with null", true, "PING\x00", "PING\n"},
+		{"Matching z command", true, "zVERSION\x00", "zVERSION\x00"},
+		{"Matching n command", true, "nPING\n", "nPING\n"},
+		{"Stream after a mismatched terminator", true, "zINSTREAM\n" + stream, "zINSTREAM\x00" + stream},
+		{"Disabled", false, "zPING\n", "zPING\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := newTestProxy(t, func(c *Config) { c.NormalizeDelimiters = tc.normalize })
+			clientSide, backendSide, _ := startProxyWithPipes(t, srv)
+
+			go func() { _, _ = clientSide.Write([]byte(tc.input)) }()
+
+			forwarded := make([]byte, len(tc.expected))
+			if _, err := io.ReadFull(backendSide, forwarded); err != nil {
+				t.Fatalf("Failed to read forwarded command: %v", err)
+			}
+			if string(forwarded) != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, forwarded)
+			}
+		})
+	}
+}
+
+func TestIsConnectionClosed(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{
+			name:     "nil error",
+			err:      nil,
+			expected: false,
+		},
+		{
+			name:     "EOF error",
+			err:      io.EOF,
+			expected: true,
+		},
+		{
+			name:     "Unexpected EOF",
+			err:      io.ErrUnexpectedEOF,
+			expected: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			result := isConnectionClosed(tc.err)
+			if result != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestIsInstreamCommand(t *testing.T) {
+	tests := []struct {
+		cmd      string
+		expected bool
+	}{
+		{"INSTREAM", false},
+		{"zINSTREAM", true},
+		{"nINSTREAM", true},
+		{"PING", false},
+		{"zPING", false},
+		{"nVERSION", false},
+		{"zFOOINSTREAM", false},
+		{"nXINSTREAM", false},
+		{"zzINSTREAM", false},
+		{"zINSTREAMX", false},
+		{"zINSTREAM /etc/passwd", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.cmd, func(t *testing.T) {
+			result := isInstreamCommand(tc.cmd)
+			if result != tc.expected {
+				t.Errorf("For command %q, expected %v, got %v", tc.cmd, tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestLookalikeInstreamCommand(t *testing.T) {
+	// Deny mode forwards names it doesn't know, so the command reaches the
+	// point where a stream would be read
+	srv := newTestProxy(t, func(c *Config) { c.Mode = "deny" })
+	clientSide, backendSide, _ := startProxyWithPipes(t, srv)
+
+	forwarded := make(chan string, 2)
+	go func() {
+		reader := bufio.NewReader(backendSide)
+		for range 2 {
+			cmd, err := reader.ReadString(nullDelimiter)
+			if err != nil {
+				return
+			}
+			forwarded <- cmd
+		}
+	}()
+	go func() { _, _ = io.Copy(io.Discard, clientSide) }()
+
+	// Had zFOOINSTREAM been taken for INSTREAM, the PING would be read as
+	// the length of a chunk
+	if _, err := clientSide.Write([]byte("zFOOINSTREAM\x00zPING\x00")); err != nil {
+		t.Fatalf("Client write failed: %v", err)
+	}
+	for _, expected := range []string{"zFOOINSTREAM\x00", "zPING\x00"} {
+		select {
+		case got := <-forwarded:
+			if got != expected {
+				t.Errorf("Expected %q forwarded, got %q", expected, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected %q forwarded as a command", expected)
+		}
+	}
+}
+
+// Mock reader for testing handleInstream
+// nolint:unused
+type mockReader struct {
+	chunks [][]byte
+	index  int
+}
+
+// nolint:unused
+func (m *mockReader) Read(p []byte) (n int, err error) {
+	if m.index >= len(m.chunks) {
+		return 0, io.EOF
+	}
+
+	n = copy(p, m.chunks[m.index])
+	m.index++
+	return n, nil
+}
+
+// nolint:unused
+func (m *mockReader) ReadByte() (byte, error) {
+	if m.index >= len(m.chunks) || len(m.chunks[m.index]) == 0 {
+		return 0, io.EOF
+	}
+
+	b := m.chunks[m.index][0]
+	m.chunks[m.index] = m.chunks[m.index][1:]
+	if len(m.chunks[m.index]) == 0 {
+		m.index++
+	}
+	return b, nil
+}
+
+// mockConn implements the net.Conn interface for testing
+type mockConn struct{}
+
+func (m *mockConn) Read(b []byte) (n int, err error)   { return 0, io.EOF }
+func (m *mockConn) Write(b []byte) (n int, err error)  { return len(b), nil }
+func (m *mockConn) Close() error                       { return nil }
+func (m *mockConn) LocalAddr() net.Addr                { return &mockAddr{} }
+func (m *mockConn) RemoteAddr() net.Addr               { return &mockAddr{} }
+func (m *mockConn) SetDeadline(t time.Time) error      { return nil }
+func (m *mockConn) SetReadDeadline(t time.Time) error  { return nil }
+func (m *mockConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// mockAddr implements the net.Addr interface for testing
+type mockAddr struct{}
+
+func (m *mockAddr) Network() string { return "tcp" }
+func (m *mockAddr) String() string  { return "127.0.0.1:1234" }
+
+func TestHandleInstream_ZeroChunk(t *testing.T) {
+	// Create a mock reader that returns a zero-size chunk
+	reader := bufio.NewReader(bytes.NewReader([]byte{0, 0, 0, 0}))
+
+	// Create a buffer to capture output
+	var backendBuf bytes.Buffer
+
+	// Create a mock proxy with all required fields
+	p := &ClamdProxy{
+		server:     newTestProxy(t),
+		client:     &mockConn{}, // Add a mock connection
+		backend:    &mockConn{},
+		backendBuf: bufio.NewWriter(&backendBuf),
+		clientBuf:  bufio.NewWriter(io.Discard), // Use io.Discard for client buffer
+	}
+
+	// Call handleInstream
+	err := p.handleInstream(reader)
+
+	// Check results
+	if err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+
+	// Check that the zero chunk was forwarded
+	if backendBuf.Len() != 4 {
+		t.Errorf("Expected 4 bytes written, got %d", backendBuf.Len())
+	}
+
+	// Check the actual bytes
+	expected := []byte{0, 0, 0, 0}
+	if !bytes.Equal(backendBuf.Bytes(), expected) {
+		t.Errorf("Expected %v, got %v", expected, backendBuf.Bytes())
+	}
+}
+
+func TestHandleInstream_CountsBytes(t *testing.T) {
+	// One chunk that fits the pooled buffer and one that takes the CopyN path
+	small := bytes.Repeat([]byte("a"), 10)
+	large := bytes.Repeat([]byte("b"), 40*1024)
+
+	var input bytes.Buffer
+	for _, chunk := range [][]byte{small, large} {
+		size := len(chunk)
+		input.Write([]byte{byte(size >> 24), byte(size >> 16), byte(size >> 8), byte(size)})
+		input.Write(chunk)
+	}
+	input.Write([]byte{0, 0, 0, 0})
+
+	var backendBuf bytes.Buffer
+	srv := newTestProxy(t)
+	p := &ClamdProxy{
+		server:     srv,
+		client:     &mockConn{},
+		backend:    &mockConn{},
+		backendBuf: bufio.NewWriter(&backendBuf),
+		clientBuf:  bufio.NewWriter(io.Discard),
+	}
+
+	if err := p.handleInstream(bufio.NewReader(&input)); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	want := int64(len(small) + len(large))
+	if got := srv.metrics.instreamClientBytes.Load(); got != want {
+		t.Errorf("Expected %d client bytes, got %d", want, got)
+	}
+	if got := srv.metrics.instreamBackendBytes.Load(); got != want {
+		t.Errorf("Expected %d backend bytes, got %d", want, got)
+	}
+}
+
+func TestLocalPing(t *testing.T) {
+	srv := newTestProxy(t, func(c *Config) { c.LocalPing = true })
+
+	clientSide, proxySide := net.Pipe()
+	defer func() { _ = clientSide.Close() }()
+
+	dialed := false
+	p := srv.NewDeferredClamdProxy(proxySide, func() (net.Conn, error) {
+		dialed = true
+		return nil, io.ErrClosedPipe
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Start()
+	}()
+
+	tests := []struct {
+		request  string
+		expected string
+	}{
+		{"zPING\x00", "PONG\x00"},
+		{"nPING\n", "PONG\n"},
+		{"PING\n", "PONG\n"},
+	}
+
+	for _, tc := range tests {
+		if _, err := clientSide.Write([]byte(tc.request)); err != nil {
+			t.Fatalf("Failed to write %q: %v", tc.request, err)
+		}
+		response := make([]byte, len(tc.expected))
+		if _, err := io.ReadFull(clientSide, response); err != nil {
+			t.Fatalf("Failed to read response to %q: %v", tc.request, err)
+		}
+		if string(response) != tc.expected {
+			t.Errorf("For %q expected %q, got %q", tc.request, tc.expected, response)
+		}
+	}
+
+	_ = clientSide.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Proxy did not finish after client closed")
+	}
+
+	if dialed {
+		t.Errorf("Expected backend not to be dialed for local PING")
+	}
+}
+
+func TestLocalPingPipelined(t *testing.T) {
+	srv := newTestProxy(t, func(c *Config) { c.LocalPing = true })
+
+	clientSide, proxyClient := net.Pipe()
+	proxyBackend, backendSide := net.Pipe()
+	defer func() { _ = clientSide.Close() }()
+	defer func() { _ = backendSide.Close() }()
+
+	p := srv.NewDeferredClamdProxy(proxyClient, func() (net.Conn, error) {
+		return proxyBackend, nil
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Start()
+		_ = proxyClient.Close()
+		<-p.clientDone
+	}()
+
+	// The PING is answered from the same read that buffers the start of the
+	// INSTREAM, which must still reach the backend whole and in order
+	stream := append([]byte("nINSTREAM\n"), instreamPayload(10, 4)...)
+	go func() {
+		_, _ = clientSide.Write(append([]byte("nPING\n"), stream...))
+	}()
+
+	// Pipes don't buffer, so the PONG has to be read while the stream is
+	// still being forwarded
+	expected := "PONG\nstream: OK\n"
+	responses := make(chan string, 1)
+	go func() {
+		response := make([]byte, len(expected))
+		n, _ := io.ReadFull(clientSide, response)
+		responses <- string(response[:n])
+	}()
+
+	forwarded := make([]byte, len(stream))
+	if _, err := io.ReadFull(backendSide, forwarded); err != nil {
+		t.Fatalf("Failed to read forwarded stream: %v", err)
+	}
+	if !bytes.Equal(forwarded, stream) {
+		t.Errorf("Expected %q forwarded, got %q", stream, forwarded)
+	}
+	if _, err := backendSide.Write([]byte("stream: OK\n")); err != nil {
+		t.Fatalf("Failed to send verdict: %v", err)
+	}
+
+	if response := <-responses; response != expected {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	_ = clientSide.Close()
+	_ = backendSide.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Proxy did not finish after client closed")
+	}
+}
+
+func TestProxyGoroutinesExit(t *testing.T) {
+	tests := []struct {
+		name  string
+		close func(clientSide, backendSide net.Conn)
+	}{
+		{"Backend closes first", func(_, backendSide net.Conn) {
+			_ = backendSide.Close()
+		}},
+		{"Client leaves before the blocked reply", func(clientSide, _ net.Conn) {
+			_, _ = clientSide.Write([]byte("nSHUTDOWN\n"))
+			_ = clientSide.Close()
+		}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			clientSide, proxyClient := net.Pipe()
+			proxyBackend, backendSide := net.Pipe()
+			t.Cleanup(func() {
+				_ = clientSide.Close()
+				_ = backendSide.Close()
+			})
+
+			// Neither peer is closed by the test after the trigger, so
+			// only the proxy itself can end the other direction
+			p := newTestProxy(t).NewClamdProxy(proxyClient, proxyBackend)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				p.Start()
+			}()
+
+			tc.close(clientSide, backendSide)
+
+			for name, ch := range map[string]<-chan struct{}{"Start": done, "client goroutine": p.clientDone} {
+				select {
+				case <-ch:
+				case <-time.After(2 * time.Second):
+					t.Fatalf("Expected %s to exit", name)
+				}
+			}
+		})
+	}
+}
+
+// startProxyWithPipes runs a connection of srv between two in-memory pipes
+// and returns the client and backend peer ends plus a channel closed once
+// the proxy has fully stopped.
+func startProxyWithPipes(t *testing.T, srv *Proxy) (net.Conn, net.Conn, <-chan struct{}) {
+	t.Helper()
+
+	clientSide, proxyClient := net.Pipe()
+	proxyBackend, backendSide := net.Pipe()
+
+	p := srv.NewClamdProxy(proxyClient, proxyBackend)
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		// Wait for the proxy so it doesn't outlive the test
+		_ = clientSide.Close()
+		_ = backendSide.Close()
+		<-done
+	})
+	go func() {
+		defer close(done)
+		p.Start()
+		_ = proxyClient.Close()
+		<-p.clientDone
+	}()
+
+	return clientSide, backendSide, done
+}
+
+func TestIdleTimeout(t *testing.T) {
+	srv := newTestProxy(t, func(c *Config) { c.IdleTimeout = 50 * time.Millisecond })
+
+	t.Run("Stalled client", func(t *testing.T) {
+		_, _, done := startProxyWithPipes(t, srv)
+
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("Idle connection was not closed")
+		}
+	})
+
+	t.Run("Half-sent INSTREAM", func(t *testing.T) {
+		clientSide, backendSide, done := startProxyWithPipes(t, srv)
+		go func() { _, _ = io.Copy(io.Discard, backendSide) }()
+
+		// Start a stream, announce a chunk and never deliver it
+		if _, err := clientSide.Write([]byte("zINSTREAM\x00\x00\x00\x00\x10")); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("Stalled stream was not closed")
+		}
+	})
+
+	t.Run("Active backend keeps connection open", func(t *testing.T) {
+		clientSide, backendSide, done := startProxyWithPipes(t, srv)
+		go func() { _, _ = io.Copy(io.Discard, clientSide) }()
+
+		// The backend keeps sending well past the idle timeout while the
+		// client is quiet, which must not count as idle
+		for i := 0; i < 6; i++ {
+			if _, err := backendSide.Write([]byte("x")); err != nil {
+				t.Fatalf("Connection closed while backend was active: %v", err)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("Connection was not closed once idle")
+		}
+	})
+}
+
+func TestStartContextCancel(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		input string
+	}{
+		{"Idle connection", ""},
+		{"Mid-stream", "zINSTREAM\x00\x00\x00\x00\x04test"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clientSide, proxyClient := net.Pipe()
+			proxyBackend, backendSide := net.Pipe()
+			defer clientSide.Close()
+			defer backendSide.Close()
+			go func() { _, _ = io.Copy(io.Discard, backendSide) }()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			p := newTestProxy(t).NewClamdProxy(proxyClient, proxyBackend)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				p.StartContext(ctx)
+				<-p.clientDone
+			}()
+
+			if tc.input != "" {
+				if _, err := clientSide.Write([]byte(tc.input)); err != nil {
+					t.Fatalf("Failed to write: %v", err)
+				}
+			}
+			cancel()
+
+			select {
+			case <-done:
+			case <-time.After(2 * time.Second):
+				t.Fatal("Cancelled connection was not closed")
+			}
+
+			// Both connections must have been closed
+			if _, err := clientSide.Write([]byte("x")); err == nil {
+				t.Error("Expected the client connection to be closed")
+			}
+			if _, err := proxyBackend.Write([]byte("x")); err == nil {
+				t.Error("Expected the backend connection to be closed")
+			}
+		})
+	}
+}
+
+func TestMaxConnLifetime(t *testing.T) {
+	var logs syncBuffer
+	srv := newTestProxy(t, func(c *Config) {
+		c.MaxConnLifetime = 100 * time.Millisecond
+		c.Logger = slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	})
+
+	clientSide, proxyClient := net.Pipe()
+	proxyBackend, backendSide := net.Pipe()
+	defer clientSide.Close()
+	defer backendSide.Close()
+
+	// A busy client: it keeps pinging and the backend keeps answering
+	go func() {
+		buf := make([]byte, len("zPING\x00"))
+		for {
+			if _, err := io.ReadFull(backendSide, buf); err != nil {
+				return
+			}
+			if _, err := backendSide.Write([]byte("PONG\x00")); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, len("PONG\x00"))
+		for {
+			if _, err := clientSide.Write([]byte("zPING\x00")); err != nil {
+				return
+			}
+			if _, err := io.ReadFull(clientSide, buf); err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	ctx, cancel := srv.connectionContext(context.Background())
+	defer cancel()
+
+	start := time.Now()
+	p := srv.NewClamdProxy(proxyClient, proxyBackend)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.StartContext(ctx)
+		<-p.clientDone
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Connection outlived its maximum lifetime")
+	}
+	if elapsed := time.Since(start); elapsed < srv.cfg.MaxConnLifetime {
+		t.Errorf("Expected the connection to last %v, closed after %v", srv.cfg.MaxConnLifetime, elapsed)
+	}
+
+	output := logs.String()
+	if !strings.Contains(output, "Connection lifetime expired") || !strings.Contains(output, "bytesTransferred=") {
+		t.Errorf("Expected a lifetime expiry log line with bytes transferred, got %q", output)
+	}
+}
+
+// stalledWriteConn is a client connection that never accepts written data:
+// Write blocks until the write deadline passes or the connection is closed
+type stalledWriteConn struct {
+	net.Conn
+	mu       sync.Mutex
+	deadline time.Time
+	closed   chan struct{}
+}
+
+func (c *stalledWriteConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *stalledWriteConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		expired = time.After(time.Until(deadline))
+	}
+	select {
+	case <-expired:
+		return 0, os.ErrDeadlineExceeded
+	case <-c.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *stalledWriteConn) Close() error {
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
+	return c.Conn.Close()
+}
+
+func TestWriteTimeout(t *testing.T) {
+	var logs syncBuffer
+	srv := newTestProxy(t, func(c *Config) {
+		c.WriteTimeout = 50 * time.Millisecond
+		c.Logger = slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	})
+
+	clientSide, proxyClient := net.Pipe()
+	proxyBackend, backendSide := net.Pipe()
+	defer clientSide.Close()
+	defer backendSide.Close()
+
+	client := &stalledWriteConn{Conn: proxyClient, closed: make(chan struct{})}
+	p := srv.NewClamdProxy(client, proxyBackend)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Start()
+		_ = client.Close()
+		<-p.clientDone
+	}()
+
+	// The backend answers, but the client never reads the reply
+	if _, err := backendSide.Write([]byte("PONG\n")); err != nil {
+		t.Fatalf("Failed to write backend reply: %v", err)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Proxy did not give up on a client that stopped reading")
+	}
+	if !strings.Contains(logs.String(), "Client write timeout") {
+		t.Errorf("Expected a write timeout to be logged, got:\n%s", logs.String())
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use by a logger
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestFrameCommand(t *testing.T) {
+	p := &ClamdProxy{cmdBuf: make([]byte, 0, 8)}
+
+	tests := []struct {
+		cmd   string
+		delim byte
+	}{
+		{"zPING", nullDelimiter},
+		{"nVERSIONCOMMANDS", newlineDelimiter}, // Exceeds the initial capacity
+		{"nPING", newlineDelimiter},            // Shorter than the previous one
+		{strings.Repeat("A", 4096), newlineDelimiter},
+	}
+
+	for _, tc := range tests {
+		expected := tc.cmd + string(tc.delim)
+		if got := string(p.frameCommand(tc.cmd, tc.delim)); got != expected {
+			t.Errorf("Expected %q, got %q", expected, got)
+		}
+	}
+}
+
+func BenchmarkFrameCommand(b *testing.B) {
+	p := &ClamdProxy{}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = p.frameCommand("zINSTREAM", nullDelimiter)
+	}
+}
+
+func BenchmarkFrameCommandAppend(b *testing.B) {
+	// Baseline: the previous per-command allocation
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = append([]byte("zINSTREAM"), nullDelimiter)
+	}
+}
+
+func TestCommandArguments(t *testing.T) {
+	srv := newTestProxy(t)
+
+	tests := []struct {
+		cmd     string
+		allowed bool
+	}{
+		{"PING", true},
+		{"zPING", true},
+		{"PING /etc/passwd", false},
+		{"zPING /etc/passwd", false},
+		{"nVERSION extra", false},
+		{"zINSTREAM now", false},
+		{"IDSESSION 1", false},
+		{"STATS", true},
+		{"zSTATS", true},
+		{"STATS /etc/passwd", false},
+		{"SCAN /tmp/file", true},
+		{"zCONTSCAN /tmp/dir", true},
+		{"FILDES", false}, // Not whitelisted at all
+	}
+
+	rules := map[string]commandRule{"STATS": {}}
+	for name, rule := range builtinWhitelist {
+		rules[name] = rule
+	}
+	rules["SCAN"] = defaultRule("SCAN")
+	rules["CONTSCAN"] = defaultRule("CONTSCAN")
+	srv.setAllowedCommands(rules)
+
+	for _, tc := range tests {
+		t.Run(tc.cmd, func(t *testing.T) {
+			if got := srv.isCommandAllowed(tc.cmd); got != tc.allowed {
+				t.Errorf("Expected %v, got %v", tc.allowed, got)
+			}
+		})
+	}
+
+	// An explicit rule lets an otherwise argument-less command take some
+	rules["STATS"] = commandRule{args: true}
+	if !srv.isCommandAllowed("STATS verbose") {
+		t.Error("Expected STATS with arguments to be allowed by its rule")
+	}
+}
+
+func TestIsCommandAllowedModes(t *testing.T) {
+	tests := []struct {
+		cmd          string
+		allowInAllow bool
+		allowInDeny  bool
+	}{
+		{"PING", true, true},
+		{"zINSTREAM", true, true},
+		{"nVERSION", true, true},
+		{"STATS", false, true},
+		{"zSTATS", false, true},
+		{"SCAN /etc/passwd", false, true},
+		{"SHUTDOWN", false, false},
+		{"zSHUTDOWN", false, false},
+		{"nRELOAD", false, false},
+		{"RELOAD now", false, false},
+		{"zap", false, true},
+		{"nonsense", false, true},
+		{"nRELOADX", false, true},
+		{"", false, false},
+	}
+
+	for _, mode := range []string{"allow", "deny"} {
+		srv := newTestProxy(t, func(c *Config) { c.Mode = mode })
+		for _, tc := range tests {
+			expected := tc.allowInAllow
+			if mode == "deny" {
+				expected = tc.allowInDeny
+			}
+			t.Run(mode+" "+tc.cmd, func(t *testing.T) {
+				if got := srv.isCommandAllowed(tc.cmd); got != expected {
+					t.Errorf("Expected %q allowed=%v in %s mode, got %v", tc.cmd, expected, mode, got)
+				}
+			})
+		}
+	}
+}
+
+func TestDisableInstream(t *testing.T) {
+	for _, mode := range []string{"allow", "deny"} {
+		srv := newTestProxy(t, func(c *Config) {
+			c.Mode = mode
+			c.DisableInstream = true
+		})
+		for cmd, expected := range map[string]bool{
+			"zINSTREAM": false,
+			"nINSTREAM": false,
+			"INSTREAM":  false,
+			"zPING":     true,
+			"nVERSION":  true,
+		} {
+			t.Run(mode+" "+cmd, func(t *testing.T) {
+				if got := srv.isCommandAllowed(cmd); got != expected {
+					t.Errorf("Expected %q allowed=%v in %s mode, got %v", cmd, expected, mode, got)
+				}
+			})
+		}
+	}
+
+	t.Run("Proxy", func(t *testing.T) {
+		srv := newTestProxy(t, func(c *Config) { c.DisableInstream = true })
+		clientSide, backendSide, _ := startProxyWithPipes(t, srv)
+
+		forwarded := make(chan string, 1)
+		go func() {
+			cmd := make([]byte, len("zPING\x00"))
+			_, _ = io.ReadFull(backendSide, cmd)
+			forwarded <- string(cmd)
+			_, _ = backendSide.Write([]byte("PONG\x00"))
+		}()
+
+		// The blocked stream never reaches handleInstream, the backend only
+		// ever sees the PING
+		go func() { _, _ = clientSide.Write([]byte("zINSTREAM\x00zPING\x00")) }()
+
+		expected := "UNKNOWN COMMAND\x00PONG\x00"
+		response := make([]byte, len(expected))
+		if _, err := io.ReadFull(clientSide, response); err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		if string(response) != expected {
+			t.Errorf("Expected %q, got %q", expected, response)
+		}
+		if got := <-forwarded; got != "zPING\x00" {
+			t.Errorf("Expected only zPING forwarded, got %q", got)
+		}
+	})
+}
+
+func TestCanonicalCommand(t *testing.T) {
+	tests := map[string]string{
+		"Zping":            "zPING",
+		"ping":             "PING",
+		"nVersion":         "nVERSION",
+		"Nversioncommands": "nVERSIONCOMMANDS",
+		"nscan /Tmp/File":  "nSCAN /Tmp/File",
+		"zINSTREAM":        "zINSTREAM",
+		"zap":              "zap",
+		"zzping":           "zzping",
+		" ping":            " ping",
+	}
+	for cmd, expected := range tests {
+		if got := canonicalCommand(cmd); got != expected {
+			t.Errorf("Expected %q for %q, got %q", expected, cmd, got)
+		}
+	}
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	// Filtered as the proxy does, which canonicalizes commands first
+	allowed := func(srv *Proxy, cmd string) bool {
+		if srv.cfg.CaseInsensitive {
+			cmd = canonicalCommand(cmd)
+		}
+		return srv.isCommandAllowed(cmd)
+	}
+
+	tests := []struct {
+		mode        string
+		cmd         string
+		exact       bool
+		insensitive bool
+	}{
+		{"allow", "zPING", true, true},
+		{"allow", "ping", false, true},
+		{"allow", "Zping", false, true},
+		{"allow", "nVersion", false, true},
+		{"allow", "zshutdown", false, false},
+		{"allow", "Scan /etc", false, false},
+		{"deny", "zSHUTDOWN", true, false},
+		{"deny", "Shutdown", true, false},
+		{"deny", "nreload", true, false},
+		{"deny", "zping", true, true},
+	}
+
+	for _, insensitive := range []bool{false, true} {
+		for _, tc := range tests {
+			t.Run(fmt.Sprintf("%s %s insensitive=%v", tc.mode, tc.cmd, insensitive), func(t *testing.T) {
+				srv := newTestProxy(t, func(c *Config) {
+					c.CaseInsensitive = insensitive
+					c.Mode = tc.mode
+					c.Denylist = []string{"shutdown", "RELOAD"}
+				})
+
+				expected := tc.exact
+				if insensitive {
+					expected = tc.insensitive
+				}
+				if got := allowed(srv, tc.cmd); got != expected {
+					t.Errorf("Expected allowed=%v, got %v", expected, got)
+				}
+			})
+		}
+	}
+
+	t.Run("Whitelist", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "whitelist")
+		if err := os.WriteFile(path, []byte("ping\nScan\n"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		set, err := loadWhitelist(path, true)
+		if err != nil {
+			t.Fatalf("Failed to load whitelist: %v", err)
+		}
+		if _, ok := set["PING"]; !ok || !set["SCAN"].args || len(set) != 2 {
+			t.Errorf("Expected upper-cased PING and SCAN with arguments, got %v", set)
+		}
+	})
+
+	t.Run("Proxy", func(t *testing.T) {
+		srv := newTestProxy(t, func(c *Config) { c.CaseInsensitive = true })
+		clientSide, backendSide, _ := startProxyWithPipes(t, srv)
+
+		forwarded := make(chan string, 1)
+		go func() {
+			cmd := make([]byte, len("zPING\x00"))
+			_, _ = io.ReadFull(backendSide, cmd)
+			forwarded <- string(cmd)
+			_, _ = backendSide.Write([]byte("PONG\x00"))
+		}()
+		go func() { _, _ = clientSide.Write([]byte("Zping\x00")) }()
+
+		response := make([]byte, len("PONG\x00"))
+		if _, err := io.ReadFull(clientSide, response); err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		if got := <-forwarded; got != "zPING\x00" {
+			t.Errorf("Expected zPING forwarded, got %q", got)
+		}
+	})
+}
+
+func TestCommandName(t *testing.T) {
+	tests := []struct {
+		cmd      string
+		expected string
+	}{
+		{"zINSTREAM", "INSTREAM"},
+		{"nPING", "PING"},
+		{"PING", "PING"},
+		{"zIDSESSION", "IDSESSION"},
+		{"nSCAN /etc/passwd", "SCAN"},
+		{"zap", "zap"},
+		{"nonsense", "nonsense"},
+		{"now", "now"},
+		{"zzPING", "zzPING"},
+		{"", ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.cmd, func(t *testing.T) {
+			if got := commandName(tc.cmd); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestCommandSet(t *testing.T) {
+	set := newTestProxy(t).commandSet([]string{"SHUTDOWN", " RELOAD ", ""})
+	if len(set) != 2 || !set["SHUTDOWN"] || !set["RELOAD"] {
+		t.Errorf("Unexpected command set %v", set)
+	}
+}
+
+func TestReadCommandMaxLength(t *testing.T) {
+	reader := bufio.NewReader(strings.NewReader("zVERSIONCOMMANDS\x00"))
+	partial, _, err := readCommand(reader, 8)
+	if err != errCommandTooLong {
+		t.Fatalf("Expected errCommandTooLong, got %v", err)
+	}
+	if partial != "zVERSION" {
+		t.Errorf("Expected partial command %q, got %q", "zVERSION", partial)
+	}
+
+	reader = bufio.NewReader(strings.NewReader("zPING\x00"))
+	if cmd, _, err := readCommand(reader, 5); err != nil || cmd != "zPING" {
+		t.Errorf("Expected a command at the limit to be accepted, got %q, %v", cmd, err)
+	}
+}
+
+func TestOversizedCommand(t *testing.T) {
+	limits := func(drain bool) *Proxy {
+		return newTestProxy(t, func(c *Config) {
+			c.MaxCommandLength = 16
+			c.MaxDrainBytes = 64
+			c.DrainOversized = drain
+		})
+	}
+
+	expectedResponse := commandTooLongResponse + "\n"
+
+	t.Run("Drained", func(t *testing.T) {
+		clientSide, backendSide, _ := startProxyWithPipes(t, limits(true))
+
+		go func() {
+			_, _ = clientSide.Write([]byte("n" + strings.Repeat("X", 40) + "\nnPING\n"))
+		}()
+
+		response := make([]byte, len(expectedResponse))
+		if _, err := io.ReadFull(clientSide, response); err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		if string(response) != expectedResponse {
+			t.Errorf("Expected %q, got %q", expectedResponse, response)
+		}
+
+		// The connection survives and the next command is forwarded
+		forwarded := make([]byte, len("nPING\n"))
+		if _, err := io.ReadFull(backendSide, forwarded); err != nil {
+			t.Fatalf("Failed to read forwarded command: %v", err)
+		}
+		if string(forwarded) != "nPING\n" {
+			t.Errorf("Expected %q forwarded, got %q", "nPING\n", forwarded)
+		}
+	})
+
+	t.Run("Drain limit exceeded", func(t *testing.T) {
+		clientSide, _, done := startProxyWithPipes(t, limits(true))
+
+		go func() {
+			_, _ = clientSide.Write([]byte("n" + strings.Repeat("X", 200) + "\nnPING\n"))
+		}()
+
+		response := make([]byte, len(expectedResponse))
+		if _, err := io.ReadFull(clientSide, response); err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("Connection was not closed")
+		}
+	})
+
+	t.Run("Closed", func(t *testing.T) {
+		clientSide, _, done := startProxyWithPipes(t, limits(false))
+
+		go func() {
+			_, _ = clientSide.Write([]byte("z" + strings.Repeat("X", 40) + "\x00"))
+		}()
+
+		expected := commandTooLongResponse + "\x00"
+		response := make([]byte, len(expected))
+		if _, err := io.ReadFull(clientSide, response); err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		if string(response) != expected {
+			t.Errorf("Expected %q, got %q", expected, response)
+		}
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("Connection was not closed")
+		}
+	})
+}
+
+// tcpPair returns both ends of a loopback TCP connection, which unlike
+// net.Pipe supports half-close
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer func() { _ = ln.Close() }()
+
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	accepted, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = dialed.Close()
+		_ = accepted.Close()
+	})
+	return dialed.(*net.TCPConn), accepted.(*net.TCPConn)
+}
+
+func TestHalfCloseDeliversVerdict(t *testing.T) {
+	clientSide, proxyClient := tcpPair(t)
+	proxyBackend, backendSide := tcpPair(t)
+
+	p := newTestProxy(t).NewClamdProxy(proxyClient, proxyBackend)
+	go func() {
+		p.Start()
+		_ = proxyClient.Close()
+	}()
+
+	// Like clamd, the backend only answers once it has seen the end of the
+	// client's input, so a full close would lose the verdict
+	go func() {
+		_, _ = io.Copy(io.Discard, backendSide)
+		_, _ = backendSide.Write([]byte("stream: OK\x00"))
+		_ = backendSide.Close()
+	}()
+
+	request := []byte("zINSTREAM\x00\x00\x00\x00\x04test\x00\x00\x00\x00")
+	if _, err := clientSide.Write(request); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if err := clientSide.CloseWrite(); err != nil {
+		t.Fatalf("Failed to half-close client: %v", err)
+	}
+
+	_ = clientSide.SetReadDeadline(time.Now().Add(2 * time.Second))
+	response, err := io.ReadAll(clientSide)
+	if err != nil {
+		t.Fatalf("Failed to read verdict: %v", err)
+	}
+	if string(response) != "stream: OK\x00" {
+		t.Errorf("Expected verdict %q, got %q", "stream: OK\x00", response)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	srv := newTestProxy(t, func(c *Config) { c.DryRun = true })
+	clientSide, backendSide, done := startProxyWithPipes(t, srv)
+
+	go func() { _, _ = clientSide.Write([]byte("zSHUTDOWN\x00")) }()
+
+	forwarded := make([]byte, len("zSHUTDOWN\x00"))
+	if _, err := io.ReadFull(backendSide, forwarded); err != nil {
+		t.Fatalf("Failed to read forwarded command: %v", err)
+	}
+	if string(forwarded) != "zSHUTDOWN\x00" {
+		t.Errorf("Expected %q forwarded, got %q", "zSHUTDOWN\x00", forwarded)
+	}
+
+	_ = clientSide.Close()
+	_ = backendSide.Close()
+	<-done
+
+	if got := srv.metrics.commandsWouldBlock.Load(); got != 1 {
+		t.Errorf("Expected 1 would-be-blocked command, got %d", got)
+	}
+}
+
+func TestBlockedResponseTerminator(t *testing.T) {
+	tests := []struct {
+		request  string
+		expected string
+	}{
+		{"zSHUTDOWN\x00", "UNKNOWN COMMAND\x00"},
+		{"nSHUTDOWN\n", "UNKNOWN COMMAND\n"},
+		{"SHUTDOWN\n", "UNKNOWN COMMAND\n"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.request, func(t *testing.T) {
+			clientSide, _, _ := startProxyWithPipes(t, newTestProxy(t))
+
+			go func() { _, _ = clientSide.Write([]byte(tc.request)) }()
+
+			response := make([]byte, len(tc.expected))
+			if _, err := io.ReadFull(clientSide, response); err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+			if string(response) != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, response)
+			}
+		})
+	}
+}
+
+func TestUnknownCommandBlocked(t *testing.T) {
+	tests := []struct {
+		name     string
+		request  string
+		unknown  int64
+		expected string // Log message
+	}{
+		{"Known command", "zSHUTDOWN\x00", 0, "Blocked command"},
+		{"Garbage", "GET / HTTP/1.1\n", 1, "Blocked unknown command, possible client protocol error"},
+		{"Wrong prefix", "xPING\n", 1, "Blocked unknown command, possible client protocol error"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var logs syncBuffer
+			srv := newTestProxy(t, func(c *Config) {
+				c.Logger = slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelInfo}))
+			})
+
+			clientSide, _, _ := startProxyWithPipes(t, srv)
+			go func() { _, _ = clientSide.Write([]byte(tc.request)) }()
+
+			response := make([]byte, len(defaultBlockedResponse)+1)
+			if _, err := io.ReadFull(clientSide, response); err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+
+			if got := srv.metrics.commandsBlocked.Load(); got != 1 {
+				t.Errorf("Expected 1 blocked command, got %d", got)
+			}
+			if got := srv.metrics.commandsUnknown.Load(); got != tc.unknown {
+				t.Errorf("Expected %d unknown commands, got %d", tc.unknown, got)
+			}
+			if !strings.Contains(logs.String(), "msg=\""+tc.expected+"\"") {
+				t.Errorf("Expected %q in logs, got %q", tc.expected, logs.String())
+			}
+		})
+	}
+}
+
+func TestIsKnownCommand(t *testing.T) {
+	tests := []struct {
+		cmd      string
+		expected bool
+	}{
+		{"SHUTDOWN", true},
+		{"zSCAN /etc", true},
+		{"nVERSION", true},
+		{"xPING", false},
+		{"ping", false},
+		{"\x16\x03\x01", false},
+		{"", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.cmd, func(t *testing.T) {
+			if got := isKnownCommand(tc.cmd); got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestBlockedResponseTemplate(t *testing.T) {
+	srv := newTestProxy(t, func(c *Config) { c.BlockedResponse = "{command}: Command not allowed. ERROR" })
+	if got := srv.blockedResponse("zSHUTDOWN"); got != "SHUTDOWN: Command not allowed. ERROR" {
+		t.Errorf("Unexpected blocked response %q", got)
+	}
+}
+
+// instreamPayload frames size bytes of synthetic data as an INSTREAM body
+// split into chunks of chunkSize, followed by the terminating zero chunk
+func instreamPayload(size, chunkSize int) []byte {
+	data := bytes.Repeat([]byte("0123456789abcdef"), size/16+1)[:size]
+
+	var buf bytes.Buffer
+	for len(data) > 0 {
+		n := min(chunkSize, len(data))
+		buf.Write([]byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)})
+		buf.Write(data[:n])
+		data = data[n:]
+	}
+	buf.Write([]byte{0, 0, 0, 0})
+	return buf.Bytes()
+}
+
+func TestHandleInstream_LargeStream(t *testing.T) {
+	for _, chunkSize := range []int{8 * 1024, 32 * 1024, 64 * 1024} {
+		t.Run(fmt.Sprintf("%dKB", chunkSize/1024), func(t *testing.T) {
+			payload := instreamPayload(4*1024*1024+123, chunkSize)
+
+			var backend bytes.Buffer
+			p := &ClamdProxy{
+				server:     newTestProxy(t),
+				client:     &mockConn{},
+				backend:    &mockConn{},
+				backendBuf: bufio.NewWriterSize(&backend, 64*1024),
+				clientBuf:  bufio.NewWriter(io.Discard),
+			}
+
+			if err := p.handleInstream(bufio.NewReader(bytes.NewReader(payload))); err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if !bytes.Equal(backend.Bytes(), payload) {
+				t.Errorf("Backend received %d bytes that differ from the %d sent", backend.Len(), len(payload))
+			}
+		})
+	}
+}
+
+// BenchmarkHandleInstream measures stream throughput across chunk sizes and
+// --stream-flush-chunks values
+func BenchmarkHandleInstream(b *testing.B) {
+	const streamSize = 8 * 1024 * 1024
+	for _, chunkSize := range []int{8 * 1024, 32 * 1024, 64 * 1024} {
+		payload := instreamPayload(streamSize, chunkSize)
+		for _, flush := range []int{1, 10, 100} {
+			name := fmt.Sprintf("chunk=%dKB/flush=%d", chunkSize/1024, flush)
+			b.Run(name, func(b *testing.B) {
+				src := bytes.NewReader(payload)
+				reader := bufio.NewReaderSize(src, 64*1024)
+				p := &ClamdProxy{
+					server:     newTestProxy(b, func(c *Config) { c.StreamFlushChunks = flush }),
+					client:     &mockConn{},
+					backend:    &mockConn{},
+					backendBuf: bufio.NewWriterSize(io.Discard, 64*1024),
+					clientBuf:  bufio.NewWriter(io.Discard),
+				}
+
+				b.SetBytes(streamSize)
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					src.Reset(payload)
+					reader.Reset(src)
+					if err := p.handleInstream(reader); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestInstreamBackendFailure(t *testing.T) {
+	for _, tc := range []struct {
+		command  string
+		expected string
+	}{
+		{"zINSTREAM\x00", backendUnavailableResponse + "\x00"},
+		{"nINSTREAM\n", backendUnavailableResponse + "\n"},
+	} {
+		t.Run(tc.expected, func(t *testing.T) {
+			clientSide, backendSide, _ := startProxyWithPipes(t, newTestProxy(t))
+
+			go func() {
+				_, _ = clientSide.Write([]byte(tc.command))
+				_, _ = clientSide.Write([]byte{0, 0, 0, 4, 't', 'e', 's', 't'})
+			}()
+
+			// The backend drops the connection in the middle of the stream
+			forwarded := make([]byte, len(tc.command))
+			if _, err := io.ReadFull(backendSide, forwarded); err != nil {
+				t.Fatalf("Failed to read forwarded command: %v", err)
+			}
+			_ = backendSide.Close()
+
+			response := make([]byte, len(tc.expected))
+			if _, err := io.ReadFull(clientSide, response); err != nil {
+				t.Fatalf("Failed to read response: %v", err)
+			}
+			if string(response) != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, response)
+			}
+		})
+	}
+}
+
+func TestMaxStreamChunks(t *testing.T) {
+	srv := newTestProxy(t, func(c *Config) { c.MaxStreamChunks = 5 })
+	clientSide, backendSide, done := startProxyWithPipes(t, srv)
+
+	forwarded := make(chan []byte, 1)
+	go func() {
+		data, _ := io.ReadAll(backendSide)
+		forwarded <- data
+	}()
+
+	// One-byte chunks, one past the limit. The proxy stops reading at the
+	// sixth header, so the remaining writes may fail.
+	go func() {
+		_, _ = clientSide.Write([]byte("zINSTREAM\x00"))
+		for i := 0; i < 6; i++ {
+			if _, err := clientSide.Write([]byte{0, 0, 0, 1, 'x'}); err != nil {
+				return
+			}
+		}
+	}()
+
+	expected := tooManyChunksResponse + "\x00"
+	response := make([]byte, len(expected))
+	if _, err := io.ReadFull(clientSide, response); err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if string(response) != expected {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stream over the chunk limit was not aborted")
+	}
+
+	// Chunks still buffered are dropped with the backend connection, but
+	// nothing past the limit and no end of stream may reach it
+	want := "zINSTREAM\x00" + strings.Repeat("\x00\x00\x00\x01x", 5)
+	if got := <-forwarded; !strings.HasPrefix(want, string(got)) {
+		t.Errorf("Expected at most the first 5 chunks to be forwarded, got %q", got)
+	}
+}
+
+func TestMaxChunkBytes(t *testing.T) {
+	srv := newTestProxy(t, func(c *Config) { c.MaxChunkBytes = 1024 })
+	clientSide, backendSide, done := startProxyWithPipes(t, srv)
+
+	forwarded := make(chan []byte, 1)
+	go func() {
+		data, _ := io.ReadAll(backendSide)
+		forwarded <- data
+	}()
+
+	// A small chunk, then a header declaring almost 4GB. The proxy stops
+	// reading at that header, so writing the data may fail.
+	go func() {
+		_, _ = clientSide.Write([]byte("nINSTREAM\n"))
+		_, _ = clientSide.Write([]byte{0, 0, 0, 4, 't', 'e', 's', 't'})
+		_, _ = clientSide.Write([]byte{0xff, 0xff, 0xff, 0xff})
+		_, _ = clientSide.Write(make([]byte, 4096))
+	}()
+
+	expected := chunkTooLargeResponse + "\n"
+	response := make([]byte, len(expected))
+	if _, err := io.ReadFull(clientSide, response); err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if string(response) != expected {
+		t.Errorf("Expected %q, got %q", expected, response)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stream with an oversized chunk was not aborted")
+	}
+
+	// Neither the oversized header nor any of its data reaches the backend
+	want := "nINSTREAM\n\x00\x00\x00\x04test"
+	if got := <-forwarded; !strings.HasPrefix(want, string(got)) {
+		t.Errorf("Expected at most the first chunk to be forwarded, got %q", got)
+	}
+}
+
+func TestChunkBufferSize(t *testing.T) {
+	tests := []struct {
+		maxChunkBytes int
+		expected      int
+	}{
+		{0, defaultChunkBufSize},
+		{10485760, defaultChunkBufSize},
+		{1024, 1024},
+	}
+	for _, test := range tests {
+		if got := chunkBufferSize(test.maxChunkBytes); got != test.expected {
+			t.Errorf("Expected %d for --max-chunk-bytes %d, got %d", test.expected, test.maxChunkBytes, got)
+		}
+	}
+}
+
+func TestUndersizedChunkPool(t *testing.T) {
+	// Buffers smaller than chunkBufSize promises must not be sliced past
+	// their capacity; the chunk gets a buffer of its own instead
+	srv := newTestProxy(t)
+	srv.chunkBufPool.New = func() interface{} {
+		buf := make([]byte, 16)
+		return &buf
+	}
+	clientSide, backendSide, done := startProxyWithPipes(t, srv)
+
+	payload := instreamPayload(1000, 500)
+	go func() {
+		_, _ = clientSide.Write([]byte("zINSTREAM\x00"))
+		_, _ = clientSide.Write(payload)
+	}()
+
+	forwarded := make([]byte, len("zINSTREAM\x00")+len(payload))
+	if _, err := io.ReadFull(backendSide, forwarded); err != nil {
+		t.Fatalf("Failed to read forwarded stream: %v", err)
+	}
+	if expected := append([]byte("zINSTREAM\x00"), payload...); !bytes.Equal(forwarded, expected) {
+		t.Error("Forwarded stream differs from what the client sent")
+	}
+
+	_ = clientSide.Close()
+	_ = backendSide.Close()
+	<-done
+
+	if got := srv.metrics.instreamUnpooledChunks.Load(); got != 2 {
+		t.Errorf("Expected 2 unpooled chunks, got %d", got)
+	}
+}
+
+func TestMaxCommandsPerConn(t *testing.T) {
+	srv := newTestProxy(t, func(c *Config) { c.MaxCommandsPerConn = 3 })
+	clientSide, backendSide, done := startProxyWithPipes(t, srv)
+
+	// Answers null-terminated commands like clamd, reading INSTREAM chunks
+	// up to the terminating one
+	received := make(chan []string, 1)
+	go func() {
+		var commands []string
+		defer func() { received <- commands }()
+		reader := bufio.NewReader(backendSide)
+		for {
+			cmd, err := reader.ReadString(0)
+			if err != nil {
+				return
+			}
+			commands = append(commands, strings.TrimSuffix(cmd, "\x00"))
+			reply := "PONG\x00"
+			if cmd == "zINSTREAM\x00" {
+				size := make([]byte, 4)
+				for {
+					if _, err := io.ReadFull(reader, size); err != nil {
+						return
+					}
+					n := int(size[0])<<24 | int(size[1])<<16 | int(size[2])<<8 | int(size[3])
+					if n == 0 {
+						break
+					}
+					if _, err := reader.Discard(n); err != nil {
+						return
+					}
+				}
+				reply = "stream: OK\x00"
+			}
+			if _, err := backendSide.Write([]byte(reply)); err != nil {
+				return
+			}
+		}
+	}()
+
+	exchange := func(request, expected string) {
+		t.Helper()
+		go func() { _, _ = clientSide.Write([]byte(request)) }()
+		reply := make([]byte, len(expected))
+		if _, err := io.ReadFull(clientSide, reply); err != nil {
+			t.Fatalf("Failed to read reply to %q: %v", request, err)
+		}
+		if string(reply) != expected {
+			t.Errorf("Expected %q, got %q", expected, reply)
+		}
+	}
+
+	// A stream of several chunks counts as a single command
+	exchange("zPING\x00", "PONG\x00")
+	exchange("zINSTREAM\x00"+string(instreamPayload(12, 4)), "stream: OK\x00")
+	exchange("zPING\x00", "PONG\x00")
+	exchange("zPING\x00", commandLimitResponse+"\x00")
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Connection over the command limit was not closed")
+	}
+	expected := []string{"zPING", "zINSTREAM", "zPING"}
+	if got := <-received; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected the backend to receive %v, got %v", expected, got)
+	}
+}
+
+// earlyCloseBackend is a clamd connection that stops accepting data after
+// the first limit bytes, like clamd closing a stream it has a verdict for.
+// Reads block until then and return reply followed by EOF.
+type earlyCloseBackend struct {
+	mockConn
+	mu      sync.Mutex
+	limit   int
+	written bytes.Buffer
+	closed  chan struct{}
+	reply   []byte
+}
+
+func (b *earlyCloseBackend) Write(data []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.written.Len()+len(data) > b.limit {
+		select {
+		case <-b.closed:
+		default:
+			close(b.closed)
+		}
+		return 0, &net.OpError{Op: "write", Net: "tcp", Err: syscall.EPIPE}
+	}
+	return b.written.Write(data)
+}
+
+func (b *earlyCloseBackend) Read(data []byte) (int, error) {
+	<-b.closed
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.reply) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(data, b.reply)
+	b.reply = b.reply[n:]
+	return n, nil
+}
+
+func TestInstreamBackendClosesEarly(t *testing.T) {
+	var logs syncBuffer
+	srv := newTestProxy(t, func(c *Config) {
+		c.StreamFlushChunks = 1
+		c.Logger = slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	})
+
+	const verdict = "stream: INSTREAM size limit exceeded. ERROR\x00"
+	clientSide, proxyClient := net.Pipe()
+	defer clientSide.Close()
+
+	// Accepts the command and the first chunk, then closes
+	backend := &earlyCloseBackend{
+		limit:  len("zINSTREAM\x00") + 4 + 4,
+		closed: make(chan struct{}),
+		reply:  []byte(verdict),
+	}
+	p := srv.NewClamdProxy(proxyClient, backend)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Start()
+		_ = proxyClient.Close()
+		<-p.clientDone
+	}()
+
+	go func() {
+		_, _ = clientSide.Write([]byte("zINSTREAM\x00"))
+		for i := 0; i < 3; i++ {
+			if _, err := clientSide.Write([]byte{0, 0, 0, 4, 't', 'e', 's', 't'}); err != nil {
+				return
+			}
+		}
+	}()
+
+	_ = clientSide.SetReadDeadline(time.Now().Add(2 * time.Second))
+	response, err := io.ReadAll(clientSide)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if string(response) != verdict {
+		t.Errorf("Expected clamd's reply %q, got %q", verdict, response)
+	}
+	<-done
+
+	if strings.Contains(logs.String(), "level=ERROR") {
+		t.Errorf("Expected no error-level log, got:\n%s", logs.String())
+	}
+	if !strings.Contains(logs.String(), "Backend closed the stream early") {
+		t.Errorf("Expected the early close to be logged, got:\n%s", logs.String())
+	}
+}
+
+func TestHandleInstream_PartialChunk(t *testing.T) {
+	// A 16 byte chunk of which the client only delivers 5 bytes
+	input := append([]byte{0, 0, 0, 16}, "abcde"...)
+
+	var backend bytes.Buffer
+	p := &ClamdProxy{
+		server:     newTestProxy(t),
+		client:     &mockConn{},
+		backend:    &mockConn{},
+		backendBuf: bufio.NewWriter(&backend),
+		clientBuf:  bufio.NewWriter(io.Discard),
+	}
+
+	if err := p.handleInstream(bufio.NewReader(bytes.NewReader(input))); err == nil {
+		t.Fatal("Expected an error for a truncated chunk")
+	}
+	if buffered := p.backendBuf.Buffered() + backend.Len(); buffered != 0 {
+		t.Errorf("Expected nothing of the partial chunk to be forwarded, got %d bytes", buffered)
+	}
+}
+
+func TestHandleInstream_PartialLargeChunk(t *testing.T) {
+	// A chunk too large for the pooled buffers, of which the client only
+	// delivers part before going away
+	srv := newTestProxy(t)
+	size := srv.chunkBufSize + 32*1024
+	input := append([]byte{0, byte(size >> 16), byte(size >> 8), byte(size)}, make([]byte, size/2)...)
+
+	// Small enough that forwarding any of the chunk would reach the backend
+	var backend bytes.Buffer
+	p := &ClamdProxy{
+		server:     srv,
+		client:     &mockConn{},
+		backend:    &mockConn{},
+		backendBuf: bufio.NewWriterSize(&backend, 4096),
+		clientBuf:  bufio.NewWriter(io.Discard),
+	}
+
+	if err := p.handleInstream(bufio.NewReader(bytes.NewReader(input))); err == nil {
+		t.Fatal("Expected an error for a truncated chunk")
+	}
+	if srv.metrics.instreamUnpooledChunks.Load() == 0 {
+		t.Fatal("Expected the chunk to bypass the pooled buffers")
+	}
+	if buffered := p.backendBuf.Buffered() + backend.Len(); buffered != 0 {
+		t.Errorf("Expected nothing of the partial chunk to be forwarded, got %d bytes", buffered)
+	}
+}
+
+func TestHandleInstream_HugeChunkForwardedInPieces(t *testing.T) {
+	// With --max-chunk-bytes disabled, a chunk over maxBufferedChunk must
+	// not be held in full; whole pieces are forwarded as they arrive
+	size := 3 * maxBufferedChunk
+	input := append([]byte{byte(size >> 24), byte(size >> 16), byte(size >> 8), byte(size)}, make([]byte, maxBufferedChunk+100)...)
+
+	var backend bytes.Buffer
+	p := &ClamdProxy{
+		server:     newTestProxy(t),
+		client:     &mockConn{},
+		backend:    &mockConn{},
+		backendBuf: bufio.NewWriterSize(&backend, 4096),
+		clientBuf:  bufio.NewWriter(io.Discard),
+	}
+
+	if err := p.handleInstream(bufio.NewReader(bytes.NewReader(input))); err == nil {
+		t.Fatal("Expected an error for a truncated chunk")
+	}
+	if forwarded := p.backendBuf.Buffered() + backend.Len(); forwarded != 4+maxBufferedChunk {
+		t.Errorf("Expected the size header and one piece to be forwarded, got %d bytes", forwarded)
+	}
+}
+
+// BenchmarkConnection measures the allocations of a short-lived connection
+// that sends a single PING
+func BenchmarkConnection(b *testing.B) {
+	srv := newTestProxy(b)
+	reply := make([]byte, 5)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		clientSide, proxyClient := net.Pipe()
+		proxyBackend, backendSide := net.Pipe()
+
+		p := srv.NewClamdProxy(proxyClient, proxyBackend)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			p.Start()
+			_ = proxyClient.Close()
+			<-p.clientDone
+		}()
+
+		go func() {
+			cmd := make([]byte, 6)
+			if _, err := io.ReadFull(backendSide, cmd); err == nil {
+				_, _ = backendSide.Write([]byte("PONG\x00"))
+			}
+			_ = backendSide.Close()
+		}()
+
+		if _, err := clientSide.Write([]byte("zPING\x00")); err != nil {
+			b.Fatalf("Failed to write command: %v", err)
+		}
+		if _, err := io.ReadFull(clientSide, reply); err != nil {
+			b.Fatalf("Failed to read reply: %v", err)
+		}
+		_ = clientSide.Close()
+		<-done
+	}
+}
+
+// writeCountingConn counts the writes reaching the underlying connection,
+// one per flush of the buffered writer in front of it
+type writeCountingConn struct {
+	net.Conn
+	writes atomic.Int32
+}
+
+func (c *writeCountingConn) Write(b []byte) (int, error) {
+	c.writes.Add(1)
+	return c.Conn.Write(b)
+}
+
+func TestClientFlushBytes(t *testing.T) {
+	// Each backend write is one read in the proxy with net.Pipe
+	reads := []string{"0123456789", "0123456789", "END\n"}
+
+	tests := []struct {
+		name       string
+		flushBytes int
+		expected   int32
+	}{
+		{"Flush every read", 0, 3},
+		{"Hold unfinished replies", 15, 2},
+		{"Hold until complete", 1024, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestProxy(t, func(c *Config) {
+				c.ClientBufferSize = 2048
+				c.ClientFlushBytes = tt.flushBytes
+			})
+
+			clientSide, pipeClient := net.Pipe()
+			proxyBackend, backendSide := net.Pipe()
+			proxyClient := &writeCountingConn{Conn: pipeClient}
+
+			p := srv.NewClamdProxy(proxyClient, proxyBackend)
+			if p.clientBuf.Size() != 2048 {
+				t.Errorf("Expected client buffer of 2048 bytes, got %d", p.clientBuf.Size())
+			}
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				p.Start()
+				_ = proxyClient.Close()
+				<-p.clientDone
+			}()
+
+			expected := strings.Join(reads, "")
+			received := make(chan string, 1)
+			go func() {
+				buf := make([]byte, len(expected))
+				n, _ := io.ReadFull(clientSide, buf)
+				received <- string(buf[:n])
+			}()
+
+			for _, r := range reads {
+				if _, err := backendSide.Write([]byte(r)); err != nil {
+					t.Fatalf("Backend write failed: %v", err)
+				}
+			}
+			// Counted before closing the backend, which flushes again
+			if got := <-received; got != expected {
+				t.Errorf("Expected %q, got %q", expected, got)
+			}
+			if got := proxyClient.writes.Load(); got != tt.expected {
+				t.Errorf("Expected %d client writes, got %d", tt.expected, got)
+			}
+
+			_ = clientSide.Close()
+			_ = backendSide.Close()
+			<-done
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PROXY protocol v1 limits and timing
+const (
+	proxyHeaderMaxLength = 107 // Longest valid v1 header, including CRLF
+	proxyHeaderTimeout   = 10 * time.Second
+)
+
+// proxiedConn is a client connection received through a load balancer that
+// reports the original client address from the PROXY protocol header
+type proxiedConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+// RemoteAddr returns the original client address
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// readProxyHeader consumes a PROXY protocol v1 header from the start of conn
+// and returns a connection reporting the source address it carries. The header
+// is read byte by byte so nothing past its CRLF is taken from the stream.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout)); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 0, proxyHeaderMaxLength)
+	b := make([]byte, 1)
+	for {
+		if len(header) >= proxyHeaderMaxLength {
+			return nil, errors.New("PROXY header too long")
+		}
+		if _, err := conn.Read(b); err != nil {
+			return nil, fmt.Errorf("failed to read PROXY header: %w", err)
+		}
+		header = append(header, b[0])
+		if len(header) >= 2 && header[len(header)-2] == '\r' && header[len(header)-1] == '\n' {
+			break
+		}
+	}
+
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+
+	remote, err := parseProxyHeader(string(header[:len(header)-2]))
+	if err != nil {
+		return nil, err
+	}
+	if remote == nil {
+		return conn, nil // UNKNOWN: keep the connection's own address
+	}
+	return &proxiedConn{Conn: conn, remote: remote}, nil
+}
+
+// parseProxyHeader parses a PROXY protocol v1 header line without its CRLF,
+// e.g. "PROXY TCP4 192.0.2.1 198.51.100.1 56324 3310", and returns the source
+// address. It returns nil for the UNKNOWN protocol.
+func parseProxyHeader(line string) (net.Addr, error) {
+	fields := strings.Split(line, " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errors.New("missing PROXY signature")
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol %q", fields[1])
+	}
+
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("malformed PROXY header %q", line)
+	}
+
+	srcIP := net.ParseIP(fields[2])
+	dstIP := net.ParseIP(fields[3])
+	if srcIP == nil || dstIP == nil {
+		return nil, fmt.Errorf("invalid address in PROXY header %q", line)
+	}
+	if isV4 := srcIP.To4() != nil && dstIP.To4() != nil; isV4 != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("address family mismatch in PROXY header %q", line)
+	}
+
+	srcPort, err := parseProxyPort(fields[4])
+	if err != nil {
+		return nil, err
+	}
+	if _, err := parseProxyPort(fields[5]); err != nil {
+		return nil, err
+	}
+
+	return &net.TCPAddr{IP: srcIP, Port: srcPort}, nil
+}
+
+// parseProxyPort parses a decimal TCP port from a PROXY header
+func parseProxyPort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 0 || port > 65535 || (len(s) > 1 && s[0] == '0') {
+		return 0, fmt.Errorf("invalid port %q in PROXY header", s)
+	}
+	return port, nil
+}
+
+// proxyHeader returns the PROXY protocol v1 header announcing a connection
+// from src to dst, as sent to the backend with --forward-client-ip=proxy.
+// Addresses that can't be expressed, such as Unix sockets or mixed address
+// families, give the UNKNOWN header.
+func proxyHeader(src, dst net.Addr) string {
+	srcTCP, ok1 := src.(*net.TCPAddr)
+	dstTCP, ok2 := dst.(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		return "PROXY UNKNOWN\r\n"
+	}
+
+	srcIP, dstIP := srcTCP.IP.To4(), dstTCP.IP.To4()
+	protocol := "TCP4"
+	if srcIP == nil && dstIP == nil {
+		srcIP, dstIP = srcTCP.IP.To16(), dstTCP.IP.To16()
+		protocol = "TCP6"
+	}
+	if srcIP == nil || dstIP == nil {
+		return "PROXY UNKNOWN\r\n"
+	}
+
+	return fmt.Sprintf("PROXY %s %s %s %d %d\r\n", protocol, srcIP, dstIP, srcTCP.Port, dstTCP.Port)
+}
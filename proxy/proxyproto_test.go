@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseProxyHeader(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected string
+		valid    bool
+	}{
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 3310", "192.0.2.1:56324", true},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 3310", "[2001:db8::1]:56324", true},
+		{"PROXY UNKNOWN", "", true},
+		{"PROXY UNKNOWN 192.0.2.1 198.51.100.1 56324 3310", "", true},
+		{"PROXY TCP4 2001:db8::1 198.51.100.1 56324 3310", "", false},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 056324 3310", "", false},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 70000 3310", "", false},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324", "", false},
+		{"PROXY UDP4 192.0.2.1 198.51.100.1 56324 3310", "", false},
+		{"zPING", "", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.line, func(t *testing.T) {
+			addr, err := parseProxyHeader(tc.line)
+			if (err == nil) != tc.valid {
+				t.Fatalf("Expected valid=%v, got error %v", tc.valid, err)
+			}
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tc.expected {
+				t.Errorf("Expected address %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		client.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 3310\r\nzPING\x00"))
+	}()
+
+	conn, err := readProxyHeader(server)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if got := conn.RemoteAddr().String(); got != "192.0.2.1:56324" {
+		t.Errorf("Expected remote address 192.0.2.1:56324, got %s", got)
+	}
+
+	// The command following the header must be left in the stream
+	buf := make([]byte, 6)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("Failed to read command: %v", err)
+	}
+	if string(buf) != "zPING\x00" {
+		t.Errorf("Expected zPING after header, got %q", buf)
+	}
+}
+
+func TestReadProxyHeaderTooLong(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		header := make([]byte, proxyHeaderMaxLength+1)
+		for i := range header {
+			header[i] = 'A'
+		}
+		client.Write(header)
+	}()
+
+	if _, err := readProxyHeader(server); err == nil {
+		t.Errorf("Expected an error for an unterminated header")
+	}
+}
+
+func TestProxyHeader(t *testing.T) {
+	tcp := func(s string) net.Addr {
+		addr, err := net.ResolveTCPAddr("tcp", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return addr
+	}
+
+	tests := []struct {
+		name     string
+		src, dst net.Addr
+		expected string
+	}{
+		{"IPv4", tcp("192.0.2.1:56324"), tcp("198.51.100.1:3310"), "PROXY TCP4 192.0.2.1 198.51.100.1 56324 3310\r\n"},
+		{"IPv6", tcp("[2001:db8::1]:56324"), tcp("[2001:db8::2]:3310"), "PROXY TCP6 2001:db8::1 2001:db8::2 56324 3310\r\n"},
+		{"Mixed families", tcp("192.0.2.1:56324"), tcp("[2001:db8::2]:3310"), "PROXY UNKNOWN\r\n"},
+		{"Unix socket", &net.UnixAddr{Name: "@", Net: "unix"}, &net.UnixAddr{Name: "/run/clamdproxy.sock", Net: "unix"}, "PROXY UNKNOWN\r\n"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			header := proxyHeader(tc.src, tc.dst)
+			if header != tc.expected {
+				t.Fatalf("Expected %q, got %q", tc.expected, header)
+			}
+
+			// What we send must be accepted by our own --proxy-protocol
+			remote, err := parseProxyHeader(strings.TrimSuffix(header, "\r\n"))
+			if err != nil {
+				t.Fatalf("Header %q not accepted: %v", header, err)
+			}
+			if remote != nil && remote.String() != tc.src.String() {
+				t.Errorf("Expected source %s, got %s", tc.src, remote)
+			}
+		})
+	}
+}
+
+func TestForwardClientIPHeader(t *testing.T) {
+	clientSide, proxyClient := net.Pipe()
+	proxyBackend, backendSide := net.Pipe()
+
+	preamble := "PROXY TCP4 192.0.2.1 198.51.100.1 56324 3310\r\n"
+	p := newTestProxy(t).NewClamdProxy(proxyClient, proxyBackend)
+	p.backendPreamble = []byte(preamble)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Start()
+		_ = proxyClient.Close()
+		<-p.clientDone
+	}()
+
+	forwarded := make(chan []byte, 1)
+	go func() {
+		data, _ := io.ReadAll(backendSide)
+		forwarded <- data
+	}()
+
+	// Blocked commands don't reach the backend, so the header goes ahead of
+	// the first forwarded one, and only once
+	go func() { _, _ = io.Copy(io.Discard, clientSide) }()
+	for _, cmd := range []string{"zSHUTDOWN\x00", "zPING\x00", "zVERSION\x00"} {
+		if _, err := clientSide.Write([]byte(cmd)); err != nil {
+			t.Fatalf("Client write failed: %v", err)
+		}
+	}
+	_ = clientSide.Close()
+	<-done
+	_ = backendSide.Close()
+
+	expected := preamble + "zPING\x00zVERSION\x00"
+	if got := string(<-forwarded); got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+}
+
+func TestProxyHeaderFromUntrustedPeer(t *testing.T) {
+	backend := startFakeBackend(t, "PONG\x00")
+
+	// The header claims an allowed address, the peer itself is not allowed
+	forged := "PROXY TCP4 10.1.2.3 198.51.100.1 56324 3310\r\nzPING\x00"
+	tests := []struct {
+		name    string
+		trusted string
+		reply   string
+	}{
+		{"Untrusted peer", "192.0.2.0/24", ""},
+		{"Trusted peer", "127.0.0.0/8", "PONG\x00"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := newTestProxy(t, func(c *Config) {
+				c.ProxyProtocol = true
+				c.Backend = []string{backend}
+				c.AllowCIDR = []string{"10.0.0.0/8"}
+				c.TrustedProxyCIDR = []string{tc.trusted}
+			})
+
+			clientSide, proxyClient := tcpPair(t)
+			done := make(chan struct{})
+			srv.activeConns.Add(1)
+			go func() {
+				defer close(done)
+				srv.handleConnection(context.Background(), proxyClient, "test")
+			}()
+
+			if _, err := clientSide.Write([]byte(forged)); err != nil {
+				t.Fatalf("Client write failed: %v", err)
+			}
+			// A rejected connection is closed without a reply
+			_ = clientSide.SetReadDeadline(time.Now().Add(2 * time.Second))
+			reply := make([]byte, len("PONG\x00"))
+			n, err := io.ReadFull(clientSide, reply)
+			if tc.reply == "" && err == nil {
+				t.Error("Expected the connection to be closed")
+			}
+			if string(reply[:n]) != tc.reply {
+				t.Errorf("Expected reply %q, got %q", tc.reply, reply)
+			}
+			_ = clientSide.Close()
+			<-done
+		})
+	}
+}
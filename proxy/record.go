@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miklosn/clamdproxy/internal/transcript"
+)
+
+// recordExt is the file name extension of the transcripts in --record-dir
+const recordExt = ".tx"
+
+// recordTimeFormat starts the transcript file names, so they sort by age
+const recordTimeFormat = "20060102T150405.000000000Z"
+
+// recording tees the data one client sends and the data sent back to it
+// into a transcript in --record-dir, in the format test_client
+// --replay plays back. It never interferes with the connection: once writing
+// fails or --record-max-bytes is reached the rest goes unrecorded.
+type recording struct {
+	mu       sync.Mutex
+	path     string
+	file     *os.File
+	buf      *bufio.Writer
+	tx       *transcript.Writer
+	size     int64 // Data bytes recorded so far
+	maxBytes int   // From --record-max-bytes, 0 records everything
+	stopped  bool
+	connID   string
+	logger   *slog.Logger
+}
+
+// startRecording creates the transcript of connection connID and deletes
+// the oldest ones beyond --record-max-files. It returns nil, logging why, if
+// the transcript can't be created.
+func (p *Proxy) startRecording(connID string) *recording {
+	name := time.Now().UTC().Format(recordTimeFormat) + "-" + connID + recordExt
+	path := filepath.Join(p.cfg.RecordDir, name)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		p.logger.Warn("Failed to start recording", "conn_id", connID, "error", err)
+		return nil
+	}
+
+	buf := bufio.NewWriter(file)
+	tx, err := transcript.NewWriter(buf)
+	if err != nil {
+		// Can't happen before the buffer is flushed, but don't leak the file
+		_ = file.Close()
+		_ = os.Remove(path)
+		p.logger.Warn("Failed to start recording", "conn_id", connID, "error", err)
+		return nil
+	}
+	p.pruneRecordings()
+	p.logger.Debug("Recording connection", "conn_id", connID, "file", path)
+	return &recording{path: path, file: file, buf: buf, tx: tx, maxBytes: p.cfg.RecordMaxBytes,
+		connID: connID, logger: p.logger}
+}
+
+// pruneRecordings deletes the oldest transcripts in --record-dir until at
+// most --record-max-files are left
+func (p *Proxy) pruneRecordings() {
+	if p.cfg.RecordMaxFiles <= 0 {
+		return
+	}
+	p.pruneMu.Lock()
+	defer p.pruneMu.Unlock()
+
+	entries, err := os.ReadDir(p.cfg.RecordDir)
+	if err != nil {
+		p.logger.Warn("Failed to list recordings", "dir", p.cfg.RecordDir, "error", err)
+		return
+	}
+	var names []string // Sorted by name, and so by age
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && strings.HasSuffix(entry.Name(), recordExt) {
+			names = append(names, entry.Name())
+		}
+	}
+	for len(names) > p.cfg.RecordMaxFiles {
+		path := filepath.Join(p.cfg.RecordDir, names[0])
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			p.logger.Warn("Failed to delete old recording", "file", path, "error", err)
+			return
+		}
+		names = names[1:]
+	}
+}
+
+// writer returns a writer recording everything written to it as sent in
+// direction dir. It never fails, so it can be teed next to a connection.
+func (r *recording) writer(dir transcript.Direction) io.Writer {
+	return recordWriter{r, dir}
+}
+
+// recordWriter is the writer returned by recording.writer
+type recordWriter struct {
+	r   *recording
+	dir transcript.Direction
+}
+
+func (w recordWriter) Write(data []byte) (int, error) {
+	w.r.record(w.dir, data)
+	return len(data), nil
+}
+
+// record appends data sent in direction dir, unless recording has stopped
+func (r *recording) record(dir transcript.Direction, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopped {
+		return
+	}
+
+	if r.maxBytes > 0 && r.size+int64(len(data)) > int64(r.maxBytes) {
+		r.stopped = true
+		r.logger.Info("Recording size limit reached, not recording the rest of the connection",
+			"conn_id", r.connID, "file", r.path, "limit", r.maxBytes)
+		return
+	}
+	if err := r.tx.Write(dir, data); err != nil {
+		r.stopped = true
+		r.logger.Warn("Failed to record, not recording the rest of the connection",
+			"conn_id", r.connID, "file", r.path, "error", err)
+		return
+	}
+	r.size += int64(len(data))
+}
+
+// close ends the recording and closes the transcript. Data written by the
+// connection afterwards is dropped.
+func (r *recording) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stopped = true
+
+	err := r.buf.Flush()
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		r.logger.Warn("Failed to write recording", "conn_id", r.connID, "file", r.path, "error", err)
+		return
+	}
+	r.logger.Debug("Recording complete", "conn_id", r.connID, "file", r.path, "bytes", r.size)
+}
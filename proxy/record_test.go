@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miklosn/clamdproxy/internal/transcript"
+)
+
+// newRecordingProxy returns a test Proxy forwarding to backends with
+// --record-dir set to a new temporary directory, and that directory
+func newRecordingProxy(t *testing.T, maxBytes, maxFiles int, backends ...string) (*Proxy, string) {
+	t.Helper()
+	dir := t.TempDir()
+	srv := newTestProxy(t, func(c *Config) {
+		c.Backend = backends
+		c.RecordDir, c.RecordMaxBytes, c.RecordMaxFiles = dir, maxBytes, maxFiles
+	})
+	return srv, dir
+}
+
+// readRecordings returns the data of every transcript in dir by direction,
+// oldest transcript first
+func readRecordings(t *testing.T, dir string) []map[transcript.Direction]string {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+recordExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var recordings []map[transcript.Direction]string
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader, err := transcript.NewReader(f)
+		if err != nil {
+			t.Fatalf("Invalid transcript %s: %v", path, err)
+		}
+		data := map[transcript.Direction]string{}
+		for {
+			rec, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Invalid transcript %s: %v", path, err)
+			}
+			data[rec.Direction] += string(rec.Data)
+		}
+		_ = f.Close()
+		recordings = append(recordings, data)
+	}
+	return recordings
+}
+
+func TestRecordDir(t *testing.T) {
+	srv, dir := newRecordingProxy(t, 0, 0, startFakeBackend(t, "PONG\x00"))
+
+	clientSide, proxyClient := tcpPair(t)
+	done := make(chan struct{})
+	srv.activeConns.Add(1)
+	go func() {
+		defer close(done)
+		srv.handleConnection(context.Background(), proxyClient, "test")
+	}()
+
+	if _, err := clientSide.Write([]byte("zPING\x00")); err != nil {
+		t.Fatalf("Client write failed: %v", err)
+	}
+	reply := make([]byte, len("PONG\x00"))
+	if _, err := io.ReadFull(clientSide, reply); err != nil {
+		t.Fatalf("Failed to read reply: %v", err)
+	}
+	_ = clientSide.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Connection was not closed")
+	}
+
+	// The transcript holds exactly what was sent either way
+	recordings := readRecordings(t, dir)
+	if len(recordings) != 1 {
+		t.Fatalf("Expected 1 recording, got %d", len(recordings))
+	}
+	if got := recordings[0][transcript.ClientToServer]; got != "zPING\x00" {
+		t.Errorf("Expected the command recorded, got %q", got)
+	}
+	if got := recordings[0][transcript.ServerToClient]; got != string(reply) {
+		t.Errorf("Expected the reply %q recorded, got %q", reply, got)
+	}
+}
+
+func TestRecordingLimits(t *testing.T) {
+	t.Run("Size", func(t *testing.T) {
+		srv, dir := newRecordingProxy(t, 8, 0)
+		rec := srv.startRecording("a")
+		if rec == nil {
+			t.Fatal("Expected a recording")
+		}
+		w := rec.writer(transcript.ClientToServer)
+		for _, data := range []string{"zPING\x00", "zVERSION\x00", "zPING\x00"} {
+			if n, err := w.Write([]byte(data)); n != len(data) || err != nil {
+				t.Errorf("Expected the write to succeed, got %d, %v", n, err)
+			}
+		}
+		rec.close()
+
+		// Nothing is recorded once the limit is reached
+		recordings := readRecordings(t, dir)
+		if len(recordings) != 1 || recordings[0][transcript.ClientToServer] != "zPING\x00" {
+			t.Errorf("Expected only the first command recorded, got %q", recordings)
+		}
+	})
+
+	t.Run("Files", func(t *testing.T) {
+		srv, dir := newRecordingProxy(t, 0, 2)
+		for _, connID := range []string{"a", "b", "c"} {
+			rec := srv.startRecording(connID)
+			if rec == nil {
+				t.Fatal("Expected a recording")
+			}
+			_, _ = rec.writer(transcript.ServerToClient).Write([]byte(connID))
+			rec.close()
+		}
+
+		recordings := readRecordings(t, dir)
+		if len(recordings) != 2 ||
+			recordings[0][transcript.ServerToClient] != "b" || recordings[1][transcript.ServerToClient] != "c" {
+			t.Errorf("Expected the newest 2 recordings kept, got %q", recordings)
+		}
+	})
+}
+
+func TestRecordBlockedCommandReplay(t *testing.T) {
+	backend := startFakeClamd(t)
+	srv, dir := newRecordingProxy(t, 0, 0, backend.addr)
+
+	// session sends data on a new connection and returns the reply once the
+	// connection has been closed
+	session := func(data string) string {
+		clientSide, proxyClient := tcpPair(t)
+		done := make(chan struct{})
+		srv.activeConns.Add(1)
+		go func() {
+			defer close(done)
+			srv.handleConnection(context.Background(), proxyClient, "test")
+		}()
+
+		_ = clientSide.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := clientSide.Write([]byte(data)); err != nil {
+			t.Fatalf("Client write failed: %v", err)
+		}
+		reply, err := bufio.NewReader(clientSide).ReadString(0)
+		if err != nil {
+			t.Fatalf("Failed to read reply, got %q: %v", reply, err)
+		}
+		_ = clientSide.Close()
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("Connection was not closed")
+		}
+		return reply
+	}
+
+	reply := session("zSHUTDOWN\x00")
+	recordings := readRecordings(t, dir)
+	if len(recordings) != 1 {
+		t.Fatalf("Expected 1 recording, got %d", len(recordings))
+	}
+	sent := recordings[0][transcript.ClientToServer]
+	if sent != "zSHUTDOWN\x00" {
+		t.Fatalf("Expected the blocked command recorded, got %q", sent)
+	}
+	if got := recordings[0][transcript.ServerToClient]; got != reply {
+		t.Errorf("Expected the reply %q recorded, got %q", reply, got)
+	}
+
+	// Replaying what the client sent gets the same reply
+	if got := session(sent); got != reply {
+		t.Errorf("Expected the replay to get %q, got %q", reply, got)
+	}
+	if len(backend.commands()) != 0 {
+		t.Errorf("Expected nothing forwarded, got %q", backend.commands())
+	}
+}
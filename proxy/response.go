@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"time"
+)
+
+// errResponseTimeout is returned by readBackend when clamd stays silent for
+// --response-timeout, or --scan-response-timeout, while a reply is due
+var errResponseTimeout = errors.New("backend response timeout")
+
+// errResponseTooLarge is returned by the Start loop when clamd sends more than
+// --max-response-bytes in reply to a command other than INSTREAM
+var errResponseTooLarge = errors.New("backend response too large")
+
+// replyWatch tracks the replies clamd still owes a connection, to enforce the
+// response timeouts and --max-response-bytes. Replies are counted by their
+// terminators, so a reply spanning several lines (e.g. of CONTSCAN) ends the
+// wait early rather than late; the timeouts never fire while clamd is merely
+// done answering.
+type replyWatch struct {
+	mu        sync.Mutex
+	awaiting  int           // Forwarded commands not answered yet
+	timeout   time.Duration // Response timeout of the latest command
+	uploading bool          // The latest command is an INSTREAM still being uploaded
+	deadline  time.Time     // Zero while no reply is due or the timeout is disabled
+	bytes     int           // Received since the latest command was forwarded
+	capped    bool          // The latest command's reply is limited by --max-response-bytes
+}
+
+// watchResponses reports whether any of the response limits is configured
+func (p *Proxy) watchResponses() bool {
+	return p.cfg.ResponseTimeout > 0 || p.cfg.ScanResponseTimeout > 0 || p.cfg.MaxResponseBytes > 0
+}
+
+// responseTimeout returns the time clamd may take to answer cmd. Scans take
+// as long as the file or directory does, so they get --scan-response-timeout.
+func (p *Proxy) responseTimeout(cmd string) time.Duration {
+	if isInstreamCommand(cmd) || pathCommands[commandName(cmd)] {
+		return p.cfg.ScanResponseTimeout
+	}
+	return p.cfg.ResponseTimeout
+}
+
+// expectReply is called by the client goroutine before cmd is forwarded, so
+// clamd can't answer before the wait for its reply has started. The response
+// timeout of an INSTREAM only starts once streamUploaded is called.
+func (p *ClamdProxy) expectReply(cmd string) {
+	if !p.server.watchResponses() {
+		return
+	}
+	switch commandName(cmd) {
+	case "IDSESSION", "SESSION", "END":
+		return // Answered by the commands that follow, not by clamd itself
+	}
+
+	w := &p.replies
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.awaiting++
+	w.timeout = p.server.responseTimeout(cmd)
+	w.uploading = isInstreamCommand(cmd)
+	w.bytes, w.capped = 0, !w.uploading
+	w.deadline = time.Time{}
+	if !w.uploading {
+		p.armReplyDeadline()
+	}
+}
+
+// streamUploaded is called by the client goroutine once an INSTREAM upload is
+// complete and starts the wait for its verdict, unless it already arrived
+func (p *ClamdProxy) streamUploaded() {
+	if !p.server.watchResponses() {
+		return
+	}
+	w := &p.replies
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.uploading = false
+	if w.awaiting > 0 {
+		p.armReplyDeadline()
+	}
+}
+
+// armReplyDeadline gives clamd one response timeout from now to reply and
+// wakes the Start loop so the deadline takes effect right away; replies.mu
+// must be held
+func (p *ClamdProxy) armReplyDeadline() {
+	if p.replies.timeout <= 0 {
+		return
+	}
+	p.replies.deadline = time.Now().Add(p.replies.timeout)
+
+	// retryBackend may be replacing the backend connection
+	if p.retryArmed.Load() {
+		p.retryMu.Lock()
+		defer p.retryMu.Unlock()
+	}
+	if err := p.backend.SetReadDeadline(p.backendDeadline()); err != nil {
+		p.server.logger.Debug("Failed to set backend response deadline", "conn_id", p.connID, "error", err)
+	}
+}
+
+// replyReceived is called by the Start loop for data read from the backend.
+// Every terminator ends a reply, and while more are due clamd gets another
+// response timeout from now. It returns errResponseTooLarge once the reply to
+// the latest command exceeds --max-response-bytes.
+func (p *ClamdProxy) replyReceived(data []byte) error {
+	if !p.server.watchResponses() {
+		return nil
+	}
+	w := &p.replies
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.awaiting = max(w.awaiting-bytes.Count(data, []byte{nullDelimiter})-bytes.Count(data, []byte{newlineDelimiter}), 0)
+	w.deadline = time.Time{}
+	if w.awaiting > 0 && w.timeout > 0 && !w.uploading {
+		w.deadline = time.Now().Add(w.timeout)
+	}
+
+	w.bytes += len(data)
+	if w.capped && p.server.cfg.MaxResponseBytes > 0 && w.bytes > p.server.cfg.MaxResponseBytes {
+		return errResponseTooLarge
+	}
+	return nil
+}
+
+// armBackendDeadline sets the backend read deadline to the earlier of the
+// idle deadline and that of a reply that is due, if any
+func (p *ClamdProxy) armBackendDeadline() error {
+	p.replies.mu.Lock()
+	defer p.replies.mu.Unlock()
+	return p.backend.SetReadDeadline(p.backendDeadline())
+}
+
+// backendDeadline implements armBackendDeadline; replies.mu must be held
+func (p *ClamdProxy) backendDeadline() time.Time {
+	deadline := p.replies.deadline
+	if p.server.cfg.IdleTimeout > 0 {
+		if idle := p.idleDeadline(); deadline.IsZero() || idle.Before(deadline) {
+			deadline = idle
+		}
+	}
+	return deadline
+}
+
+// replyOverdue reports whether clamd missed the deadline of a reply
+func (p *ClamdProxy) replyOverdue() bool {
+	p.replies.mu.Lock()
+	defer p.replies.mu.Unlock()
+	return !p.replies.deadline.IsZero() && !time.Now().Before(p.replies.deadline)
+}
+
+// replyTimeout returns the response timeout of the latest command, for logging
+func (p *ClamdProxy) replyTimeout() time.Duration {
+	p.replies.mu.Lock()
+	defer p.replies.mu.Unlock()
+	return p.replies.timeout
+}
@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withResponseLimits returns a test Proxy with the given response limits
+func withResponseLimits(t *testing.T, timeout, scanTimeout time.Duration, maxBytes int) *Proxy {
+	t.Helper()
+	return newTestProxy(t, func(c *Config) {
+		c.ResponseTimeout, c.ScanResponseTimeout, c.MaxResponseBytes = timeout, scanTimeout, maxBytes
+	})
+}
+
+// skipCommand reads the command the proxy forwarded to the backend and
+// returns a reader for the rest, e.g. the INSTREAM chunks
+func skipCommand(backendSide io.Reader) *bufio.Reader {
+	reader := bufio.NewReader(backendSide)
+	_, _ = reader.ReadString(nullDelimiter)
+	return reader
+}
+
+// waitClosed fails the test unless the proxy is done within a second
+func waitClosed(t *testing.T, done <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Connection was not closed after %s", what)
+	}
+}
+
+func TestResponseTimeout(t *testing.T) {
+	t.Run("Silent backend", func(t *testing.T) {
+		clientSide, backendSide, done := startProxyWithPipes(t, withResponseLimits(t, 50*time.Millisecond, 0, 0))
+
+		go func() { _, _ = io.Copy(io.Discard, backendSide) }()
+		if _, err := clientSide.Write([]byte("zVERSION\x00")); err != nil {
+			t.Fatalf("Client write failed: %v", err)
+		}
+		go func() { _, _ = io.Copy(io.Discard, clientSide) }()
+		waitClosed(t, done, "the response timeout")
+	})
+
+	t.Run("Idle session", func(t *testing.T) {
+		clientSide, backendSide, done := startProxyWithPipes(t, withResponseLimits(t, 50*time.Millisecond, 0, 0))
+
+		// Answers every PING, whenever it arrives
+		go func() {
+			reader := bufio.NewReader(backendSide)
+			n := 0
+			for {
+				cmd, err := reader.ReadString(nullDelimiter)
+				if err != nil {
+					return
+				}
+				if cmd == "zPING\x00" {
+					n++
+					_, _ = fmt.Fprintf(backendSide, "%d: PONG\x00", n)
+				}
+			}
+		}()
+
+		reader := bufio.NewReader(clientSide)
+		ping := func(expected string) {
+			t.Helper()
+			if _, err := clientSide.Write([]byte("zPING\x00")); err != nil {
+				t.Fatalf("Client write failed: %v", err)
+			}
+			reply, err := reader.ReadString(nullDelimiter)
+			if err != nil || reply != expected {
+				t.Fatalf("Expected %q, got %q (%v)", expected, reply, err)
+			}
+		}
+
+		if _, err := clientSide.Write([]byte("zIDSESSION\x00")); err != nil {
+			t.Fatalf("Client write failed: %v", err)
+		}
+		ping("1: PONG\x00")
+		// Nothing is due, so waiting between commands is fine
+		time.Sleep(150 * time.Millisecond)
+		ping("2: PONG\x00")
+
+		select {
+		case <-done:
+			t.Fatal("Idle session was closed")
+		default:
+		}
+	})
+
+	t.Run("Scan", func(t *testing.T) {
+		clientSide, backendSide, _ := startProxyWithPipes(t, withResponseLimits(t, 50*time.Millisecond, 0, 0))
+
+		// The verdict takes longer than --response-timeout, which only
+		// applies to other commands
+		go func() {
+			if _, err := readStream(skipCommand(backendSide)); err == nil {
+				time.Sleep(150 * time.Millisecond)
+				_, _ = io.WriteString(backendSide, "stream: OK\x00")
+			}
+		}()
+
+		if _, err := clientSide.Write(streamRequest([]byte("data"), 2)); err != nil {
+			t.Fatalf("Client write failed: %v", err)
+		}
+		reply, err := bufio.NewReader(clientSide).ReadString(nullDelimiter)
+		if err != nil || reply != "stream: OK\x00" {
+			t.Errorf("Expected the verdict, got %q (%v)", reply, err)
+		}
+	})
+
+	t.Run("Scan timeout", func(t *testing.T) {
+		clientSide, backendSide, done := startProxyWithPipes(t, withResponseLimits(t, 0, 50*time.Millisecond, 0))
+
+		go func() { _, _ = io.Copy(io.Discard, backendSide) }()
+		if _, err := clientSide.Write(streamRequest([]byte("data"), 2)); err != nil {
+			t.Fatalf("Client write failed: %v", err)
+		}
+
+		// The client is told rather than left waiting for a verdict
+		expected := backendUnavailableResponse + "\x00"
+		reply, err := bufio.NewReader(clientSide).ReadString(nullDelimiter)
+		if err != nil || reply != expected {
+			t.Errorf("Expected %q, got %q (%v)", expected, reply, err)
+		}
+		waitClosed(t, done, "the scan response timeout")
+	})
+}
+
+func TestMaxResponseBytes(t *testing.T) {
+	t.Run("Oversized reply", func(t *testing.T) {
+		clientSide, backendSide, done := startProxyWithPipes(t, withResponseLimits(t, 0, 0, 16))
+
+		go func() {
+			if _, err := bufio.NewReader(backendSide).ReadString(nullDelimiter); err == nil {
+				_, _ = io.WriteString(backendSide, strings.Repeat("x", 100)+"\x00")
+			}
+		}()
+		if _, err := clientSide.Write([]byte("zVERSION\x00")); err != nil {
+			t.Fatalf("Client write failed: %v", err)
+		}
+
+		data, _ := io.ReadAll(clientSide)
+		if len(data) != 0 {
+			t.Errorf("Expected nothing of the oversized reply, got %q", data)
+		}
+		waitClosed(t, done, "an oversized reply")
+	})
+
+	t.Run("INSTREAM exempt", func(t *testing.T) {
+		clientSide, backendSide, _ := startProxyWithPipes(t, withResponseLimits(t, 0, 0, 16))
+
+		verdict := "stream: Some.Very.Long.Signature.Name FOUND\x00"
+		go func() {
+			if _, err := readStream(skipCommand(backendSide)); err == nil {
+				_, _ = io.WriteString(backendSide, verdict)
+			}
+		}()
+		if _, err := clientSide.Write(streamRequest([]byte("data"), 4)); err != nil {
+			t.Fatalf("Client write failed: %v", err)
+		}
+		reply, err := bufio.NewReader(clientSide).ReadString(nullDelimiter)
+		if err != nil || reply != verdict {
+			t.Errorf("Expected %q, got %q (%v)", verdict, reply, err)
+		}
+	})
+}
@@ -0,0 +1,96 @@
+package proxy
+
+// With --retry-first-command, a backend that is reset or closed right after
+// accepting the connection (e.g. while clamd reloads) is replaced by a new
+// one instead of failing the client. The window lasts until the backend
+// sends anything, a second command has to be forwarded or an INSTREAM stream
+// starts; only the first command is kept for replay. retryMu serializes the
+// client goroutine's forwarding with the Start loop replacing the backend,
+// and retryArmed lets both skip the lock once the window has closed.
+
+// forwardRetryable forwards a command while a backend retry is still
+// possible. A write that fails because the backend went away is not an error:
+// the Start loop sees the same failure and replays the command.
+func (p *ClamdProxy) forwardRetryable(frame []byte) error {
+	p.retryMu.Lock()
+	defer p.retryMu.Unlock()
+
+	if p.retryArmed.Load() {
+		if p.retryCmd != nil {
+			p.retryArmed.Store(false)
+			p.retryCmd = nil
+		} else {
+			p.retryCmd = append([]byte(nil), frame...)
+		}
+	}
+
+	_, err := p.backendBuf.Write(frame)
+	if err == nil {
+		err = p.backendBuf.Flush()
+	}
+	if err != nil && p.retryArmed.Load() && isConnectionClosed(err) {
+		p.server.logger.Debug("Backend failed on first command, awaiting retry", "conn_id", p.connID, "error", err)
+		return nil
+	}
+	return err
+}
+
+// disarmRetry closes the retry window
+func (p *ClamdProxy) disarmRetry() {
+	if !p.retryArmed.Load() {
+		return
+	}
+	p.retryMu.Lock()
+	defer p.retryMu.Unlock()
+	p.retryArmed.Store(false)
+	p.retryCmd = nil
+}
+
+// retryBackend is called by the Start loop when the backend failed before
+// sending anything. Within the retry window it dials a new backend once and
+// replays the first command, if one was forwarded, and reports whether the
+// connection can go on.
+func (p *ClamdProxy) retryBackend(cause error) bool {
+	if !p.retryArmed.Load() {
+		return false
+	}
+	p.retryMu.Lock()
+	defer p.retryMu.Unlock()
+	if !p.retryArmed.Load() {
+		return false
+	}
+	// Only disarm once the backend has been replaced: the client goroutine
+	// skips the lock as soon as it sees the window closed
+	defer p.retryArmed.Store(false)
+	replay := p.retryCmd
+	p.retryCmd = nil
+
+	clientAddr := p.client.RemoteAddr().String()
+	p.server.logger.Info("Backend closed before replying, reconnecting",
+		"conn_id", p.connID,
+		"client", clientAddr,
+		"replay", replay != nil,
+		"error", cause)
+
+	if err := p.backend.Close(); err != nil {
+		p.server.logger.Debug("Error closing failed backend connection", "conn_id", p.connID, "error", err)
+	}
+	conn, err := p.redial()
+	if err != nil {
+		return false // Already logged by the dialer
+	}
+	p.backend = conn
+	p.backendBuf.Reset(conn)
+
+	if replay != nil {
+		_, err = p.backendBuf.Write(replay)
+		if err == nil {
+			err = p.backendBuf.Flush()
+		}
+		if err != nil {
+			p.server.logger.Debug("Error replaying first command", "conn_id", p.connID, "client", clientAddr, "error", err)
+			return false
+		}
+	}
+	return true
+}
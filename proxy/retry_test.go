@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// resettingBackend accepts connections on a local port. The first one is
+// reset, right away or once the first command has arrived; later ones answer
+// zVERSION like clamd.
+func resettingBackend(t *testing.T, afterCommand bool) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for first := true; ; first = false {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn *net.TCPConn, reset bool) {
+				defer conn.Close()
+				cmd := make([]byte, len("zVERSION\x00"))
+				if reset {
+					if afterCommand {
+						_, _ = io.ReadFull(conn, cmd)
+					} else {
+						time.Sleep(20 * time.Millisecond) // Let the dial complete
+					}
+					_ = conn.SetLinger(0) // Close with RST
+					return
+				}
+				if _, err := io.ReadFull(conn, cmd); err == nil {
+					_, _ = conn.Write([]byte("ClamAV 1.0.0\x00"))
+				}
+				_, _ = io.Copy(io.Discard, conn)
+			}(conn.(*net.TCPConn), first)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestRetryFirstCommand(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		afterCommand bool
+		retry        bool
+		expected     string
+	}{
+		{"Reset before the first command", false, true, "ClamAV 1.0.0\x00"},
+		{"Reset after the first command", true, true, "ClamAV 1.0.0\x00"},
+		{"Retry disabled", true, false, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			addr := resettingBackend(t, tc.afterCommand)
+			backend, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("Failed to dial backend: %v", err)
+			}
+
+			clientSide, proxyClient := net.Pipe()
+			defer clientSide.Close()
+
+			p := newTestProxy(t).NewClamdProxy(proxyClient, backend)
+			if tc.retry {
+				p.redial = func() (net.Conn, error) { return net.Dial("tcp", addr) }
+			}
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				p.Start()
+				_ = proxyClient.Close()
+				<-p.clientDone
+				_ = p.backend.Close()
+			}()
+
+			if !tc.afterCommand {
+				time.Sleep(100 * time.Millisecond) // Let the reset arrive first
+			}
+			if _, err := clientSide.Write([]byte("zVERSION\x00")); err != nil && tc.retry {
+				t.Fatalf("Failed to send command: %v", err)
+			}
+
+			// Without retry the client is disconnected without a reply
+			_ = clientSide.SetReadDeadline(time.Now().Add(2 * time.Second))
+			reply := make([]byte, len(tc.expected))
+			if !tc.retry {
+				reply, err = io.ReadAll(clientSide)
+				if err != nil {
+					t.Errorf("Expected the connection to be closed, got %v", err)
+				}
+			} else if _, err := io.ReadFull(clientSide, reply); err != nil {
+				t.Errorf("Failed to read reply: %v", err)
+			}
+			if string(reply) != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, reply)
+			}
+			_ = clientSide.Close()
+			<-done
+		})
+	}
+}
+
+func TestRetryFirstCommandNotForStreams(t *testing.T) {
+	addr := resettingBackend(t, true)
+	backend, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial backend: %v", err)
+	}
+
+	clientSide, proxyClient := net.Pipe()
+	defer clientSide.Close()
+
+	redials := 0
+	p := newTestProxy(t).NewClamdProxy(proxyClient, backend)
+	p.redial = func() (net.Conn, error) {
+		redials++
+		return net.Dial("tcp", addr)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Start()
+		_ = proxyClient.Close()
+		<-p.clientDone
+	}()
+
+	// Same length as zVERSION, so the backend resets right after it
+	go func() {
+		_, _ = clientSide.Write([]byte("zINSTREAM\x00"))
+		_, _ = clientSide.Write(instreamPayload(4, 4))
+	}()
+
+	expected := backendUnavailableResponse + "\x00"
+	_ = clientSide.SetReadDeadline(time.Now().Add(2 * time.Second))
+	reply := make([]byte, len(expected))
+	if _, err := io.ReadFull(clientSide, reply); err != nil {
+		t.Fatalf("Failed to read reply: %v", err)
+	}
+	if string(reply) != expected {
+		t.Errorf("Expected %q, got %q", expected, reply)
+	}
+	_ = clientSide.Close()
+	<-done
+
+	if redials != 0 {
+		t.Errorf("Expected no redial for a stream, got %d", redials)
+	}
+}
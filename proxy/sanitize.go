@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"bytes"
+)
+
+// sanitizedError replaces the text of clamd ERROR replies with
+// --sanitize-responses
+const sanitizedError = "ERROR"
+
+// responseSanitizer strips the details from ERROR replies read from clamd,
+// which can reveal paths on the clamd host or its version. Other replies,
+// such as OK, FOUND or PONG, are passed through unchanged.
+type responseSanitizer struct {
+	partial []byte // Start of a reply whose terminator hasn't arrived yet
+	passing bool   // Current reply exceeded maxResponseRecord and is passed through
+}
+
+// rewrite returns data with every ERROR reply replaced by a bare one. Replies
+// may be split across reads, so an unterminated one is held back until the
+// rest arrives. Replies longer than maxResponseRecord, such as STATS output,
+// can't be errors and are passed through as they arrive.
+func (s *responseSanitizer) rewrite(data []byte) []byte {
+	// Most reads are complete replies without an error
+	if len(s.partial) == 0 && !s.passing && len(data) > 0 &&
+		isResponseTerminator(data[len(data)-1]) && !bytes.Contains(data, []byte(sanitizedError)) {
+		return data
+	}
+
+	var out []byte
+	for len(data) > 0 {
+		i := bytes.IndexAny(data, "\n\x00")
+		if i < 0 {
+			if s.passing || len(s.partial)+len(data) > maxResponseRecord {
+				out = append(out, s.partial...)
+				out = append(out, data...)
+				s.partial = s.partial[:0]
+				s.passing = true
+			} else {
+				s.partial = append(s.partial, data...)
+			}
+			break
+		}
+
+		record := data[:i+1]
+		if s.passing {
+			out = append(out, record...)
+		} else {
+			if len(s.partial) > 0 {
+				record = append(s.partial, record...)
+			}
+			out = append(out, sanitizeRecord(record)...)
+		}
+		s.partial = s.partial[:0]
+		s.passing = false
+		data = data[i+1:]
+	}
+	return out
+}
+
+// flush returns the reply still held back once clamd has closed the
+// connection without terminating it
+func (s *responseSanitizer) flush() []byte {
+	if len(s.partial) == 0 {
+		return nil
+	}
+	out := sanitizeRecord(s.partial)
+	s.partial = s.partial[:0]
+	return out
+}
+
+// sanitizeRecord returns a single reply, optionally terminated, with the
+// message of an ERROR replaced by a bare ERROR. The request number of a
+// session reply ("<id>: ") and the terminator are kept.
+func sanitizeRecord(record []byte) []byte {
+	body, terminator := record, []byte(nil)
+	if n := len(record); n > 0 && isResponseTerminator(record[n-1]) {
+		body, terminator = record[:n-1], record[n-1:]
+	}
+	if classifyResponse(string(body)) != verdictError {
+		return record
+	}
+
+	var out []byte
+	if sep := bytes.Index(body, []byte(": ")); sep > 0 && isRequestNumber(body[:sep]) {
+		out = append(out, body[:sep+2]...)
+	}
+	out = append(out, sanitizedError...)
+	return append(out, terminator...)
+}
+
+// isResponseTerminator reports whether b ends a clamd reply
+func isResponseTerminator(b byte) bool {
+	return b == newlineDelimiter || b == nullDelimiter
+}
+
+// isRequestNumber reports whether b is the request number of a session reply
+func isRequestNumber(b []byte) bool {
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return len(b) > 0
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestResponseSanitizer(t *testing.T) {
+	tests := []struct {
+		name     string
+		reads    []string
+		expected string
+	}{
+		{
+			name:     "Verdicts unchanged",
+			reads:    []string{"stream: OK\x00", "stream: Eicar-Test-Signature FOUND\n", "PONG\n"},
+			expected: "stream: OK\x00stream: Eicar-Test-Signature FOUND\nPONG\n",
+		},
+		{
+			name:     "Error replaced",
+			reads:    []string{"/srv/files/secret.txt: lstat() failed: No such file or directory. ERROR\n"},
+			expected: "ERROR\n",
+		},
+		{
+			name:     "Multi-line",
+			reads:    []string{"/a: OK\n/b: Access denied. ERROR\n/c: Eicar FOUND\n"},
+			expected: "/a: OK\nERROR\n/c: Eicar FOUND\n",
+		},
+		{
+			name:     "Split error",
+			reads:    []string{"INSTREAM size limit", " exceeded. ER", "ROR\x00"},
+			expected: "ERROR\x00",
+		},
+		{
+			name:     "Split between replies",
+			reads:    []string{"stream: OK\nstr", "eam: Can't allocate memory ERROR\n"},
+			expected: "stream: OK\nERROR\n",
+		},
+		{
+			name:     "Session reply keeps its request number",
+			reads:    []string{"1: PONG\x002: stream: Broken pipe ERROR\x00"},
+			expected: "1: PONG\x002: ERROR\x00",
+		},
+		{
+			name:     "Signature mentioning ERROR",
+			reads:    []string{"stream: Win.ERROR.Test FOUND\n"},
+			expected: "stream: Win.ERROR.Test FOUND\n",
+		},
+		{
+			name:     "Unterminated error at end of stream",
+			reads:    []string{"stream: Broken pipe ERROR"},
+			expected: "ERROR",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var s responseSanitizer
+			var out strings.Builder
+			for _, read := range tc.reads {
+				out.Write(s.rewrite([]byte(read)))
+			}
+			out.Write(s.flush())
+			if out.String() != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, out.String())
+			}
+		})
+	}
+}
+
+func TestResponseSanitizerLongReply(t *testing.T) {
+	// Replies too long to be held back, such as STATS output, pass through
+	// as they arrive
+	var s responseSanitizer
+	long := strings.Repeat("x", maxResponseRecord+1)
+	if got := string(s.rewrite([]byte(long))); got != long {
+		t.Errorf("Expected the long reply to pass through, got %d bytes", len(got))
+	}
+	if got := string(s.rewrite([]byte(" ERROR\nstream: Broken pipe ERROR\n"))); got != " ERROR\nERROR\n" {
+		t.Errorf("Expected %q, got %q", " ERROR\nERROR\n", got)
+	}
+}
+
+func TestSanitizeResponses(t *testing.T) {
+	srv := newTestProxy(t, func(c *Config) { c.SanitizeResponses = true })
+	clientSide, backendSide, done := startProxyWithPipes(t, srv)
+
+	go func() {
+		_, _ = clientSide.Write([]byte("zINSTREAM\x00"))
+		_, _ = clientSide.Write(instreamPayload(4, 4))
+	}()
+
+	forwarded := make([]byte, len("zINSTREAM\x00")+len(instreamPayload(4, 4)))
+	if _, err := io.ReadFull(backendSide, forwarded); err != nil {
+		t.Fatalf("Failed to read forwarded stream: %v", err)
+	}
+	go func() {
+		_, _ = backendSide.Write([]byte("INSTREAM size limit exceeded. "))
+		_, _ = backendSide.Write([]byte("ERROR\x00"))
+		_ = backendSide.Close()
+	}()
+
+	response, err := io.ReadAll(clientSide)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	if string(response) != "ERROR\x00" {
+		t.Errorf("Expected %q, got %q", "ERROR\x00", response)
+	}
+	<-done
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// parseScanPrefixes cleans the directories SCAN may be used on. They must be
+// absolute, since clamd resolves relative paths against its own working
+// directory.
+func parseScanPrefixes(prefixes []string) ([]string, error) {
+	cleaned := make([]string, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		if !filepath.IsAbs(prefix) {
+			return nil, fmt.Errorf("invalid --scan-allow-prefix %q: must be an absolute path", prefix)
+		}
+		cleaned = append(cleaned, filepath.Clean(prefix))
+	}
+	return cleaned, nil
+}
+
+// isPathScanCommand reports whether name is a command that takes a path to
+// scan on the clamd host
+func isPathScanCommand(name string) bool {
+	return name == "SCAN" || name == "CONTSCAN"
+}
+
+// isScanPathAllowed reports whether the path argument of a SCAN or CONTSCAN
+// command lies within one of the --scan-allow-prefix directories. Paths
+// containing ".." are refused outright rather than resolved. Symlinks can't
+// be checked here, since they are followed by clamd on its own host.
+func (p *Proxy) isScanPathAllowed(cmd string) bool {
+	// clamd takes the rest of the line after the command as the path
+	_, path, ok := strings.Cut(cmd, " ")
+	if !ok || path == "" || !filepath.IsAbs(path) {
+		return false
+	}
+	for _, element := range strings.Split(filepath.ToSlash(path), "/") {
+		if element == ".." {
+			return false
+		}
+	}
+
+	path = filepath.Clean(path)
+	for _, prefix := range p.scanPrefixes {
+		if path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, string(filepath.Separator))+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import "testing"
+
+func TestIsScanPathAllowed(t *testing.T) {
+	srv := newTestProxy(t, func(c *Config) { c.ScanAllowPrefix = []string{"/srv/shared/", "/data/uploads"} })
+
+	tests := []struct {
+		cmd     string
+		allowed bool
+	}{
+		{"SCAN /srv/shared", true},
+		{"SCAN /srv/shared/", true},
+		{"SCAN /srv/shared/invoice.pdf", true},
+		{"zCONTSCAN /data/uploads/2024/report.docx", true},
+		{"nSCAN /srv/shared/dir with spaces/file", true},
+		{"SCAN /srv/shared//nested/./file", true},
+
+		// Traversal is refused even if it would resolve inside
+		{"SCAN /srv/shared/../../etc/shadow", false},
+		{"SCAN /srv/shared/sub/../file", false},
+		{"SCAN /srv/shared/..", false},
+
+		// Lookalike prefixes and symlink-looking names
+		{"SCAN /srv/shared-evil/file", false},
+		{"SCAN /srv/sharedlink/file", false},
+		{"SCAN /srv/shared../etc", false}, // A sibling of /srv/shared, not a parent reference
+		{"SCAN /etc/passwd", false},
+		{"SCAN /", false},
+
+		// Missing or relative paths
+		{"SCAN", false},
+		{"SCAN ", false},
+		{"SCAN srv/shared/file", false},
+		{"SCAN ./srv/shared/file", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.cmd, func(t *testing.T) {
+			if got := srv.isScanPathAllowed(tc.cmd); got != tc.allowed {
+				t.Errorf("Expected %v, got %v", tc.allowed, got)
+			}
+		})
+	}
+}
+
+func TestScanAllowPrefixFiltering(t *testing.T) {
+	for _, mode := range []string{"allow", "deny"} {
+		srv := newTestProxy(t, func(c *Config) {
+			c.Mode = mode
+			c.ScanAllowPrefix = []string{"/srv/shared"}
+		})
+		if !srv.isCommandAllowed("zSCAN /srv/shared/file") {
+			t.Errorf("%s mode: expected SCAN within the prefix to be allowed", mode)
+		}
+		if srv.isCommandAllowed("zSCAN /etc/passwd") {
+			t.Errorf("%s mode: expected SCAN outside the prefix to be blocked", mode)
+		}
+		if !srv.isCommandAllowed("CONTSCAN /srv/shared") {
+			t.Errorf("%s mode: expected CONTSCAN within the prefix to be allowed", mode)
+		}
+	}
+
+	// An explicit denial still wins
+	srv := newTestProxy(t, func(c *Config) {
+		c.Mode = "deny"
+		c.Denylist = []string{"SCAN"}
+		c.ScanAllowPrefix = []string{"/srv/shared"}
+	})
+	if srv.isCommandAllowed("SCAN /srv/shared/file") {
+		t.Error("Expected a denied SCAN to stay blocked")
+	}
+}
+
+func TestParseScanPrefixes(t *testing.T) {
+	if _, err := parseScanPrefixes([]string{"relative/dir"}); err == nil {
+		t.Error("Expected a relative prefix to be rejected")
+	}
+	prefixes, err := parseScanPrefixes([]string{"/srv/shared/../other/"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(prefixes) != 1 || prefixes[0] != "/srv/other" {
+		t.Errorf("Expected the prefix to be cleaned, got %q", prefixes)
+	}
+}
@@ -0,0 +1,674 @@
+// Package proxy implements a proxy for ClamAV's clamd daemon that filters
+// unsafe commands and forwards safe ones to the backend. It is the core of
+// the clamdproxy command and can be embedded in other programs:
+//
+//	cfg := proxy.DefaultConfig()
+//	cfg.Listen = []string{"127.0.0.1:3310"}
+//	cfg.Backend = []string{"127.0.0.1:3311"}
+//	p, err := proxy.New(cfg)
+//	if err != nil {
+//		return err
+//	}
+//	return p.ListenAndServe(ctx)
+//
+// Every Proxy keeps its own settings, connections and counters, so a program
+// may run several side by side.
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alecthomas/kong"
+)
+
+// Config configures a Proxy. Its fields are the command line flags of
+// clamdproxy, named in the tags, whose help texts document them; start from
+// DefaultConfig to get the flag defaults.
+type Config struct {
+	Listen          []string `name:"listen" help:"Addresses to listen on, host:port or unix:/path (repeatable)" default:"127.0.0.1:3310"`
+	Backend         []string `name:"backend" help:"Address of the backend clamd server (repeatable, load balanced round-robin)" default:"127.0.0.1:3311"`
+	Mode            string   `name:"mode" help:"Command filtering mode: allow forwards only whitelisted commands, deny forwards everything but the denylist" default:"allow" enum:"allow,deny"`
+	Whitelist       string   `name:"whitelist" help:"File listing the commands allowed in allow mode, one per line (reloaded on SIGHUP)"`
+	Denylist        []string `name:"denylist" help:"Commands refused in deny mode (repeatable or comma separated)" default:"SHUTDOWN,RELOAD"`
+	BlockedResponse string   `name:"blocked-response" help:"Reply sent for blocked commands; {command} is replaced by the command name" default:"UNKNOWN COMMAND"`
+	DryRun          bool     `name:"dry-run" help:"Forward every command, only logging the ones the filter would block"`
+	LegacySession   bool     `name:"legacy-session" help:"Allow the legacy SESSION command, which keeps the connection open for further commands until END"`
+	CaseInsensitive bool     `name:"case-insensitive" help:"Match command names regardless of case, forwarding them in the upper case clamd expects (e.g. Zping as zPING)"`
+	DisableInstream bool     `name:"disable-instream" help:"Block INSTREAM in every mode, whatever the whitelist allows, so no files are scanned through the proxy"`
+	PprofAddr       string   `name:"pprof" help:"Address for pprof HTTP server (disabled if empty)" default:""`
+	StatsAddr       string   `name:"stats-addr" help:"Address for the JSON stats HTTP endpoint at /stats and the /drain and /undrain admin endpoints (disabled if empty)" default:""`
+	MetricsAddr     string   `name:"metrics-addr" help:"Address for the Prometheus metrics HTTP endpoint at /metrics (disabled if empty)" default:""`
+	HealthAddr      string   `name:"health-addr" help:"Address for the /healthz and /readyz HTTP endpoints (disabled if empty)" default:""`
+	OtelEndpoint    string   `name:"otel-endpoint" help:"Base URL of an OTLP/HTTP collector to send connection traces to, e.g. http://localhost:4318 (disabled if empty)" default:""`
+
+	ActiveHighWater []int `name:"active-high-water" help:"Log a warning when the number of active connections reaches any of these values (repeatable)"`
+
+	SummaryInterval time.Duration `name:"summary-interval" help:"Log a summary of the connection and scan counters at info level this often (0 disables)" default:"0"`
+
+	AuditLog string `name:"audit-log" help:"Append a JSON line for every command forwarded, refused or answered locally to this file (disabled if empty)" default:""`
+
+	TLSCert          string            `name:"tls-cert" help:"TLS certificate file for client connections (enables TLS termination)" default:""`
+	TLSKey           string            `name:"tls-key" help:"TLS private key file for client connections" default:""`
+	SNIBackend       map[string]string `name:"sni-backend" help:"Route TLS clients to a backend by SNI hostname (host=addr, repeatable)"`
+	SNIRejectUnknown bool              `name:"sni-reject-unknown" help:"Reject TLS clients whose SNI hostname has no --sni-backend route instead of using --backend"`
+	ClientCA         string            `name:"client-ca" help:"PEM file with CA certificates; TLS clients must present a certificate signed by one of them" default:""`
+
+	BackendDialTimeout   time.Duration `name:"backend-dial-timeout" help:"Give up connecting to a backend after this long (0 waits for the OS connect timeout)" default:"5s"`
+	BackendSourceAddr    string        `name:"backend-source-addr" help:"Local IP address to connect to backends from (chosen by the OS if empty)" default:""`
+	BackendRetries       int           `name:"backend-retries" help:"Times to retry connecting to the backend after a refused or timed out dial" default:"3"`
+	BackendRetryDelay    time.Duration `name:"backend-retry-delay" help:"Delay before the first backend connection retry, doubled on each further retry" default:"100ms"`
+	BackendRetryMaxDelay time.Duration `name:"backend-retry-max-delay" help:"Upper bound for the backend connection retry delay" default:"2s"`
+	RetryFirstCommand    bool          `name:"retry-first-command" help:"Reconnect once and replay the first command if the backend closes the connection before replying"`
+	UnavailableResponse  string        `name:"unavailable-response" help:"Reply sent to clients whose backend can't be reached before closing the connection (closes without a reply if empty)" default:"ERROR: backend unavailable"`
+
+	BackendPoolSize int `name:"backend-pool-size" help:"Keep this many backend connections open ahead of clients, reusing those a client never sent a command on (0 dials per client)" default:"0"`
+
+	BreakerThreshold int           `name:"breaker-threshold" help:"Fail new connections fast after this many consecutive failed backend dials (0 disables)" default:"0"`
+	BreakerCooldown  time.Duration `name:"breaker-cooldown" help:"How long the circuit breaker stays open before a single probe dial" default:"10s"`
+
+	MaxCommandLength  int  `name:"max-command-length" help:"Reject commands longer than this many bytes (0 disables)" default:"0"`
+	DrainOversized    bool `name:"drain-oversized" help:"Skip the rest of an oversized command and keep the connection open instead of closing it"`
+	MaxDrainBytes     int  `name:"max-drain-bytes" help:"Close the connection if an oversized command is still unterminated after skipping this many bytes" default:"65536"`
+	StreamFlushChunks int  `name:"stream-flush-chunks" help:"Flush INSTREAM data to the backend every this many chunks (1 flushes every chunk)" default:"10"`
+	MaxStreamChunks   int  `name:"max-stream-chunks" help:"Abort INSTREAM streams with more than this many chunks (0 disables)" default:"1000000"`
+	MaxChunkBytes     int  `name:"max-chunk-bytes" help:"Abort INSTREAM streams declaring a chunk larger than this many bytes (0 disables)" default:"10485760"`
+
+	MinStreamThroughput    int           `name:"min-stream-throughput" help:"Warn about INSTREAM uploads slower than this many bytes per second over a window (0 disables)" default:"0"`
+	StreamThroughputWindow time.Duration `name:"stream-throughput-window" help:"Window over which --min-stream-throughput is measured" default:"10s"`
+	AbortSlowStreams       bool          `name:"abort-slow-streams" help:"Abort INSTREAM uploads slower than --min-stream-throughput instead of only logging them"`
+
+	ClientBufferSize  int `name:"client-buffer-size" help:"Size of the per-connection buffers for replies to the client, in bytes" default:"65536"`
+	BackendBufferSize int `name:"backend-buffer-size" help:"Size of the per-connection buffer for commands and data sent to the backend, in bytes" default:"65536"`
+	ClientFlushBytes  int `name:"client-flush-bytes" help:"Hold back unfinished replies until this many bytes are buffered (0 sends every backend read right away)" default:"0"`
+
+	Workers     int `name:"workers" help:"Handle connections with a fixed pool of this many workers (0 starts one goroutine per connection)" default:"0"`
+	WorkerQueue int `name:"worker-queue" help:"Accepted connections that may wait for a free worker before new ones are rejected" default:"128"`
+
+	ScanAllowPrefix []string `name:"scan-allow-prefix" help:"Allow SCAN and CONTSCAN on paths within this directory on the clamd host (repeatable)"`
+
+	AllowCIDR []string `name:"allow-cidr" help:"Only accept clients from these networks, e.g. 10.0.0.0/8 (repeatable, all clients allowed if empty)"`
+
+	ProxyProtocol    bool     `name:"proxy-protocol" help:"Expect a PROXY protocol v1 header on client connections and log the client address it carries"`
+	TrustedProxyCIDR []string `name:"trusted-proxy-cidr" help:"Only take PROXY headers from load balancers in these networks and reject other peers (repeatable, required with --proxy-protocol and --allow-cidr)"`
+
+	ForwardClientIP string `name:"forward-client-ip" help:"How to pass the client address to the backend: none, or proxy to send a PROXY protocol v1 header before the first command" default:"none" enum:"none,proxy"`
+
+	TCPKeepAlivePeriod time.Duration `name:"tcp-keepalive-period" help:"Interval of TCP keepalive probes on idle client and backend connections (0 disables keepalive)" default:"30s"`
+	ShutdownTimeout    time.Duration `name:"shutdown-timeout" help:"How long to wait for active connections to finish on SIGINT or SIGTERM" default:"30s"`
+
+	LocalPing    bool          `name:"local-ping" help:"Answer PING locally without connecting to the backend"`
+	IdleTimeout  time.Duration `name:"idle-timeout" help:"Close connections with no activity in either direction for this long (0 disables)" default:"0s"`
+	WriteTimeout time.Duration `name:"write-timeout" help:"Close connections whose client doesn't accept a reply within this long (0 disables)" default:"0s"`
+
+	ResponseTimeout     time.Duration `name:"response-timeout" help:"Close connections whose backend sends nothing for this long while a reply to a forwarded command is due (0 disables)" default:"0s"`
+	ScanResponseTimeout time.Duration `name:"scan-response-timeout" help:"Like --response-timeout, for the verdict of INSTREAM once the upload is complete and of SCAN-type commands, which take as long as the scan (0 disables)" default:"0s"`
+	MaxResponseBytes    int           `name:"max-response-bytes" help:"Close connections whose backend sends more than this many bytes in reply to a command other than INSTREAM (0 disables)" default:"0"`
+
+	MaxConnLifetime time.Duration `name:"max-conn-lifetime" help:"Close connections open for longer than this, regardless of activity (0 disables)" default:"0s"`
+
+	VersionCacheTTL time.Duration `name:"version-cache-ttl" help:"Answer VERSION locally from a reply fetched from the backend, refreshed in the background once older than this (0 disables)" default:"0s"`
+
+	MaxCommandsPerConn int `name:"max-commands-per-conn" help:"Close connections after this many forwarded commands, an INSTREAM counting once (0 disables)" default:"0"`
+
+	NormalizeDelimiters bool `name:"normalize-delimiters" help:"Forward commands terminated as their prefix requires (null for z, newline otherwise), whatever the client sent"`
+
+	SanitizeResponses bool `name:"sanitize-responses" help:"Replace clamd ERROR replies, which can reveal paths or version details, with a bare ERROR"`
+
+	RecordDir      string `name:"record-dir" help:"Record what each client sends and is sent back into a transcript file in this directory, for test_client --replay (disabled if empty)" default:""`
+	RecordMaxBytes int    `name:"record-max-bytes" help:"Stop recording a connection once its transcript holds this many bytes of data (0 disables)" default:"10485760"`
+	RecordMaxFiles int    `name:"record-max-files" help:"Keep at most this many transcripts in --record-dir, deleting the oldest (0 keeps all)" default:"100"`
+
+	// Logger receives the proxy's logs; slog.Default() is used if nil
+	Logger *slog.Logger `kong:"-"`
+
+	// Version is reported to the trace collector as the service version
+	Version string `kong:"-"`
+}
+
+// DefaultConfig returns a Config holding the defaults of the command line flags
+func DefaultConfig() Config {
+	var c Config
+	parser, err := kong.New(&c)
+	if err == nil {
+		_, err = parser.Parse(nil)
+	}
+	if err != nil {
+		panic(fmt.Sprintf("invalid Config defaults: %v", err))
+	}
+	return c
+}
+
+// Proxy accepts clamd clients and forwards their commands to the backends,
+// as configured by New. It serves once: after Serve returns it is shut down.
+// Every Proxy has settings, connections and counters of its own, so several
+// may run in one process.
+type Proxy struct {
+	cfg    Config
+	logger *slog.Logger
+
+	// Command filtering. allowed is swapped on SIGHUP while connections are
+	// being filtered, always access it through allowedRule and
+	// setAllowedCommands.
+	allowedMu    sync.RWMutex
+	allowed      map[string]commandRule
+	denied       map[string]bool // Refused in deny mode
+	scanPrefixes []string        // From --scan-allow-prefix, see isScanPathAllowed
+
+	// Client access
+	allowedNets      []*net.IPNet      // From --allow-cidr, nil allows every client
+	trustedProxyNets []*net.IPNet      // From --trusted-proxy-cidr, nil trusts every peer
+	tlsConfig        *tls.Config       // Nil without TLS termination
+	sniBackends      map[string]string // Lower-cased SNI hostname -> backend address
+
+	// Buffer pools to reduce GC pressure, sized by the flags
+	chunkBufSize      int       // See chunkBufferSize
+	chunkBufPool      sync.Pool // For INSTREAM chunks up to chunkBufSize
+	copyBufPool       sync.Pool // For relaying backend replies in Start
+	clientWriterPool  sync.Pool // For the buffered writers of a connection
+	backendWriterPool sync.Pool
+
+	// Backends
+	sourceAddr      *net.TCPAddr // From --backend-source-addr, nil leaves it to the OS
+	netDial         func(ctx context.Context, network, addr string) (net.Conn, error)
+	backendCounter  atomic.Uint64 // Drives round-robin selection, see backendOrder
+	breaker         *circuitBreaker
+	poolsMu         sync.Mutex
+	pools           map[string]*backendPool // Keyed by backend address list
+	versionCachesMu sync.Mutex
+	versionCaches   map[string]*versionCache // Keyed by backend address list
+
+	tracer   *spanTracer // Nil without --otel-endpoint
+	auditLog *auditTrail // Nil without --audit-log
+	pruneMu  sync.Mutex  // Serializes pruneRecordings
+
+	metrics     proxyMetrics
+	draining    atomic.Bool       // See drainHandler
+	activeConns sync.WaitGroup    // Accepted connections not yet handled in full
+	connQueue   chan acceptedConn // Nil without --workers, see dispatchConnection
+	served      atomic.Bool
+}
+
+// New validates c and sets up a Proxy, opening the audit log and the trace
+// exporter it configures
+func New(c Config) (*Proxy, error) {
+	p := &Proxy{cfg: c, logger: c.Logger}
+	if p.logger == nil {
+		p.logger = slog.Default()
+	}
+
+	var whitelist map[string]commandRule
+	if c.Whitelist != "" {
+		var err error
+		if whitelist, err = loadWhitelist(c.Whitelist, c.CaseInsensitive); err != nil {
+			return nil, fmt.Errorf("failed to load whitelist: %w", err)
+		}
+	}
+
+	if c.StreamFlushChunks <= 0 {
+		return nil, fmt.Errorf("invalid --stream-flush-chunks %d, must be positive", c.StreamFlushChunks)
+	}
+	if c.ClientBufferSize < minBufferSize || c.BackendBufferSize < minBufferSize {
+		return nil, fmt.Errorf("invalid buffer size, --client-buffer-size %d and --backend-buffer-size %d must be at least %d bytes",
+			c.ClientBufferSize, c.BackendBufferSize, minBufferSize)
+	}
+	if c.ClientFlushBytes < 0 || c.ClientFlushBytes > c.ClientBufferSize {
+		return nil, fmt.Errorf("invalid --client-flush-bytes %d, must be between 0 and --client-buffer-size", c.ClientFlushBytes)
+	}
+	if c.MinStreamThroughput < 0 || (c.MinStreamThroughput > 0 && c.StreamThroughputWindow <= 0) {
+		return nil, fmt.Errorf("invalid --min-stream-throughput %d, must not be negative and needs a positive --stream-throughput-window",
+			c.MinStreamThroughput)
+	}
+
+	if c.RecordMaxBytes < 0 || c.RecordMaxFiles < 0 {
+		return nil, fmt.Errorf("invalid --record-max-bytes %d or --record-max-files %d, must not be negative",
+			c.RecordMaxBytes, c.RecordMaxFiles)
+	}
+	if c.RecordDir != "" {
+		if err := os.MkdirAll(c.RecordDir, 0o700); err != nil {
+			return nil, fmt.Errorf("invalid --record-dir: %w", err)
+		}
+	}
+
+	sourceAddr, err := parseSourceAddr(c.BackendSourceAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --backend-source-addr: %w", err)
+	}
+	prefixes, err := parseScanPrefixes(c.ScanAllowPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SCAN directories: %w", err)
+	}
+	nets, err := parseCIDRs("allow-cidr", c.AllowCIDR)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client access list: %w", err)
+	}
+	trustedNets, err := parseCIDRs("trusted-proxy-cidr", c.TrustedProxyCIDR)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxy list: %w", err)
+	}
+	if c.ProxyProtocol && len(nets) > 0 && len(trustedNets) == 0 {
+		// Anyone could otherwise claim an allowed address in a forged header
+		return nil, errors.New("--allow-cidr with --proxy-protocol needs --trusted-proxy-cidr")
+	}
+	clientTLS, err := p.loadTLSConfig()
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLS configuration: %w", err)
+	}
+
+	var spans *spanTracer
+	if c.OtelEndpoint != "" {
+		if spans, err = newSpanTracer(c.OtelEndpoint, c.Version, p.logger); err != nil {
+			return nil, fmt.Errorf("invalid tracing configuration: %w", err)
+		}
+	}
+	var audits *auditTrail
+	if c.AuditLog != "" {
+		if audits, err = openAuditTrail(c.AuditLog); err != nil {
+			return nil, fmt.Errorf("invalid audit configuration: %w", err)
+		}
+	}
+
+	p.allowed = builtinWhitelist
+	if whitelist != nil {
+		p.allowed = whitelist
+		p.logger.Info("Loaded whitelist", "file", c.Whitelist, "commands", len(whitelist))
+	}
+	p.denied = p.commandSet(c.Denylist)
+	p.scanPrefixes = prefixes
+	p.allowedNets = nets
+	p.trustedProxyNets = trustedNets
+	p.tlsConfig = clientTLS
+
+	p.chunkBufSize = chunkBufferSize(c.MaxChunkBytes)
+	p.chunkBufPool.New = p.newChunkBuf
+
+	p.sourceAddr = sourceAddr
+	p.netDial = p.dialContext
+	p.breaker = &circuitBreaker{now: time.Now, logger: p.logger}
+	p.pools = make(map[string]*backendPool)
+	p.versionCaches = make(map[string]*versionCache)
+
+	p.auditLog = audits
+	p.tracer = spans
+	if p.tracer != nil {
+		go p.tracer.run()
+	}
+	return p, nil
+}
+
+// ReloadWhitelist re-reads the whitelist file, keeping the current whitelist
+// if that fails. clamdproxy calls it on SIGHUP.
+func (p *Proxy) ReloadWhitelist() error {
+	if p.cfg.Whitelist == "" {
+		return errors.New("no whitelist file configured")
+	}
+	return p.reloadWhitelist()
+}
+
+// ListenAndServe binds every Listen address and serves on them as Serve does
+func (p *Proxy) ListenAndServe(ctx context.Context) error {
+	listeners, err := p.listenAll(p.cfg.Listen)
+	if err != nil {
+		return err
+	}
+	return p.Serve(ctx, listeners...)
+}
+
+// Serve accepts clients on the listeners, along with the pprof, stats,
+// metrics and health servers configured, until ctx is done or a listener
+// fails for good. It then closes the listeners and waits up to
+// ShutdownTimeout for active connections to finish before closing them, and
+// shuts the HTTP servers down. It returns an error if one of the HTTP
+// servers can't bind its address, the listener failure, or an error if
+// connections were still open after that, and nil after a clean shutdown.
+func (p *Proxy) Serve(ctx context.Context, listeners ...net.Listener) error {
+	if len(listeners) == 0 {
+		return errors.New("no listeners to serve on")
+	}
+	if p.served.Swap(true) {
+		return errors.New("proxy already served")
+	}
+
+	p.logger.Warn("Starting clamdproxy",
+		"version", p.cfg.Version,
+		"listen", listenAddrs(listeners),
+		"backend", p.cfg.Backend,
+		"mode", p.cfg.Mode,
+		"dry_run", p.cfg.DryRun,
+		"tls", p.tlsConfig != nil,
+		"tracing", p.tracer != nil,
+		"audit_log", p.cfg.AuditLog)
+
+	// Bind every HTTP server before serving, so an address already in use
+	// stops startup instead of leaving the server silently off
+	servers, err := p.startHTTPServers()
+	if err != nil {
+		p.closeListeners(listeners)
+		return err
+	}
+
+	// Cancelled when the shutdown timeout expires, which closes the
+	// connections still active
+	serverCtx, cancelServer := context.WithCancel(context.Background())
+	defer cancelServer()
+
+	if p.cfg.Workers > 0 {
+		p.startWorkers(serverCtx, p.cfg.Workers, p.cfg.WorkerQueue)
+	}
+
+	// Stop accepting once ctx is done, which ends the accept loops
+	go func() {
+		<-ctx.Done()
+		p.closeListeners(listeners)
+	}()
+
+	stopSummary := func() {}
+	if p.cfg.SummaryInterval > 0 {
+		stopSummary = p.startSummaryLogger(p.cfg.SummaryInterval)
+	}
+
+	// A listener that fails for good is shut down like on a signal, along
+	// with the others, letting active connections finish, but the error is
+	// returned
+	listenerErr := p.serveListeners(listeners, ctx.Done(), func(conn net.Conn, listener string) {
+		p.dispatchConnection(serverCtx, conn, listener)
+	})
+	if listenerErr != nil {
+		p.logger.Error("Listener failed, shutting down", "error", listenerErr)
+	}
+
+	p.shutdownHTTPServers(servers)
+
+	if !p.waitForConnections(p.cfg.ShutdownTimeout) {
+		p.logger.Warn("Shutdown timeout reached, closing active connections",
+			"active", p.metrics.connectionsActive.Load(),
+			"timeout", p.cfg.ShutdownTimeout)
+		cancelServer()
+		if !p.waitForConnections(forcedShutdownTimeout) {
+			p.closeAuditLog()
+			return errors.New("connections still active after shutdown")
+		}
+	}
+	p.stopWorkers()
+
+	if p.tracer != nil {
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), traceExportTimeout)
+		if err := p.tracer.shutdown(shutdownCtx); err != nil {
+			p.logger.Error("Failed to export remaining trace spans", "error", err)
+		}
+		cancelShutdown()
+	}
+	p.closeBackendPools()
+	p.closeAuditLog()
+	stopSummary()
+	p.logger.Warn("Shutdown complete")
+	return listenerErr
+}
+
+// httpServer is one of the HTTP servers run next to the proxy
+type httpServer struct {
+	name     string
+	server   *http.Server
+	listener net.Listener
+}
+
+// startHTTPServers starts the pprof, stats, metrics and health servers that
+// are configured. If one can't bind its address, the ones already started are
+// shut down again and the error is returned.
+func (p *Proxy) startHTTPServers() ([]httpServer, error) {
+	wanted := []struct {
+		name, addr, path string
+		handler          http.Handler
+	}{
+		{"pprof", p.cfg.PprofAddr, "/debug/pprof/", p.pprofMux()},
+		{"stats", p.cfg.StatsAddr, "/stats", p.statsMux()},
+		{"metrics", p.cfg.MetricsAddr, "/metrics", p.metricsMux()},
+		{"health", p.cfg.HealthAddr, "/readyz", p.healthMux()},
+	}
+
+	var servers []httpServer
+	for _, w := range wanted {
+		if w.addr == "" {
+			continue
+		}
+		listener, err := net.Listen("tcp", w.addr)
+		if err != nil {
+			p.shutdownHTTPServers(servers)
+			return nil, fmt.Errorf("failed to start %s server: %w", w.name, err)
+		}
+
+		server := &http.Server{
+			Handler:           w.handler,
+			ReadHeaderTimeout: 5 * time.Second,
+		}
+		p.logger.Info("Starting "+w.name+" server",
+			"addr", w.addr,
+			"url", fmt.Sprintf("http://%s%s", w.addr, w.path))
+		go func(name string) {
+			if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				p.logger.Error("HTTP server failed", "server", name, "error", err)
+			}
+		}(w.name)
+		servers = append(servers, httpServer{w.name, server, listener})
+	}
+	return servers, nil
+}
+
+// shutdownHTTPServers shuts the servers down, letting requests in progress
+// finish within ShutdownTimeout. The listeners are closed here as well, as a
+// server that hasn't got round to serving yet doesn't know its listener.
+func (p *Proxy) shutdownHTTPServers(servers []httpServer) {
+	for _, s := range servers {
+		p.shutdownHTTPServer(s.name, s.server, p.cfg.ShutdownTimeout)
+		if err := s.listener.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			p.logger.Debug("Error closing HTTP server listener", "server", s.name, "error", err)
+		}
+	}
+}
+
+// statsMux serves the JSON counters and the drain admin endpoints
+func (p *Proxy) statsMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", p.statsHandler)
+	mux.HandleFunc("/drain", p.drainHandler)
+	mux.HandleFunc("/undrain", p.undrainHandler)
+	return mux
+}
+
+// metricsMux serves the Prometheus metrics
+func (p *Proxy) metricsMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", p.promHandler)
+	return mux
+}
+
+// pprofMux serves the pprof handlers and the expvar counters, without
+// registering pprof on http.DefaultServeMux of a program embedding the proxy
+func (p *Proxy) pprofMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/vars", p.varsHandler)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// handleConnection manages a client connection by establishing a backend connection
+// and setting up bidirectional proxying between them. Cancelling ctx closes it.
+// listener is the address of the listener that accepted it, which is logged
+// and counted with the connection.
+func (p *Proxy) handleConnection(ctx context.Context, clientConn net.Conn, listener string) {
+	defer p.activeConns.Done()
+	ctx, cancel := p.connectionContext(ctx)
+	defer cancel()
+	p.connectionOpened(listener)
+	defer p.metrics.connectionClosed()
+	connID := newConnID()
+	connSpan := p.tracer.startSpan("clamdproxy.connection", nil)
+	defer connSpan.finish()
+	connSpan.setAttr("clamdproxy.conn_id", connID)
+	connSpan.setAttr("clamdproxy.listener", listener)
+	defer func() {
+		if err := clientConn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			p.logger.Error("Failed to close client connection", "conn_id", connID, "error", err)
+		}
+	}()
+	clientAddr := clientConn.RemoteAddr().String()
+
+	if err := setKeepAlive(clientConn, p.cfg.TCPKeepAlivePeriod); err != nil {
+		p.logger.Debug("Failed to configure client keepalive", "conn_id", connID, "client", clientAddr, "error", err)
+	}
+
+	// Take the real client address from the load balancer's PROXY header,
+	// once the peer is known to be one
+	if p.cfg.ProxyProtocol {
+		if !p.isTrustedProxy(clientConn.RemoteAddr()) {
+			p.logger.Warn("Rejected connection from untrusted PROXY peer", "conn_id", connID, "listener", listener, "peer", clientAddr)
+			connSpan.setError("PROXY peer not trusted")
+			return
+		}
+		proxiedConn, err := readProxyHeader(clientConn)
+		if err != nil {
+			p.logger.Warn("Rejected connection with invalid PROXY header", "conn_id", connID, "listener", listener, "peer", clientAddr, "error", err)
+			connSpan.setError("invalid PROXY header")
+			return
+		}
+		clientConn = proxiedConn // Closed by the deferred close above
+		clientAddr = clientConn.RemoteAddr().String()
+	}
+
+	if !p.isClientAllowed(clientConn.RemoteAddr()) {
+		p.logger.Warn("Rejected connection from disallowed address", "conn_id", connID, "client", clientAddr, "listener", listener)
+		connSpan.setAttr("client.address", clientAddr)
+		connSpan.setError("client address not allowed")
+		return
+	}
+
+	p.logger.Info("Connection established", "conn_id", connID, "client", clientAddr, "listener", listener)
+	connSpan.setAttr("client.address", clientAddr)
+
+	backendAddrs := p.cfg.Backend
+
+	if p.tlsConfig != nil {
+		var sniBackend string // Set during the handshake
+		tlsConn := tls.Server(clientConn, p.connTLSConfig(&sniBackend))
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			p.logger.Info("TLS handshake failed", "conn_id", connID, "client", clientAddr, "error", err)
+			connSpan.setError("TLS handshake failed")
+			return
+		}
+		clientConn = tlsConn // Closed by the deferred close above
+
+		state := tlsConn.ConnectionState()
+		if name := clientCertName(state); name != "" {
+			p.logger.Info("TLS client authenticated", "conn_id", connID, "client", clientAddr, "cn", name)
+			connSpan.setAttr("tls.client.subject", name)
+		}
+
+		if sniBackend != "" {
+			backendAddrs = []string{sniBackend}
+			p.logger.Debug("Routed by SNI", "conn_id", connID, "client", clientAddr, "sni", state.ServerName, "backend", sniBackend)
+		}
+	}
+
+	dial := func() (net.Conn, error) {
+		return p.dialBackend(ctx, backendAddrs, clientAddr, connID)
+	}
+	var pool *backendPool
+	if p.cfg.BackendPoolSize > 0 {
+		pool = p.backendPoolFor(backendAddrs)
+		dial = func() (net.Conn, error) {
+			return pool.get(ctx, clientAddr, connID)
+		}
+	}
+
+	var proxy *ClamdProxy
+	if p.cfg.LocalPing || p.cfg.VersionCacheTTL > 0 {
+		// Defer the dial so clients that only PING or ask for the version
+		// never reach the backend
+		proxy = p.NewDeferredClamdProxy(clientConn, dial)
+	} else {
+		backendConn, err := dial()
+		if err != nil {
+			connSpan.setError("backend unavailable")
+			p.replyUnavailable(clientConn, connID)
+			return
+		}
+		proxy = p.NewClamdProxy(clientConn, backendConn)
+	}
+	proxy.parkBackend = pool != nil
+	defer func() {
+		if proxy.backend == nil {
+			return
+		}
+		// Connections that never carried a command, e.g. of load balancer
+		// health checks, go back to the pool
+		if pool != nil && proxy.backendReusable() {
+			pool.put(proxy.backend)
+			return
+		}
+		if err := proxy.backend.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			p.logger.Error("Failed to close backend connection", "conn_id", connID, "error", err)
+		}
+	}()
+
+	proxy.connID = connID
+	if p.cfg.RecordDir != "" {
+		if rec := p.startRecording(connID); rec != nil {
+			defer rec.close()
+			proxy.record(rec)
+		}
+	}
+	if p.cfg.ForwardClientIP == "proxy" {
+		proxy.backendPreamble = []byte(proxyHeader(clientConn.RemoteAddr(), clientConn.LocalAddr()))
+	}
+	if p.cfg.VersionCacheTTL > 0 {
+		proxy.versionCache = p.versionCacheFor(backendAddrs)
+	}
+	if p.cfg.RetryFirstCommand {
+		proxy.redial = func() (net.Conn, error) {
+			return p.dialBackend(ctx, backendAddrs, clientAddr, connID)
+		}
+	}
+	proxy.span = connSpan
+	proxy.StartContext(ctx)
+
+	p.logger.Info("Connection closed", "conn_id", connID, "client", clientAddr, "listener", listener)
+}
+
+// errConnLifetimeExpired is the cancellation cause of a connection that
+// reached --max-conn-lifetime
+var errConnLifetimeExpired = errors.New("connection lifetime expired")
+
+// connectionContext derives the context of a single client connection from
+// the server's, expiring it after --max-conn-lifetime if that is set
+func (p *Proxy) connectionContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if p.cfg.MaxConnLifetime > 0 {
+		return context.WithTimeoutCause(parent, p.cfg.MaxConnLifetime, errConnLifetimeExpired)
+	}
+	return context.WithCancel(parent)
+}
+
+// newConnID returns a short random ID used to correlate the log lines of a
+// single client connection
+func newConnID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "00000000"
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,335 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewConnID(t *testing.T) {
+	id := newConnID()
+	if len(id) != 8 {
+		t.Errorf("Expected an 8 character ID, got %q", id)
+	}
+	if _, err := hex.DecodeString(id); err != nil {
+		t.Errorf("Expected a hex ID, got %q", id)
+	}
+	if other := newConnID(); other == id {
+		t.Errorf("Expected distinct IDs, got %q twice", id)
+	}
+}
+
+func TestJSONLogClientField(t *testing.T) {
+	var logs syncBuffer
+	srv := newTestProxy(t, func(c *Config) {
+		c.Logger = slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+		c.Backend = []string{startFakeBackend(t, "PONG\x00")}
+	})
+
+	clientSide, proxyClient := tcpPair(t)
+	done := make(chan struct{})
+	srv.activeConns.Add(1)
+	go func() {
+		defer close(done)
+		srv.handleConnection(context.Background(), proxyClient, "test")
+	}()
+
+	if _, err := clientSide.Write([]byte("zPING\x00")); err != nil {
+		t.Fatalf("Client write failed: %v", err)
+	}
+	reply := make([]byte, len("PONG\x00"))
+	if _, err := io.ReadFull(clientSide, reply); err != nil {
+		t.Fatalf("Failed to read reply: %v", err)
+	}
+	_ = clientSide.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Connection was not closed")
+	}
+
+	// Every record naming the client must carry its address as a plain
+	// string, as log pipelines parse it
+	expected := clientSide.LocalAddr().String()
+	found := 0
+	scanner := bufio.NewScanner(strings.NewReader(logs.String()))
+	for scanner.Scan() {
+		var record map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("Invalid JSON log line %q: %v", scanner.Text(), err)
+		}
+		client, ok := record["client"]
+		if !ok {
+			continue
+		}
+		found++
+		if s, ok := client.(string); !ok || s != expected {
+			t.Errorf("Expected client %q in %q, got %#v", expected, record["msg"], client)
+		}
+	}
+	if found == 0 {
+		t.Errorf("Expected log records with a client field, got %q", logs.String())
+	}
+}
+
+func TestListenerLabel(t *testing.T) {
+	var logs syncBuffer
+	srv := newTestProxy(t, func(c *Config) {
+		c.Logger = slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelInfo}))
+		c.Backend = []string{startFakeBackend(t, "PONG\x00")}
+	})
+
+	socket := filepath.Join(t.TempDir(), "clamdproxy.sock")
+	listeners, err := srv.listenAll([]string{"127.0.0.1:0", "unix:" + socket})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	shutdown := make(chan struct{})
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.serveListeners(listeners, shutdown, func(conn net.Conn, listener string) {
+			srv.dispatchConnection(context.Background(), conn, listener)
+		})
+	}()
+
+	for _, listener := range listeners {
+		conn, err := net.Dial(listener.Addr().Network(), listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to connect to %s: %v", listener.Addr(), err)
+		}
+		if _, err := conn.Write([]byte("zPING\x00")); err != nil {
+			t.Fatalf("Client write failed: %v", err)
+		}
+		if _, err := io.ReadFull(conn, make([]byte, len("PONG\x00"))); err != nil {
+			t.Fatalf("Failed to read reply: %v", err)
+		}
+		_ = conn.Close()
+	}
+
+	close(shutdown)
+	srv.closeListeners(listeners)
+	if err := <-served; err != nil {
+		t.Errorf("Expected a clean stop, got %v", err)
+	}
+	if !srv.waitForConnections(2 * time.Second) {
+		t.Fatal("Connections were not closed")
+	}
+
+	// Each connection is logged and counted with the listener it arrived on
+	established := map[string]bool{}
+	scanner := bufio.NewScanner(strings.NewReader(logs.String()))
+	for scanner.Scan() {
+		var record map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("Invalid JSON log line %q: %v", scanner.Text(), err)
+		}
+		if record["msg"] == "Connection established" {
+			listener, _ := record["listener"].(string)
+			established[listener] = true
+		}
+	}
+	counts := srv.metrics.listenerConnections()
+	for _, listener := range listeners {
+		addr := listener.Addr().String()
+		if !established[addr] {
+			t.Errorf("Expected a connection logged with listener %s, got %q", addr, logs.String())
+		}
+		if got := counts[addr]; got != 1 {
+			t.Errorf("Expected 1 connection counted for %s, got %d", addr, got)
+		}
+	}
+}
+
+func TestServeHTTPServers(t *testing.T) {
+	// Addresses that were free a moment ago
+	freeAddr := func() string {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		defer listener.Close()
+		return listener.Addr().String()
+	}
+
+	c := DefaultConfig()
+	c.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	c.StatsAddr, c.MetricsAddr = freeAddr(), freeAddr()
+
+	// serve starts serving in the background; Serve is stopped and waited
+	// for when the test ends, however it ends
+	serve := func() (<-chan error, context.CancelFunc) {
+		t.Helper()
+		p, err := New(c)
+		if err != nil {
+			t.Fatalf("Failed to create proxy: %v", err)
+		}
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		served := make(chan error, 1)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			served <- p.Serve(ctx, listener)
+		}()
+		t.Cleanup(func() {
+			cancel()
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Error("Serve did not return after the context was cancelled")
+			}
+		})
+		return served, cancel
+	}
+
+	// Serving twice in a row finds the addresses released
+	for i := 0; i < 2; i++ {
+		served, cancel := serve()
+		if !waitListening(c.MetricsAddr, 5*time.Second) {
+			t.Fatalf("Metrics server not listening on %s", c.MetricsAddr)
+		}
+		resp, err := http.Get("http://" + c.MetricsAddr + "/metrics")
+		if err != nil {
+			t.Fatalf("Failed to get metrics: %v", err)
+		}
+		_ = resp.Body.Close()
+		cancel()
+		if err := <-served; err != nil {
+			t.Fatalf("Expected a clean shutdown, got %v", err)
+		}
+	}
+
+	// An address in use stops Serve
+	taken, err := net.Listen("tcp", c.MetricsAddr)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer taken.Close()
+	served, _ := serve()
+	select {
+	case err := <-served:
+		if err == nil || !strings.Contains(err.Error(), "metrics server") {
+			t.Errorf("Expected the metrics server to fail, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not fail")
+	}
+
+	// The stats server started before the failure was shut down again
+	listener, err := net.Listen("tcp", c.StatsAddr)
+	if err != nil {
+		t.Errorf("Expected %s to be released, got %v", c.StatsAddr, err)
+	} else {
+		_ = listener.Close()
+	}
+}
+
+// waitListening reports whether addr accepts connections within timeout
+func waitListening(addr string, timeout time.Duration) bool {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			_ = conn.Close()
+			return true
+		}
+	}
+	return false
+}
+
+func TestDefaultConfig(t *testing.T) {
+	c := DefaultConfig()
+	if c.Mode != "allow" || c.StreamFlushChunks != 10 || c.ClientBufferSize != defaultBufferSize {
+		t.Errorf("Expected the flag defaults, got %+v", c)
+	}
+	if !reflect.DeepEqual(c.Denylist, []string{"SHUTDOWN", "RELOAD"}) {
+		t.Errorf("Expected the default denylist, got %v", c.Denylist)
+	}
+}
+
+func TestNewInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		change   func(c *Config)
+		expected string
+	}{
+		{"Stream flush chunks", func(c *Config) { c.StreamFlushChunks = 0 }, "--stream-flush-chunks"},
+		{"Buffer size", func(c *Config) { c.BackendBufferSize = 100 }, "buffer size"},
+		{"Client flush bytes", func(c *Config) { c.ClientFlushBytes = c.ClientBufferSize + 1 }, "--client-flush-bytes"},
+		{"Access list", func(c *Config) { c.AllowCIDR = []string{"10.0.0.0/33"} }, "client access list"},
+		{"Trusted proxies", func(c *Config) { c.TrustedProxyCIDR = []string{"10.0.0.1"} }, "trusted proxy list"},
+		{"Access list behind untrusted proxies", func(c *Config) {
+			c.ProxyProtocol = true
+			c.AllowCIDR = []string{"10.0.0.0/8"}
+		}, "--trusted-proxy-cidr"},
+		{"Whitelist", func(c *Config) { c.Whitelist = filepath.Join(t.TempDir(), "missing") }, "whitelist"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := DefaultConfig()
+			tc.change(&c)
+			if _, err := New(c); err == nil || !strings.Contains(err.Error(), tc.expected) {
+				t.Errorf("Expected an error about %s, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestServe(t *testing.T) {
+	backend := startFakeClamd(t)
+
+	c := DefaultConfig()
+	c.Backend = []string{backend.addr}
+	c.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Proxies share nothing, so several can serve in one process
+	var addrs []string
+	var served []chan error
+	for i := 0; i < 2; i++ {
+		p, err := New(c)
+		if err != nil {
+			t.Fatalf("Failed to create proxy: %v", err)
+		}
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		done := make(chan error, 1)
+		go func() { done <- p.Serve(ctx, listener) }()
+		addrs = append(addrs, listener.Addr().String())
+		served = append(served, done)
+	}
+
+	for _, addr := range addrs {
+		if got := roundTrip(t, addr, []byte("zPING\x00"), nullDelimiter); got != "PONG\x00" {
+			t.Errorf("Expected %q from %s, got %q", "PONG\x00", addr, got)
+		}
+	}
+
+	cancel()
+	for _, done := range served {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Expected a clean shutdown, got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Serve did not return after the context was cancelled")
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+)
+
+// sessionState tracks a clamd IDSESSION. Inside a session clamd prefixes every
+// reply with the number of the request it answers ("<n>: ..."), counting from
+// 1. Requests the proxy answers itself never reach clamd, so from then on
+// clamd's numbering lags behind the client's and its replies are renumbered.
+type sessionState struct {
+	mu         sync.Mutex
+	active     bool
+	delim      byte        // Reply terminator, set by the IDSESSION prefix
+	clientSeq  int         // Requests the client has sent in this session
+	backendSeq int         // Requests forwarded to clamd in this session
+	renumber   map[int]int // clamd request number -> client request number, where they differ
+	partial    []byte      // Unterminated reply held back while renumbering
+
+	// The last renumbered reply, for the further records of a reply with
+	// several, like an all-match scan's
+	lastID, lastClientID int
+}
+
+// begin starts a new session whose replies are terminated by delim
+func (s *sessionState) begin(delim byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.active = true
+	s.delim = delim
+	s.clientSeq = 0
+	s.backendSeq = 0
+}
+
+// end marks the session as finished. Replies to requests still in flight
+// are renumbered as before.
+func (s *sessionState) end() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active = false
+}
+
+// forwarded records a request that was sent on to clamd
+func (s *sessionState) forwarded() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.active {
+		return
+	}
+	s.clientSeq++
+	s.backendSeq++
+	if s.clientSeq != s.backendSeq {
+		if s.renumber == nil {
+			s.renumber = make(map[int]int)
+		}
+		s.renumber[s.backendSeq] = s.clientSeq
+	}
+}
+
+// local records a request answered by the proxy itself and returns the number
+// and terminator its reply must carry. ok is false outside a session.
+func (s *sessionState) local() (id int, delim byte, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.active {
+		return 0, 0, false
+	}
+	s.clientSeq++
+	return s.clientSeq, s.delim, true
+}
+
+// rewrite renumbers the session replies in data read from clamd so they match
+// the client's request numbers. Data is returned unchanged until a request
+// has been answered locally; after that, complete replies are returned and an
+// unterminated one is held back until the rest arrives.
+func (s *sessionState) rewrite(data []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.renumber) == 0 && len(s.partial) == 0 && s.lastClientID == 0 {
+		return data
+	}
+
+	var out []byte
+	for len(data) > 0 {
+		i := bytes.IndexAny(data, "\n\x00")
+		if i < 0 {
+			s.partial = append(s.partial, data...)
+			break
+		}
+
+		record := data[:i+1]
+		if len(s.partial) > 0 {
+			record = append(s.partial, record...)
+			s.partial = nil
+		}
+		out = append(out, s.renumberRecord(record)...)
+		data = data[i+1:]
+	}
+	return out
+}
+
+// renumberRecord replaces the request number of a single terminated reply
+func (s *sessionState) renumberRecord(record []byte) []byte {
+	sep := bytes.Index(record, []byte(": "))
+	if sep <= 0 {
+		return record
+	}
+	id, err := strconv.Atoi(string(record[:sep]))
+	if err != nil {
+		return record
+	}
+	clientID, ok := s.renumber[id]
+	if ok {
+		// The entry is done with once its reply arrives; any further
+		// records of the same reply follow it directly
+		delete(s.renumber, id)
+		s.lastID, s.lastClientID = id, clientID
+	} else if id == s.lastID && s.lastClientID != 0 {
+		clientID = s.lastClientID
+	} else {
+		return record
+	}
+
+	renumbered := strconv.AppendInt(nil, int64(clientID), 10)
+	return append(renumbered, record[sep:]...)
+}
+
+// isSessionCommand reports whether cmd starts or ends a clamd session
+func isSessionCommand(cmd string) bool {
+	name := commandName(cmd)
+	return name == "IDSESSION" || name == "SESSION" || name == "END"
+}
@@ -0,0 +1,254 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSessionRewrite(t *testing.T) {
+	var s sessionState
+	s.begin(nullDelimiter)
+
+	s.forwarded() // 1 -> clamd 1
+	if id, delim, ok := s.local(); !ok || id != 2 || delim != nullDelimiter {
+		t.Fatalf("Expected local request 2 with null terminator, got %d %q %v", id, delim, ok)
+	}
+	s.forwarded() // 3 -> clamd 2
+
+	// The second reply arrives split across reads
+	var out []byte
+	out = append(out, s.rewrite([]byte("1: PONG\x002: stre"))...)
+	out = append(out, s.rewrite([]byte("am: OK\x00"))...)
+
+	expected := "1: PONG\x003: stream: OK\x00"
+	if string(out) != expected {
+		t.Errorf("Expected %q, got %q", expected, out)
+	}
+}
+
+func TestSessionRewriteForgetsAnswered(t *testing.T) {
+	var s sessionState
+	s.begin(nullDelimiter)
+
+	// A long session in which every other request is answered locally
+	for i := 1; i <= 1000; i++ {
+		s.local()
+		s.forwarded()
+		reply := strconv.Itoa(i) + ": PONG\x00"
+		expected := strconv.Itoa(2*i) + ": PONG\x00"
+		if out := s.rewrite([]byte(reply)); string(out) != expected {
+			t.Fatalf("Expected %q, got %q", expected, out)
+		}
+	}
+	if len(s.renumber) != 0 {
+		t.Errorf("Expected answered requests to be forgotten, got %d entries", len(s.renumber))
+	}
+
+	// Further records of the last reply are still renumbered
+	if out := s.rewrite([]byte("1000: stream: Other FOUND\x00")); string(out) != "2000: stream: Other FOUND\x00" {
+		t.Errorf("Expected a further record to be renumbered, got %q", out)
+	}
+}
+
+func TestSessionRewritePassthrough(t *testing.T) {
+	var s sessionState
+	s.begin(newlineDelimiter)
+	s.forwarded()
+
+	data := []byte("1: PO")
+	if out := s.rewrite(data); string(out) != "1: PO" {
+		t.Errorf("Expected data to pass through unchanged, got %q", out)
+	}
+}
+
+func TestIDSession(t *testing.T) {
+	clientSide, backendSide, _ := startProxyWithPipes(t, newTestProxy(t))
+
+	go func() {
+		_, _ = clientSide.Write([]byte("zIDSESSION\x00zPING\x00zSHUTDOWN\x00zVERSION\x00zEND\x00"))
+	}()
+
+	// Replies are collected concurrently since the proxy answers the blocked
+	// command while clamd is still reading
+	replies := make(chan string, 3)
+	go func() {
+		clientReader := bufio.NewReader(clientSide)
+		for {
+			reply, err := clientReader.ReadString(0)
+			if err != nil {
+				return
+			}
+			replies <- reply
+		}
+	}()
+
+	// Only the allowed commands reach clamd, which numbers them 1 and 2
+	backendReader := bufio.NewReader(backendSide)
+	for _, expected := range []string{"zIDSESSION", "zPING", "zVERSION", "zEND"} {
+		cmd, err := backendReader.ReadString(0)
+		if err != nil {
+			t.Fatalf("Failed to read forwarded command: %v", err)
+		}
+		if cmd != expected+"\x00" {
+			t.Fatalf("Expected %q to be forwarded, got %q", expected, cmd)
+		}
+	}
+	if _, err := backendSide.Write([]byte("1: PONG\x002: ClamAV 1.0.0\x00")); err != nil {
+		t.Fatalf("Failed to write replies: %v", err)
+	}
+
+	// The blocked command gets request number 2 from the proxy, so clamd's
+	// reply to VERSION is renumbered to 3
+	var got []string
+	for len(got) < 3 {
+		select {
+		case reply := <-replies:
+			got = append(got, reply)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timed out waiting for replies, got %q", got)
+		}
+	}
+	sort.Strings(got)
+
+	expected := []string{"1: PONG\x00", "2: UNKNOWN COMMAND\x00", "3: ClamAV 1.0.0\x00"}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("Expected reply %q, got %q", expected[i], got[i])
+		}
+	}
+}
+
+func TestSessionEndDrains(t *testing.T) {
+	clientSide, proxyClient := tcpPair(t)
+	proxyBackend, backendSide := tcpPair(t)
+
+	p := newTestProxy(t).NewClamdProxy(proxyClient, proxyBackend)
+	go func() {
+		p.Start()
+		_ = proxyClient.Close()
+	}()
+
+	// clamd answers the outstanding request only after END, then closes
+	received := make(chan []byte, 1)
+	go func() {
+		data, _ := io.ReadAll(backendSide)
+		received <- data
+		_, _ = backendSide.Write([]byte("1: PONG\x00"))
+		_ = backendSide.Close()
+	}()
+
+	// Anything after END must not be forwarded
+	if _, err := clientSide.Write([]byte("zIDSESSION\x00zPING\x00zEND\x00zVERSION\x00")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+
+	_ = clientSide.SetReadDeadline(time.Now().Add(2 * time.Second))
+	response, err := io.ReadAll(clientSide)
+	if err != nil {
+		t.Fatalf("Failed to read replies: %v", err)
+	}
+	if string(response) != "1: PONG\x00" {
+		t.Errorf("Expected the final reply %q, got %q", "1: PONG\x00", response)
+	}
+
+	if forwarded := <-received; string(forwarded) != "zIDSESSION\x00zPING\x00zEND\x00" {
+		t.Errorf("Expected the session up to END to be forwarded, got %q", forwarded)
+	}
+}
+
+func TestLegacySession(t *testing.T) {
+	srv := newTestProxy(t, func(c *Config) { c.LegacySession = true })
+	clientSide, proxyClient := tcpPair(t)
+	proxyBackend, backendSide := tcpPair(t)
+
+	p := srv.NewClamdProxy(proxyClient, proxyBackend)
+	go func() {
+		p.Start()
+		_ = proxyClient.Close()
+	}()
+
+	// Every command up to END goes to clamd over the same connection, which
+	// then answers and closes
+	received := make(chan []byte, 1)
+	go func() {
+		data, _ := io.ReadAll(backendSide)
+		received <- data
+		_, _ = backendSide.Write([]byte("PONG\nClamAV 1.0.0\n"))
+		_ = backendSide.Close()
+	}()
+
+	if _, err := clientSide.Write([]byte("nSESSION\nnPING\nnVERSION\nnEND\n")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+
+	_ = clientSide.SetReadDeadline(time.Now().Add(2 * time.Second))
+	response, err := io.ReadAll(clientSide)
+	if err != nil {
+		t.Fatalf("Failed to read replies: %v", err)
+	}
+	if string(response) != "PONG\nClamAV 1.0.0\n" {
+		t.Errorf("Expected both replies, got %q", response)
+	}
+
+	if forwarded := <-received; string(forwarded) != "nSESSION\nnPING\nnVERSION\nnEND\n" {
+		t.Errorf("Expected the whole session to be forwarded, got %q", forwarded)
+	}
+}
+
+func TestLegacySessionBlockedCommand(t *testing.T) {
+	srv := newTestProxy(t, func(c *Config) { c.LegacySession = true })
+	clientSide, backendSide, _ := startProxyWithPipes(t, srv)
+	go func() {
+		_, _ = clientSide.Write([]byte("zSESSION\x00zSHUTDOWN\x00zPING\x00"))
+	}()
+
+	// Replies are collected concurrently since the proxy answers the blocked
+	// command while clamd is still reading
+	replies := make(chan string, 2)
+	go func() {
+		clientReader := bufio.NewReader(clientSide)
+		for {
+			reply, err := clientReader.ReadString(0)
+			if err != nil {
+				return
+			}
+			replies <- reply
+		}
+	}()
+
+	backendReader := bufio.NewReader(backendSide)
+	for _, expected := range []string{"zSESSION", "zPING"} {
+		cmd, err := backendReader.ReadString(0)
+		if err != nil {
+			t.Fatalf("Failed to read forwarded command: %v", err)
+		}
+		if cmd != expected+"\x00" {
+			t.Fatalf("Expected %q to be forwarded, got %q", expected, cmd)
+		}
+	}
+	if _, err := backendSide.Write([]byte("PONG\x00")); err != nil {
+		t.Fatalf("Failed to write reply: %v", err)
+	}
+
+	// The blocked command is answered by the proxy and the session goes on
+	for _, expected := range []string{"UNKNOWN COMMAND\x00", "PONG\x00"} {
+		select {
+		case reply := <-replies:
+			if reply != expected {
+				t.Errorf("Expected reply %q, got %q", expected, reply)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timed out waiting for %q", expected)
+		}
+	}
+}
+
+func TestLegacySessionDisabled(t *testing.T) {
+	if newTestProxy(t).isCommandAllowed("SESSION") {
+		t.Error("Expected SESSION to be blocked without --legacy-session")
+	}
+}
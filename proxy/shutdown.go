@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// forcedShutdownTimeout is how long shutdown waits for connections to close
+// after cancelling them once the shutdown timeout has expired
+const forcedShutdownTimeout = 5 * time.Second
+
+// waitForConnections waits up to timeout for the connections still being
+// handled and reports whether all of them finished
+func (p *Proxy) waitForConnections(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		p.activeConns.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// shutdownHTTPServer stops one of the auxiliary HTTP servers, giving requests
+// in progress up to timeout to finish before they are cut off
+func (p *Proxy) shutdownHTTPServer(name string, server *http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		p.logger.Error("Failed to shut down HTTP server", "server", name, "error", err)
+		_ = server.Close()
+	}
+}
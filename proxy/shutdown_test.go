@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestShutdownHTTPServer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	// A request that outlives the timeout, like a long CPU profile
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})}
+
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(listener) }()
+	go func() {
+		if resp, err := http.Get("http://" + listener.Addr().String()); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+
+	begin := time.Now()
+	newTestProxy(t).shutdownHTTPServer("test", server, 50*time.Millisecond)
+	if elapsed := time.Since(begin); elapsed > 2*time.Second {
+		t.Errorf("Expected shutdown to give up after the timeout, took %v", elapsed)
+	}
+
+	select {
+	case err := <-served:
+		if !errors.Is(err, http.ErrServerClosed) {
+			t.Errorf("Expected %v, got %v", http.ErrServerClosed, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Server kept serving after shutdown")
+	}
+}
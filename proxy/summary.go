@@ -0,0 +1,41 @@
+package proxy
+
+import "time"
+
+// startSummaryLogger logs the aggregate counters at info level every interval
+// until the returned stop function is called. Stopping logs a final summary
+// and waits for it to be written.
+func (p *Proxy) startSummaryLogger(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	quit := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.logSummary()
+			case <-quit:
+				p.logSummary()
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(quit)
+		<-done
+	}
+}
+
+// logSummary logs a single line with the counters accumulated since start
+func (p *Proxy) logSummary() {
+	p.logger.Info("Summary",
+		"connections_total", p.metrics.connectionsTotal.Load(),
+		"connections_active", p.metrics.connectionsActive.Load(),
+		"instream_bytes", p.metrics.instreamClientBytes.Load(),
+		"commands_blocked", p.metrics.commandsBlocked.Load(),
+		"scans_infected", p.metrics.scansInfected.Load())
+}
@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSummaryLogger(t *testing.T) {
+	var logs syncBuffer
+	srv := newTestProxy(t, func(c *Config) {
+		c.Logger = slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	})
+
+	stop := srv.startSummaryLogger(10 * time.Millisecond)
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(logs.String(), "msg=Summary") {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected a periodic summary line")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Stopping logs a final summary and nothing after it
+	stop()
+	stopped := strings.Count(logs.String(), "msg=Summary")
+	time.Sleep(50 * time.Millisecond)
+	if got := strings.Count(logs.String(), "msg=Summary"); got != stopped {
+		t.Errorf("Expected no summaries after stop, got %d more", got-stopped)
+	}
+
+	for _, key := range []string{"connections_total=", "connections_active=", "instream_bytes=", "commands_blocked=", "scans_infected="} {
+		if !strings.Contains(logs.String(), key) {
+			t.Errorf("Expected %s in summary, got %q", key, logs.String())
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"errors"
+	"time"
+)
+
+// errStreamTooSlow is returned by handleInstream when a client uploads slower
+// than --min-stream-throughput and --abort-slow-streams is set
+var errStreamTooSlow = errors.New("INSTREAM upload too slow")
+
+// streamTooSlowResponse answers a stream aborted for its throughput
+const streamTooSlowResponse = "INSTREAM upload too slow. ERROR"
+
+// streamThroughput measures the rate at which a client uploads an INSTREAM
+// stream, one window of --stream-throughput-window at a time. It is updated
+// once per chunk, so a client dripping a single large chunk only shows up
+// once the chunk is complete; a client sending nothing at all is left to
+// --idle-timeout.
+type streamThroughput struct {
+	min    int64 // Bytes per second
+	window time.Duration
+	now    func() time.Time
+
+	start time.Time // Start of the current window
+	bytes int64     // Payload received in the current window
+}
+
+// newStreamThroughput starts measuring a stream against min bytes per second
+func newStreamThroughput(min int64, window time.Duration) *streamThroughput {
+	t := &streamThroughput{min: min, window: window, now: time.Now}
+	t.start = t.now()
+	return t
+}
+
+// add records a chunk of n bytes. Once a window has passed it returns the
+// window's rate in bytes per second and whether that is below the minimum,
+// then starts the next window.
+func (t *streamThroughput) add(n int) (rate int64, slow bool) {
+	t.bytes += int64(n)
+
+	now := t.now()
+	elapsed := now.Sub(t.start)
+	if elapsed < t.window {
+		return 0, false
+	}
+
+	rate = int64(float64(t.bytes) / elapsed.Seconds())
+	t.start, t.bytes = now, 0
+	return rate, rate < t.min
+}
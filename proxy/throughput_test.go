@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamThroughput(t *testing.T) {
+	now := time.Unix(0, 0)
+	tp := newStreamThroughput(1000, time.Second)
+	tp.now = func() time.Time { return now }
+	tp.start = now
+
+	// Within the window nothing is reported, however little arrived
+	now = now.Add(500 * time.Millisecond)
+	if rate, slow := tp.add(100); rate != 0 || slow {
+		t.Errorf("Expected no report within the window, got %d, %v", rate, slow)
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if rate, slow := tp.add(400); rate != 500 || !slow {
+		t.Errorf("Expected a slow rate of 500, got %d, %v", rate, slow)
+	}
+
+	// The next window starts from scratch
+	now = now.Add(2 * time.Second)
+	if rate, slow := tp.add(4000); rate != 2000 || slow {
+		t.Errorf("Expected a rate of 2000, got %d, %v", rate, slow)
+	}
+}
+
+func TestSlowStream(t *testing.T) {
+	limit := func(c *Config) {
+		c.MinStreamThroughput = 1 << 20
+		c.StreamThroughputWindow = 50 * time.Millisecond
+	}
+
+	drip := func(clientSide io.Writer) {
+		_, _ = clientSide.Write([]byte("zINSTREAM\x00"))
+		for i := 0; i < 3; i++ {
+			if _, err := clientSide.Write([]byte{0, 0, 0, 1, 'x'}); err != nil {
+				return
+			}
+			time.Sleep(30 * time.Millisecond)
+		}
+		_, _ = clientSide.Write([]byte{0, 0, 0, 0})
+	}
+
+	t.Run("Warn", func(t *testing.T) {
+		var logs syncBuffer
+		srv := newTestProxy(t, limit, func(c *Config) {
+			c.Logger = slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelInfo}))
+		})
+
+		clientSide, backendSide, done := startProxyWithPipes(t, srv)
+		forwarded := make(chan []byte, 1)
+		go func() {
+			data, _ := io.ReadAll(backendSide)
+			forwarded <- data
+		}()
+
+		drip(clientSide)
+		_ = clientSide.Close()
+		<-done
+
+		// The whole stream still reaches the backend
+		expected := "zINSTREAM\x00" + strings.Repeat("\x00\x00\x00\x01x", 3) + "\x00\x00\x00\x00"
+		_ = backendSide.Close()
+		if got := string(<-forwarded); got != expected {
+			t.Errorf("Expected %q forwarded, got %q", expected, got)
+		}
+		if n := strings.Count(logs.String(), "Slow INSTREAM upload"); n != 1 {
+			t.Errorf("Expected one slow upload warning, got %d in %q", n, logs.String())
+		}
+	})
+
+	t.Run("Abort", func(t *testing.T) {
+		srv := newTestProxy(t, limit, func(c *Config) { c.AbortSlowStreams = true })
+
+		clientSide, backendSide, done := startProxyWithPipes(t, srv)
+		go func() { _, _ = io.Copy(io.Discard, backendSide) }()
+		go drip(clientSide)
+
+		expected := streamTooSlowResponse + "\x00"
+		response := make([]byte, len(expected))
+		if _, err := io.ReadFull(clientSide, response); err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		if string(response) != expected {
+			t.Errorf("Expected %q, got %q", expected, response)
+		}
+
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("Slow stream was not aborted")
+		}
+	})
+}
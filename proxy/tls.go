@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// loadTLSConfig builds the client-facing TLS configuration from the CLI flags.
+// It returns nil if no certificate is configured.
+func (p *Proxy) loadTLSConfig() (*tls.Config, error) {
+	if p.cfg.TLSCert == "" && p.cfg.TLSKey == "" {
+		if len(p.cfg.SNIBackend) > 0 {
+			return nil, errors.New("--sni-backend requires --tls-cert and --tls-key")
+		}
+		if p.cfg.ClientCA != "" {
+			return nil, errors.New("--client-ca requires --tls-cert and --tls-key")
+		}
+		return nil, nil
+	}
+	if p.cfg.TLSCert == "" || p.cfg.TLSKey == "" {
+		return nil, errors.New("both --tls-cert and --tls-key must be set")
+	}
+
+	cert, err := tls.LoadX509KeyPair(p.cfg.TLSCert, p.cfg.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS key pair: %w", err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if p.cfg.ClientCA != "" {
+		pool, err := loadCertPool(p.cfg.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	p.configureSNIRouting(p.cfg.SNIBackend)
+	return config, nil
+}
+
+// loadCertPool reads the PEM encoded CA certificates used to verify clients
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in client CA file %s", path)
+	}
+	return pool, nil
+}
+
+// clientCertName returns the common name of the certificate a TLS client
+// authenticated with, or "" if it presented none
+func clientCertName(state tls.ConnectionState) string {
+	if len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return state.PeerCertificates[0].Subject.CommonName
+}
+
+// configureSNIRouting installs the SNI routing table, see connTLSConfig
+func (p *Proxy) configureSNIRouting(routes map[string]string) {
+	p.sniBackends = make(map[string]string, len(routes))
+	for host, addr := range routes {
+		p.sniBackends[strings.ToLower(host)] = addr
+	}
+}
+
+// connTLSConfig returns the TLS configuration for one client connection. With
+// SNI routing it is a copy of tlsConfig whose GetConfigForClient hook looks up
+// the SNI hostname of the ClientHello and stores the backend routed to it in
+// backend, or refuses the handshake for an unknown hostname with
+// --sni-reject-unknown.
+func (p *Proxy) connTLSConfig(backend *string) *tls.Config {
+	if len(p.sniBackends) == 0 && !p.cfg.SNIRejectUnknown {
+		return p.tlsConfig
+	}
+
+	config := p.tlsConfig.Clone()
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		addr, ok := p.backendForSNI(hello.ServerName)
+		if !ok && p.cfg.SNIRejectUnknown {
+			return nil, fmt.Errorf("no backend configured for SNI %q", hello.ServerName)
+		}
+		*backend = addr
+		return nil, nil // Keep using this config
+	}
+	return config
+}
+
+// backendForSNI returns the backend address routed to the given SNI hostname
+func (p *Proxy) backendForSNI(serverName string) (string, bool) {
+	if serverName == "" {
+		return "", false
+	}
+	addr, ok := p.sniBackends[strings.ToLower(serverName)]
+	return addr, ok
+}
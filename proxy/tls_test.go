@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackendForSNI(t *testing.T) {
+	srv := newTestProxy(t)
+	srv.configureSNIRouting(map[string]string{
+		"Tenant-A.example.com": "10.0.0.1:3310",
+		"tenant-b.example.com": "10.0.0.2:3310",
+	})
+
+	tests := []struct {
+		serverName string
+		expected   string
+		found      bool
+	}{
+		{"tenant-a.example.com", "10.0.0.1:3310", true},
+		{"TENANT-B.example.com", "10.0.0.2:3310", true},
+		{"unknown.example.com", "", false},
+		{"", "", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.serverName, func(t *testing.T) {
+			addr, ok := srv.backendForSNI(tc.serverName)
+			if ok != tc.found || addr != tc.expected {
+				t.Errorf("Expected (%q, %v), got (%q, %v)", tc.expected, tc.found, addr, ok)
+			}
+		})
+	}
+}
+
+func TestConnTLSConfig(t *testing.T) {
+	srv := newTestProxy(t)
+	srv.tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+
+	var backend string
+	if config := srv.connTLSConfig(&backend); config != srv.tlsConfig {
+		t.Error("Expected the shared config without SNI routing")
+	}
+
+	routes := map[string]string{"known.example.com": "10.0.0.1:3310"}
+	tests := []struct {
+		name          string
+		rejectUnknown bool
+		serverName    string
+		expected      string
+		rejected      bool
+	}{
+		{"Known SNI", false, "known.example.com", "10.0.0.1:3310", false},
+		{"Unknown SNI falls back", false, "other.example.com", "", false},
+		{"Known SNI with rejection", true, "KNOWN.example.com", "10.0.0.1:3310", false},
+		{"Unknown SNI rejected", true, "other.example.com", "", true},
+		{"Missing SNI rejected", true, "", "", true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			srv.cfg.SNIRejectUnknown = tc.rejectUnknown
+			srv.configureSNIRouting(routes)
+
+			// The hook captures the backend during the handshake
+			var backend string
+			config := srv.connTLSConfig(&backend)
+			if config == srv.tlsConfig || srv.tlsConfig.GetConfigForClient != nil {
+				t.Fatal("Expected a per-connection copy of the config")
+			}
+			_, err := config.GetConfigForClient(&tls.ClientHelloInfo{ServerName: tc.serverName})
+			if (err != nil) != tc.rejected {
+				t.Fatalf("Expected rejected=%v, got %v", tc.rejected, err)
+			}
+			if backend != tc.expected {
+				t.Errorf("Expected backend %q, got %q", tc.expected, backend)
+			}
+		})
+	}
+}
+
+// testCert is a generated certificate with its key
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCert creates a certificate for cn, signed by parent or self-signed
+// if parent is nil
+func newTestCert(t *testing.T, cn string, isCA bool, parent *testCert) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		DNSNames:              []string{cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+	}
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// writePEM writes the certificate and its key to PEM files in dir and
+// returns their paths
+func (c *testCert) writePEM(t *testing.T, dir, name string) (certFile, keyFile string) {
+	t.Helper()
+
+	certFile = filepath.Join(dir, name+".crt")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0o600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	keyFile = filepath.Join(dir, name+".key")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestClientCertificateAuth(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "Test CA", true, nil)
+	server := newTestCert(t, "clamdproxy.example.com", false, ca)
+	trusted := newTestCert(t, "scanner-1", false, ca)
+	untrusted := newTestCert(t, "intruder", false, nil)
+
+	caFile, _ := ca.writePEM(t, dir, "ca")
+	serverCert, serverKey := server.writePEM(t, dir, "server")
+
+	srv := newTestProxy(t, func(c *Config) {
+		c.TLSCert, c.TLSKey, c.ClientCA = serverCert, serverKey, caFile
+	})
+	config := srv.tlsConfig
+	if config.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Fatalf("Expected client certificates to be required, got %v", config.ClientAuth)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	tests := []struct {
+		name   string
+		certs  []tls.Certificate
+		wantCN string
+	}{
+		{"No certificate", nil, ""},
+		{"Untrusted certificate", []tls.Certificate{untrusted.tlsCertificate()}, ""},
+		{"Trusted certificate", []tls.Certificate{trusted.tlsCertificate()}, "scanner-1"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			clientSide, serverSide := net.Pipe()
+			defer clientSide.Close()
+			defer serverSide.Close()
+
+			client := tls.Client(clientSide, &tls.Config{
+				ServerName:   "clamdproxy.example.com",
+				RootCAs:      roots,
+				Certificates: tc.certs,
+				MinVersion:   tls.VersionTLS12,
+			})
+			go func() {
+				// The client learns about a rejected certificate only
+				// when reading, so drive the connection until it fails
+				if err := client.Handshake(); err == nil {
+					_, _ = client.Read(make([]byte, 1))
+				}
+				_ = client.Close()
+			}()
+
+			conn := tls.Server(serverSide, config)
+			err := conn.Handshake()
+			if tc.wantCN == "" {
+				if err == nil {
+					t.Fatal("Expected the handshake to be rejected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected the handshake to succeed, got %v", err)
+			}
+			if cn := clientCertName(conn.ConnectionState()); cn != tc.wantCN {
+				t.Errorf("Expected client CN %q, got %q", tc.wantCN, cn)
+			}
+		})
+	}
+}
+
+func TestClientCARequiresTLS(t *testing.T) {
+	srv := newTestProxy(t)
+	srv.cfg.ClientCA = "ca.pem"
+
+	if _, err := srv.loadTLSConfig(); err == nil {
+		t.Error("Expected --client-ca without a certificate to be rejected")
+	}
+}
@@ -0,0 +1,402 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracing export tuning
+const (
+	traceExportInterval = 5 * time.Second  // Pending spans are sent at least this often
+	traceBatchSize      = 512              // Send early once this many spans are pending
+	traceMaxPending     = 4096             // Spans beyond this are dropped while the collector is unreachable
+	traceExportTimeout  = 10 * time.Second // Bounds a single export request
+)
+
+// OTLP span kinds and status codes
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+
+	spanStatusError = 2
+)
+
+// span is a single timed operation of a trace. All methods are safe to call
+// on a nil span and from several goroutines.
+type span struct {
+	tracer   *spanTracer // Exports the span once finished
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte // Zero for the root span of a trace
+	name     string
+	kind     int
+	start    time.Time
+
+	mu       sync.Mutex
+	end      time.Time
+	attrs    []spanAttr
+	errorMsg string
+	finished bool
+}
+
+// spanAttr is a span attribute with a string, int64 or bool value
+type spanAttr struct {
+	key   string
+	value any
+}
+
+// startSpan starts a span named name as a child of parent, or as the root of
+// a new trace if parent is nil. It returns nil on a nil tracer, when tracing
+// is disabled.
+func (t *spanTracer) startSpan(name string, parent *span) *span {
+	if t == nil {
+		return nil
+	}
+
+	s := &span{tracer: t, name: name, kind: spanKindInternal, start: time.Now()}
+	if parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		s.kind = spanKindServer
+		_, _ = rand.Read(s.traceID[:])
+	}
+	_, _ = rand.Read(s.spanID[:])
+	return s
+}
+
+// setAttr records an attribute; value must be a string, int, int64 or bool.
+// Attributes set after finish are ignored.
+func (s *span) setAttr(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.finished {
+		s.attrs = append(s.attrs, spanAttr{key, value})
+	}
+}
+
+// setError marks the span as failed with the given message. The first
+// error recorded is kept, as it is usually the cause of any later ones.
+func (s *span) setError(msg string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.finished && s.errorMsg == "" {
+		s.errorMsg = msg
+	}
+}
+
+// finish ends the span and queues it for export. Only the first call counts.
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.finished {
+		s.mu.Unlock()
+		return
+	}
+	s.finished = true
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	s.tracer.enqueue(s)
+}
+
+// spanQueue holds the scan spans of a connection in the order their verdicts
+// are expected, mirroring ClamdProxy.pendingScans
+type spanQueue struct {
+	mu    sync.Mutex
+	spans []*span
+}
+
+// push appends a span; nil spans are not queued, so the queue stays empty
+// when tracing is disabled
+func (q *spanQueue) push(s *span) {
+	if s == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.spans = append(q.spans, s)
+}
+
+// pop removes and returns the oldest span, or nil if there is none
+func (q *spanQueue) pop() *span {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.spans) == 0 {
+		return nil
+	}
+	s := q.spans[0]
+	q.spans = q.spans[1:]
+	return s
+}
+
+// finishAll ends the spans of scans that never got a verdict
+func (q *spanQueue) finishAll(msg string) {
+	for s := q.pop(); s != nil; s = q.pop() {
+		s.setError(msg)
+		s.finish()
+	}
+}
+
+// spanTracer batches finished spans and sends them to an OpenTelemetry
+// collector using OTLP over HTTP with JSON encoding
+type spanTracer struct {
+	url     string
+	client  *http.Client
+	version string // Reported as the service version
+	logger  *slog.Logger
+
+	mu      sync.Mutex
+	pending []*span
+	dropped int
+
+	wake chan struct{} // Signals a full batch to run
+	stop chan struct{} // Closed by shutdown
+	done chan struct{} // Closed once run has exported the last batch
+}
+
+// newSpanTracer returns a tracer exporting to the OTLP/HTTP collector at
+// endpoint, e.g. http://localhost:4318. Spans are posted to its /v1/traces
+// path, reporting version as the service version. Call run to start
+// exporting.
+func newSpanTracer(endpoint, version string, logger *slog.Logger) (*spanTracer, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q, expected an http or https URL", endpoint)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/v1/traces"
+
+	return &spanTracer{
+		url:     u.String(),
+		client:  &http.Client{Timeout: traceExportTimeout},
+		version: version,
+		logger:  logger,
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// enqueue adds a finished span to the next batch
+func (t *spanTracer) enqueue(s *span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.pending) >= traceMaxPending {
+		t.dropped++
+		return
+	}
+	t.pending = append(t.pending, s)
+	if len(t.pending) == traceBatchSize {
+		select {
+		case t.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run exports pending spans periodically until shutdown
+func (t *spanTracer) run() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(traceExportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.wake:
+		case <-t.stop:
+			t.exportPending()
+			return
+		}
+		t.exportPending()
+	}
+}
+
+// shutdown stops the export loop after sending the spans still pending,
+// waiting at most until ctx is done
+func (t *spanTracer) shutdown(ctx context.Context) error {
+	close(t.stop)
+	select {
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// exportPending sends the spans collected so far in one request
+func (t *spanTracer) exportPending() {
+	t.mu.Lock()
+	batch, dropped := t.pending, t.dropped
+	t.pending, t.dropped = nil, 0
+	t.mu.Unlock()
+
+	if dropped > 0 {
+		t.logger.Warn("Dropped trace spans, collector not keeping up", "dropped", dropped)
+	}
+	if len(batch) == 0 {
+		return
+	}
+
+	if err := t.export(batch); err != nil {
+		t.logger.Warn("Failed to export trace spans", "endpoint", t.url, "spans", len(batch), "error", err)
+	}
+}
+
+// export posts a batch of spans to the collector
+func (t *spanTracer) export(batch []*span) error {
+	body, err := json.Marshal(otlpRequest(batch, t.version))
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.client.Post(t.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return errors.New("collector responded " + resp.Status)
+	}
+	return nil
+}
+
+// OTLP/HTTP JSON request body, see
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+type (
+	otlpTraces struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name    string `json:"name"`
+		Version string `json:"version,omitempty"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              int            `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Status            *otlpStatus    `json:"status,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string       `json:"key"`
+		Value otlpAnyValue `json:"value"`
+	}
+	otlpAnyValue struct {
+		StringValue *string `json:"stringValue,omitempty"`
+		IntValue    *string `json:"intValue,omitempty"` // 64-bit integers are encoded as strings
+		BoolValue   *bool   `json:"boolValue,omitempty"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+// otlpRequest converts finished spans to an OTLP export request from
+// version v of the service
+func otlpRequest(batch []*span, v string) otlpTraces {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		spans = append(spans, s.otlp())
+	}
+
+	return otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{
+			otlpAttr("service.name", "clamdproxy"),
+			otlpAttr("service.version", v),
+		}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/miklosn/clamdproxy", Version: v},
+			Spans: spans,
+		}},
+	}}}
+}
+
+// otlp converts a finished span to its OTLP representation
+func (s *span) otlp() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+	}
+	if s.parentID != [8]byte{} {
+		out.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	for _, a := range s.attrs {
+		out.Attributes = append(out.Attributes, otlpAttr(a.key, a.value))
+	}
+	if s.errorMsg != "" {
+		out.Status = &otlpStatus{Code: spanStatusError, Message: s.errorMsg}
+	}
+	return out
+}
+
+// otlpAttr encodes a span attribute; unsupported value types are formatted
+// as strings
+func otlpAttr(key string, value any) otlpKeyValue {
+	var v otlpAnyValue
+	switch value := value.(type) {
+	case string:
+		v.StringValue = &value
+	case int:
+		s := strconv.Itoa(value)
+		v.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(value, 10)
+		v.IntValue = &s
+	case bool:
+		v.BoolValue = &value
+	default:
+		s := fmt.Sprint(value)
+		v.StringValue = &s
+	}
+	return otlpKeyValue{Key: key, Value: v}
+}
@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTracingDisabled(t *testing.T) {
+	srv := newTestProxy(t)
+	if srv.tracer != nil {
+		t.Fatal("Expected tracing to be disabled by default")
+	}
+
+	s := srv.tracer.startSpan("test", nil)
+	if s != nil {
+		t.Fatalf("Expected a nil span, got %+v", s)
+	}
+
+	// Every span method must be safe on the nil span
+	s.setAttr("key", "value")
+	s.setError("failed")
+	s.finish()
+	finishScanSpan(s, verdictClean, "stream: OK")
+
+	var q spanQueue
+	q.push(s)
+	if got := q.pop(); got != nil {
+		t.Errorf("Expected an empty queue, got %+v", got)
+	}
+}
+
+func TestNewSpanTracer(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		expected string
+	}{
+		{"http://localhost:4318", "http://localhost:4318/v1/traces"},
+		{"http://localhost:4318/", "http://localhost:4318/v1/traces"},
+		{"https://collector.example.com/otlp", "https://collector.example.com/otlp/v1/traces"},
+	}
+	for _, test := range tests {
+		tr, err := newSpanTracer(test.endpoint, "test", slog.Default())
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", test.endpoint, err)
+			continue
+		}
+		if tr.url != test.expected {
+			t.Errorf("Expected %q, got %q", test.expected, tr.url)
+		}
+	}
+
+	for _, endpoint := range []string{"localhost:4318", "grpc://localhost:4317", "http://"} {
+		if _, err := newSpanTracer(endpoint, "test", slog.Default()); err == nil {
+			t.Errorf("Expected an error for %q", endpoint)
+		}
+	}
+}
+
+// collectTraces starts a fake OTLP collector and returns a test Proxy
+// tracing to it. The returned function shuts the tracer down and returns
+// what was received.
+func collectTraces(t *testing.T) (*Proxy, func() []otlpSpan) {
+	t.Helper()
+
+	var mu sync.Mutex
+	var spans []otlpSpan
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Unexpected export request to %s with type %q", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		var req otlpTraces
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("Failed to decode export request: %v", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}))
+	t.Cleanup(collector.Close)
+
+	srv := newTestProxy(t, func(c *Config) { c.OtelEndpoint = collector.URL })
+	return srv, func() []otlpSpan {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.tracer.shutdown(ctx); err != nil {
+			t.Fatalf("Failed to shut down tracer: %v", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return spans
+	}
+}
+
+// spanAttrs returns the attributes of an exported span by key
+func spanAttrs(s otlpSpan) map[string]string {
+	attrs := make(map[string]string, len(s.Attributes))
+	for _, a := range s.Attributes {
+		switch {
+		case a.Value.StringValue != nil:
+			attrs[a.Key] = *a.Value.StringValue
+		case a.Value.IntValue != nil:
+			attrs[a.Key] = *a.Value.IntValue
+		}
+	}
+	return attrs
+}
+
+func TestTracerExport(t *testing.T) {
+	srv, collected := collectTraces(t)
+
+	root := srv.tracer.startSpan("root", nil)
+	root.setAttr("client.address", "192.0.2.1:1234")
+	child := srv.tracer.startSpan("child", root)
+	child.setAttr("count", 3)
+	child.setError("failed")
+	child.finish()
+	child.setAttr("late", true) // Ignored after finish
+	root.finish()
+
+	spans := collected()
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %d", len(spans))
+	}
+	gotChild, gotRoot := spans[0], spans[1]
+
+	if gotRoot.TraceID != gotChild.TraceID || len(gotRoot.TraceID) != 32 {
+		t.Errorf("Expected a shared 16 byte trace ID, got %q and %q", gotRoot.TraceID, gotChild.TraceID)
+	}
+	if gotRoot.ParentSpanID != "" {
+		t.Errorf("Expected no parent for the root span, got %q", gotRoot.ParentSpanID)
+	}
+	if gotChild.ParentSpanID != gotRoot.SpanID {
+		t.Errorf("Expected parent %q, got %q", gotRoot.SpanID, gotChild.ParentSpanID)
+	}
+	if gotRoot.Kind != spanKindServer || gotChild.Kind != spanKindInternal {
+		t.Errorf("Expected kinds %d and %d, got %d and %d", spanKindServer, spanKindInternal, gotRoot.Kind, gotChild.Kind)
+	}
+	if attrs := spanAttrs(gotRoot); attrs["client.address"] != "192.0.2.1:1234" {
+		t.Errorf("Expected client address attribute, got %v", attrs)
+	}
+	if attrs := spanAttrs(gotChild); attrs["count"] != "3" || len(attrs) != 1 {
+		t.Errorf("Expected only count=3, got %v", attrs)
+	}
+	if gotChild.Status == nil || gotChild.Status.Code != spanStatusError || gotChild.Status.Message != "failed" {
+		t.Errorf("Expected error status, got %+v", gotChild.Status)
+	}
+}
+
+func TestInstreamSpan(t *testing.T) {
+	srv, collected := collectTraces(t)
+	clientSide, backendSide, done := startProxyWithPipes(t, srv)
+
+	go func() {
+		_, _ = clientSide.Write([]byte("zINSTREAM\x00"))
+		_, _ = clientSide.Write(instreamPayload(10, 4))
+	}()
+
+	// Command, three chunks of 4, 4 and 2 bytes and the terminating chunk
+	forwarded := make([]byte, len("zINSTREAM\x00")+len(instreamPayload(10, 4)))
+	if _, err := io.ReadFull(backendSide, forwarded); err != nil {
+		t.Fatalf("Failed to read forwarded stream: %v", err)
+	}
+	verdict := "stream: Eicar-Test-Signature FOUND\x00"
+	if _, err := backendSide.Write([]byte(verdict)); err != nil {
+		t.Fatalf("Failed to send verdict: %v", err)
+	}
+	response := make([]byte, len(verdict))
+	if _, err := io.ReadFull(clientSide, response); err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	_ = backendSide.Close()
+	<-done
+
+	spans := collected()
+	if len(spans) != 1 {
+		t.Fatalf("Expected 1 span, got %d", len(spans))
+	}
+	if spans[0].Name != "clamd.instream" {
+		t.Errorf("Expected span clamd.instream, got %q", spans[0].Name)
+	}
+	expected := map[string]string{
+		"clamdproxy.instream.chunks": "3",
+		"clamdproxy.instream.bytes":  "10",
+		"clamdproxy.verdict":         "FOUND",
+		"clamdproxy.signature":       "Eicar-Test-Signature",
+	}
+	attrs := spanAttrs(spans[0])
+	for key, value := range expected {
+		if attrs[key] != value {
+			t.Errorf("Expected %s=%q, got %q", key, value, attrs[key])
+		}
+	}
+}
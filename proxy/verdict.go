@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"bytes"
+	"strings"
+)
+
+// verdict is the outcome of a scan as reported by clamd
+type verdict int
+
+const (
+	verdictNone     verdict = iota // Not a scan result (PONG, VERSION, ...)
+	verdictClean                   // "stream: OK"
+	verdictInfected                // "stream: <signature> FOUND"
+	verdictError                   // "<reason> ERROR"
+)
+
+func (v verdict) String() string {
+	switch v {
+	case verdictClean:
+		return "OK"
+	case verdictInfected:
+		return "FOUND"
+	case verdictError:
+		return "ERROR"
+	default:
+		return "NONE"
+	}
+}
+
+// classifyResponse determines the scan verdict carried by a single clamd
+// response record. Session responses prefixed with "<id>: " are handled the
+// same way since only the suffix is inspected.
+func classifyResponse(line string) verdict {
+	line = strings.TrimSpace(line)
+	switch {
+	case strings.HasSuffix(line, " FOUND"):
+		return verdictInfected
+	case strings.HasSuffix(line, ": OK"):
+		return verdictClean
+	case strings.HasSuffix(line, " ERROR"):
+		return verdictError
+	default:
+		return verdictNone
+	}
+}
+
+// scanSignature extracts the signature name from a FOUND response such as
+// "stream: Eicar-Test-Signature FOUND" or "1: stream: Eicar-Test-Signature FOUND"
+func scanSignature(line string) string {
+	line = strings.TrimSuffix(strings.TrimSpace(line), " FOUND")
+	if i := strings.LastIndex(line, ": "); i >= 0 {
+		line = line[i+2:]
+	}
+	return line
+}
+
+// maxResponseRecord bounds how much of an unterminated response record is
+// buffered. Verdicts are short, so anything longer is not worth classifying.
+const maxResponseRecord = 4096
+
+// responseAssembler reassembles newline or null terminated backend response
+// records that may arrive split across several reads
+type responseAssembler struct {
+	partial    []byte // Start of a record whose terminator hasn't arrived yet
+	discarding bool   // Current record exceeded maxResponseRecord and is skipped
+}
+
+// feed consumes data read from the backend and calls emit for every complete
+// record, without its terminator. The record passed to emit is only valid
+// for the duration of the call.
+func (a *responseAssembler) feed(data []byte, emit func(record []byte)) {
+	for len(data) > 0 {
+		i := bytes.IndexAny(data, "\n\x00")
+		if i < 0 {
+			if !a.discarding && len(a.partial)+len(data) <= maxResponseRecord {
+				a.partial = append(a.partial, data...)
+			} else {
+				a.partial = a.partial[:0]
+				a.discarding = true
+			}
+			return
+		}
+
+		record := data[:i]
+		if !a.discarding && len(a.partial)+len(record) <= maxResponseRecord {
+			if len(a.partial) > 0 {
+				a.partial = append(a.partial, record...)
+				record = a.partial
+			}
+			emit(record)
+		}
+		a.partial = a.partial[:0]
+		a.discarding = false
+		data = data[i+1:]
+	}
+}
+
+// observeResponse inspects data read from the backend, logs the scan verdicts
+// it contains and counts them. Records may be newline (classic and n-prefixed) or
+// null (z-prefixed) terminated and split across reads. Only one verdict is
+// counted per forwarded scan, so the multiple FOUND lines of an all-match
+// response count once.
+func (p *ClamdProxy) observeResponse(data []byte) {
+	p.responses.feed(data, func(record []byte) {
+		if p.pendingScans.Load() <= 0 {
+			return
+		}
+		v := classifyResponse(string(record))
+		if v == verdictNone {
+			return
+		}
+		p.pendingScans.Add(-1)
+
+		attrs := []any{"conn_id", p.connID, "client", p.client.RemoteAddr().String(), "result", v.String()}
+		if v == verdictInfected {
+			attrs = append(attrs, "signature", scanSignature(string(record)))
+		}
+		p.server.logger.Info("Scan result", attrs...)
+		if s := p.scanSpans.pop(); s != nil {
+			finishScanSpan(s, v, string(record))
+		}
+
+		switch v {
+		case verdictClean:
+			p.server.metrics.scansClean.Add(1)
+		case verdictInfected:
+			p.server.metrics.scansInfected.Add(1)
+		case verdictError:
+			p.server.metrics.scansError.Add(1)
+		}
+	})
+}
+
+// finishScanSpan records the verdict of a scan on its span and ends it
+func finishScanSpan(s *span, v verdict, reply string) {
+	if s == nil {
+		return
+	}
+	s.setAttr("clamdproxy.verdict", v.String())
+	switch v {
+	case verdictInfected:
+		s.setAttr("clamdproxy.signature", scanSignature(reply))
+	case verdictError:
+		s.setError(strings.TrimSpace(reply))
+	}
+	s.finish()
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"bytes"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestClassifyResponse(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected verdict
+	}{
+		{"stream: OK", verdictClean},
+		{"stream: OK\n", verdictClean},
+		{"1: stream: OK", verdictClean},
+		{"stream: Eicar-Test-Signature FOUND", verdictInfected},
+		{"2: stream: Eicar-Test-Signature FOUND", verdictInfected},
+		{"INSTREAM size limit exceeded. ERROR", verdictError},
+		{"PONG", verdictNone},
+		{"ClamAV 1.0.0/27000/Mon Jan 1 00:00:00 2024", verdictNone},
+		{"", verdictNone},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.line, func(t *testing.T) {
+			if got := classifyResponse(tc.line); got != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestObserveResponse(t *testing.T) {
+	tests := []struct {
+		name                     string
+		pending                  int32
+		response                 string
+		clean, infected, errored int64
+	}{
+		{"Classic clean", 1, "stream: OK\n", 1, 0, 0},
+		{"Z-protocol infected", 1, "stream: Eicar-Test-Signature FOUND\x00", 0, 1, 0},
+		{"Error", 1, "INSTREAM size limit exceeded. ERROR\n", 0, 0, 1},
+		{"All-match counted once", 1, "stream: Sig1 FOUND\nstream: Sig2 FOUND\n", 0, 1, 0},
+		{"Pipelined scans", 2, "1: stream: OK\x002: stream: Sig FOUND\x00", 1, 1, 0},
+		{"No pending scan", 0, "stream: OK\n", 0, 0, 0},
+		{"Not a verdict", 1, "PONG\n", 0, 0, 0},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := newTestProxy(t)
+			p := &ClamdProxy{server: srv, client: &mockConn{}}
+			p.pendingScans.Store(tc.pending)
+			p.observeResponse([]byte(tc.response))
+
+			if got := srv.metrics.scansClean.Load(); got != tc.clean {
+				t.Errorf("Expected %d clean, got %d", tc.clean, got)
+			}
+			if got := srv.metrics.scansInfected.Load(); got != tc.infected {
+				t.Errorf("Expected %d infected, got %d", tc.infected, got)
+			}
+			if got := srv.metrics.scansError.Load(); got != tc.errored {
+				t.Errorf("Expected %d errors, got %d", tc.errored, got)
+			}
+		})
+	}
+}
+
+func TestResponseAssembler(t *testing.T) {
+	tests := []struct {
+		name     string
+		reads    []string
+		expected []string
+	}{
+		{"Single read", []string{"stream: OK\n"}, []string{"stream: OK"}},
+		{"Split verdict", []string{"stream: Eicar-Te", "st-Signature FOUND\x00"}, []string{"stream: Eicar-Test-Signature FOUND"}},
+		{"Split across three reads", []string{"str", "eam: ", "OK\n"}, []string{"stream: OK"}},
+		{"Several records in one read", []string{"1: PONG\x002: stream: OK\x00"}, []string{"1: PONG", "2: stream: OK"}},
+		{"Terminator on its own", []string{"PONG", "\n"}, []string{"PONG"}},
+		{"Unterminated", []string{"stream: OK"}, nil},
+		{"Oversized record skipped", []string{strings.Repeat("x", maxResponseRecord), "x\nPONG\n"}, []string{"PONG"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var a responseAssembler
+			var got []string
+			for _, read := range tc.reads {
+				a.feed([]byte(read), func(record []byte) {
+					got = append(got, string(record))
+				})
+			}
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestObserveResponseSplitVerdict(t *testing.T) {
+	srv := newTestProxy(t)
+	p := &ClamdProxy{server: srv, client: &mockConn{}}
+	p.pendingScans.Store(1)
+	p.observeResponse([]byte("stream: Eicar-Test-Sig"))
+	p.observeResponse([]byte("nature FOUND\n"))
+
+	if got := srv.metrics.scansInfected.Load(); got != 1 {
+		t.Errorf("Expected 1 infected scan, got %d", got)
+	}
+}
+
+func TestScanSignature(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected string
+	}{
+		{"stream: Eicar-Test-Signature FOUND", "Eicar-Test-Signature"},
+		{"1: stream: Win.Test.EICAR_HDB-1 FOUND", "Win.Test.EICAR_HDB-1"},
+		{"stream: Eicar-Test-Signature FOUND\n", "Eicar-Test-Signature"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.line, func(t *testing.T) {
+			if got := scanSignature(tc.line); got != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestObserveResponseLogsVerdict(t *testing.T) {
+	var buf bytes.Buffer
+	srv := newTestProxy(t, func(c *Config) {
+		c.Logger = slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	})
+
+	p := &ClamdProxy{server: srv, client: &mockConn{}}
+	p.pendingScans.Store(1)
+	p.observeResponse([]byte("stream: Eicar-Test-Signature FOUND\n"))
+
+	output := buf.String()
+	if !strings.Contains(output, "result=FOUND") || !strings.Contains(output, "signature=Eicar-Test-Signature") {
+		t.Errorf("Expected verdict log with signature, got %q", output)
+	}
+}
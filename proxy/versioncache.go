@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// versionFetchTimeout bounds fetching the VERSION reply from one backend
+const versionFetchTimeout = 5 * time.Second
+
+// versionCache holds the VERSION reply of a set of backends for
+// --version-cache-ttl, so frequent version polls are answered without a
+// backend connection
+type versionCache struct {
+	fetch  func() (string, error)
+	now    func() time.Time
+	logger *slog.Logger
+
+	mu         sync.Mutex
+	reply      string    // Cached reply without its terminator, empty until fetched
+	fetched    time.Time // When reply was fetched
+	refreshing bool      // A background refresh is running
+}
+
+// versionCacheFor returns the shared cache for the given backends. Clients
+// routed to different backends by SNI may see different versions, so each
+// backend list has its own.
+func (p *Proxy) versionCacheFor(addrs []string) *versionCache {
+	key := strings.Join(addrs, ",")
+
+	p.versionCachesMu.Lock()
+	defer p.versionCachesMu.Unlock()
+
+	cache, ok := p.versionCaches[key]
+	if !ok {
+		cache = &versionCache{
+			fetch:  func() (string, error) { return fetchVersion(addrs) },
+			now:    time.Now,
+			logger: p.logger,
+		}
+		p.versionCaches[key] = cache
+	}
+	return cache
+}
+
+// get returns the cached VERSION reply. The first call fetches it from the
+// backend; once it is older than ttl it is still returned while a background
+// refresh replaces it. ok is false if there is nothing cached and the fetch
+// failed, in which case the command should be forwarded as usual.
+func (c *versionCache) get(ttl time.Duration) (reply string, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.reply == "" {
+		reply, err := c.fetch()
+		if err != nil {
+			c.logger.Debug("Failed to fetch backend version", "error", err)
+			return "", false
+		}
+		c.reply, c.fetched = reply, c.now()
+		return reply, true
+	}
+
+	if c.now().Sub(c.fetched) >= ttl && !c.refreshing {
+		c.refreshing = true
+		go c.refresh()
+	}
+	return c.reply, true
+}
+
+// refresh replaces the cached reply with a freshly fetched one. On failure
+// the stale reply is kept and the next get tries again.
+func (c *versionCache) refresh() {
+	reply, err := c.fetch()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.refreshing = false
+	if err != nil {
+		c.logger.Debug("Failed to refresh backend version", "error", err)
+		return
+	}
+	c.reply, c.fetched = reply, c.now()
+}
+
+// fetchVersion asks the given backends for their version, in order, and
+// returns the first reply
+func fetchVersion(addrs []string) (string, error) {
+	err := errors.New("no backend configured")
+	for _, addr := range addrs {
+		var reply string
+		if reply, err = queryVersion(addr, versionFetchTimeout); err == nil {
+			return reply, nil
+		}
+	}
+	return "", err
+}
+
+// queryVersion sends zVERSION to the backend at addr and returns its reply
+// without the terminator
+func queryVersion(addr string, timeout time.Duration) (string, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return "", err
+	}
+	if _, err := conn.Write([]byte("zVERSION\x00")); err != nil {
+		return "", fmt.Errorf("failed to send VERSION: %w", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(nullDelimiter)
+	if err != nil {
+		return "", fmt.Errorf("failed to read VERSION reply: %w", err)
+	}
+	reply = strings.TrimSuffix(reply, "\x00")
+	if reply == "" || classifyResponse(reply) == verdictError {
+		return "", fmt.Errorf("unexpected VERSION reply %q", reply)
+	}
+	return reply, nil
+}
+
+// isVersionCommand reports whether cmd is VERSION, without arguments, in any
+// of its protocol variants
+func isVersionCommand(cmd string) bool {
+	return cmd == "VERSION" || cmd == "zVERSION" || cmd == "nVERSION"
+}
@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestVersionCache(t *testing.T) {
+	var fetches atomic.Int32
+	now := time.Unix(1700000000, 0)
+	var nowMu sync.Mutex
+	cache := &versionCache{
+		fetch: func() (string, error) {
+			return fmt.Sprintf("ClamAV 1.4.%d", fetches.Add(1)), nil
+		},
+		now: func() time.Time {
+			nowMu.Lock()
+			defer nowMu.Unlock()
+			return now
+		},
+		logger: newTestProxy(t).logger,
+	}
+
+	if reply, ok := cache.get(time.Minute); !ok || reply != "ClamAV 1.4.1" {
+		t.Fatalf("Expected the fetched reply, got %q, %v", reply, ok)
+	}
+	if reply, _ := cache.get(time.Minute); reply != "ClamAV 1.4.1" || fetches.Load() != 1 {
+		t.Errorf("Expected the cached reply without a fetch, got %q after %d fetches", reply, fetches.Load())
+	}
+
+	// Once stale, the old reply is served while it is refreshed
+	nowMu.Lock()
+	now = now.Add(time.Minute)
+	nowMu.Unlock()
+	if reply, _ := cache.get(time.Minute); reply != "ClamAV 1.4.1" {
+		t.Errorf("Expected the stale reply during the refresh, got %q", reply)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if reply, _ := cache.get(time.Minute); reply == "ClamAV 1.4.2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the reply to be refreshed in the background")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := fetches.Load(); n != 2 {
+		t.Errorf("Expected 2 fetches, got %d", n)
+	}
+}
+
+func TestVersionCacheFetchFailure(t *testing.T) {
+	cache := &versionCache{
+		fetch:  func() (string, error) { return "", errors.New("connection refused") },
+		now:    time.Now,
+		logger: newTestProxy(t).logger,
+	}
+	if reply, ok := cache.get(time.Minute); ok {
+		t.Errorf("Expected no reply when the fetch fails, got %q", reply)
+	}
+}
+
+func TestCachedVersionSkipsBackend(t *testing.T) {
+	srv := newTestProxy(t, func(c *Config) { c.VersionCacheTTL = time.Minute })
+
+	const version = "ClamAV 1.4.0/27000/Mon Jan  1 00:00:00 2024"
+
+	// Fake clamd answering zVERSION, counting connections
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			cmd := make([]byte, len("zVERSION\x00"))
+			if _, err := io.ReadFull(conn, cmd); err == nil {
+				_, _ = conn.Write([]byte(version + "\x00"))
+			}
+			conn.Close()
+		}
+	}()
+
+	clientSide, proxyClient := net.Pipe()
+	defer clientSide.Close()
+
+	dials := 0
+	p := srv.NewDeferredClamdProxy(proxyClient, func() (net.Conn, error) {
+		dials++
+		return nil, errors.New("unexpected dial")
+	})
+	p.versionCache = srv.versionCacheFor([]string{listener.Addr().String()})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Start()
+	}()
+
+	for _, tc := range []struct{ command, expected string }{
+		{"zVERSION\x00", version + "\x00"},
+		{"nVERSION\n", version + "\n"},
+		{"VERSION\n", version + "\n"},
+	} {
+		if _, err := clientSide.Write([]byte(tc.command)); err != nil {
+			t.Fatalf("Failed to send %q: %v", tc.command, err)
+		}
+		reply := make([]byte, len(tc.expected))
+		if _, err := io.ReadFull(clientSide, reply); err != nil {
+			t.Fatalf("Failed to read reply to %q: %v", tc.command, err)
+		}
+		if string(reply) != tc.expected {
+			t.Errorf("Expected %q, got %q", tc.expected, reply)
+		}
+	}
+	_ = clientSide.Close()
+	<-done
+
+	if dials != 0 {
+		t.Errorf("Expected no backend connection for the client, got %d", dials)
+	}
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("Expected a single fetch from the backend, got %d", n)
+	}
+}
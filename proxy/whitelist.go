@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// allowedRule returns the rule for name if it is in the current whitelist
+func (p *Proxy) allowedRule(name string) (commandRule, bool) {
+	p.allowedMu.RLock()
+	defer p.allowedMu.RUnlock()
+	rule, ok := p.allowed[name]
+	return rule, ok
+}
+
+// setAllowedCommands replaces the whitelist
+func (p *Proxy) setAllowedCommands(set map[string]commandRule) {
+	p.allowedMu.Lock()
+	defer p.allowedMu.Unlock()
+	p.allowed = set
+}
+
+// loadWhitelist reads a whitelist file containing one command name per line.
+// Only path commands such as SCAN may carry arguments, unless the name is
+// followed by "*" (e.g. "STATS *"). Names are upper-cased if upper is set,
+// for --case-insensitive. Blank lines and lines starting with # are ignored.
+func loadWhitelist(path string, upper bool) (map[string]commandRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	set := make(map[string]commandRule)
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if upper {
+			fields[0] = strings.ToUpper(fields[0])
+		}
+		rule := defaultRule(fields[0])
+		switch {
+		case len(fields) == 2 && fields[1] == "*":
+			rule.args = true
+		case len(fields) != 1:
+			return nil, fmt.Errorf("%s:%d: expected a command name, optionally followed by *, got %q", path, lineNo, line)
+		}
+		set[fields[0]] = rule
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(set) == 0 {
+		return nil, fmt.Errorf("%s: no commands listed", path)
+	}
+	return set, nil
+}
+
+// reloadWhitelist re-reads the --whitelist file and swaps it in. On failure
+// the previously loaded whitelist stays in effect and the error is returned.
+func (p *Proxy) reloadWhitelist() error {
+	set, err := loadWhitelist(p.cfg.Whitelist, p.cfg.CaseInsensitive)
+	if err != nil {
+		p.logger.Error("Failed to reload whitelist, keeping the previous one",
+			"file", p.cfg.Whitelist,
+			"error", err)
+		return err
+	}
+	p.setAllowedCommands(set)
+	p.logger.Warn("Reloaded whitelist", "file", p.cfg.Whitelist, "commands", len(set))
+	return nil
+}
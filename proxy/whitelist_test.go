@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadWhitelist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "whitelist")
+	if err := os.WriteFile(path, []byte("# health checks\nPING\n\n  INSTREAM  \nSCAN\nSTATS *\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	set, err := loadWhitelist(path, false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := map[string]commandRule{
+		"PING":     {},
+		"INSTREAM": {},
+		"SCAN":     {args: true}, // Path commands take arguments by default
+		"STATS":    {args: true},
+	}
+	if !reflect.DeepEqual(set, expected) {
+		t.Errorf("Expected whitelist %v, got %v", expected, set)
+	}
+}
+
+// isListed reports whether name is in the current whitelist of srv
+func isListed(srv *Proxy, name string) bool {
+	_, ok := srv.allowedRule(name)
+	return ok
+}
+
+func TestReloadWhitelistKeepsPreviousOnError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "whitelist")
+	srv := newTestProxy(t)
+	srv.cfg.Whitelist = path
+
+	if err := os.WriteFile(path, []byte("PING\nSTATS\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.reloadWhitelist(); err != nil {
+		t.Fatalf("Expected the whitelist to reload, got %v", err)
+	}
+	if !isListed(srv, "STATS") || isListed(srv, "INSTREAM") {
+		t.Fatalf("Expected the reloaded whitelist to be in effect")
+	}
+
+	// A broken file must not replace the working whitelist
+	if err := os.WriteFile(path, []byte("SCAN /etc\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.reloadWhitelist(); err == nil {
+		t.Error("Expected an error for the broken file")
+	}
+	if !isListed(srv, "STATS") || isListed(srv, "SCAN") {
+		t.Errorf("Expected the previous whitelist to be kept after a failed reload")
+	}
+}
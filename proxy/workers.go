@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"context"
+	"net"
+)
+
+// acceptedConn is a connection waiting for a worker, with the address of the
+// listener that accepted it
+type acceptedConn struct {
+	conn     net.Conn
+	listener string
+}
+
+// startWorkers starts n workers that handle connections from a queue holding
+// up to queueSize connections waiting for a free worker. Connections are
+// handled within ctx.
+func (p *Proxy) startWorkers(ctx context.Context, n, queueSize int) {
+	p.connQueue = make(chan acceptedConn, queueSize)
+	for i := 0; i < n; i++ {
+		go func() {
+			for accepted := range p.connQueue {
+				p.handleConnection(ctx, accepted.conn, accepted.listener)
+			}
+		}()
+	}
+	p.logger.Info("Started worker pool", "workers", n, "queue", queueSize)
+}
+
+// stopWorkers ends the worker pool, if there is one, once the accept loops
+// have stopped and the queue is empty
+func (p *Proxy) stopWorkers() {
+	if p.connQueue == nil {
+		return
+	}
+	close(p.connQueue)
+	p.connQueue = nil
+}
+
+// dispatchConnection hands an accepted connection to the worker pool, or to a
+// new goroutine if the pool is disabled. When all workers are busy and the
+// queue is full the connection is rejected by closing it, rather than letting
+// the backlog grow without bound. Without the pool the connection is handled
+// within ctx; pooled workers use the context given to startWorkers. listener
+// is the address of the listener that accepted conn.
+func (p *Proxy) dispatchConnection(ctx context.Context, conn net.Conn, listener string) {
+	p.activeConns.Add(1)
+	if p.connQueue == nil {
+		go p.handleConnection(ctx, conn, listener)
+		return
+	}
+
+	select {
+	case p.connQueue <- acceptedConn{conn, listener}:
+	default:
+		p.activeConns.Done()
+		p.metrics.connectionsRejected.Add(1)
+		p.logger.Warn("Worker queue full, rejecting connection",
+			"client", conn.RemoteAddr().String(),
+			"listener", listener,
+			"queue", cap(p.connQueue))
+		if err := conn.Close(); err != nil {
+			p.logger.Debug("Error closing rejected connection", "error", err)
+		}
+	}
+}
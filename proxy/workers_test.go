@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDispatchConnectionQueueFull(t *testing.T) {
+	srv := newTestProxy(t)
+	srv.connQueue = make(chan acceptedConn, 1)
+
+	queuedClient, queued := net.Pipe()
+	rejectedClient, rejected := net.Pipe()
+	defer func() {
+		_ = queuedClient.Close()
+		_ = queued.Close()
+		_ = rejectedClient.Close()
+	}()
+
+	srv.dispatchConnection(context.Background(), queued, "test")
+	srv.dispatchConnection(context.Background(), rejected, "test")
+
+	if got := <-srv.connQueue; got.conn != queued || got.listener != "test" {
+		t.Errorf("Expected the first connection to be queued")
+	}
+	if got := srv.metrics.connectionsRejected.Load(); got != 1 {
+		t.Errorf("Expected 1 rejected connection, got %d", got)
+	}
+
+	// The rejected connection must have been closed
+	_ = rejectedClient.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := rejectedClient.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected EOF on rejected connection, got %v", err)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/miklosn/clamdproxy/proxy"
+)
+
+// notifyShutdown returns a channel that is closed on the first SIGINT or SIGTERM
+func notifyShutdown() <-chan struct{} {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	done := make(chan struct{})
+	go func() {
+		sig := <-signals
+		signal.Stop(signals)
+		logger.Warn("Shutting down", "signal", sig.String())
+		close(done)
+	}()
+	return done
+}
+
+// watchWhitelistReload reloads the whitelist whenever the process receives SIGHUP
+func watchWhitelistReload(p *proxy.Proxy) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			_ = p.ReloadWhitelist() // Logged by the proxy
+		}
+	}()
+}
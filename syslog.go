@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+)
+
+// syslogWriter is the subset of *syslog.Writer used for logging, one method
+// per syslog severity
+type syslogWriter interface {
+	Debug(m string) error
+	Info(m string) error
+	Warning(m string) error
+	Err(m string) error
+}
+
+// syslogHandler is a slog.Handler that formats records with the text or JSON
+// handler and sends each one to syslog at the severity matching its level
+type syslogHandler struct {
+	w      syslogWriter
+	format string
+	opts   *slog.HandlerOptions
+	ops    []func(slog.Handler) slog.Handler // WithAttrs/WithGroup calls, replayed per record
+}
+
+// newSyslogHandler returns a handler writing records in the given format to w
+func newSyslogHandler(w syslogWriter, format string, level slog.Leveler) *syslogHandler {
+	return &syslogHandler{
+		w:      w,
+		format: format,
+		opts: &slog.HandlerOptions{
+			Level: level,
+			// syslog stamps every message itself
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				if len(groups) == 0 && a.Key == slog.TimeKey {
+					return slog.Attr{}
+				}
+				return a
+			},
+		},
+	}
+}
+
+// Enabled applies the configured log level
+func (h *syslogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.opts.Level.Level()
+}
+
+// Handle formats r and writes it to syslog
+func (h *syslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	var inner slog.Handler
+	if h.format == "json" {
+		inner = slog.NewJSONHandler(&buf, h.opts)
+	} else {
+		inner = slog.NewTextHandler(&buf, h.opts)
+	}
+	for _, op := range h.ops {
+		inner = op(inner)
+	}
+	if err := inner.Handle(ctx, r); err != nil {
+		return err
+	}
+
+	msg := strings.TrimSuffix(buf.String(), "\n")
+	switch {
+	case r.Level >= slog.LevelError:
+		return h.w.Err(msg)
+	case r.Level >= slog.LevelWarn:
+		return h.w.Warning(msg)
+	case r.Level >= slog.LevelInfo:
+		return h.w.Info(msg)
+	default:
+		return h.w.Debug(msg)
+	}
+}
+
+// WithAttrs returns a handler that adds attrs to every record
+func (h *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(inner slog.Handler) slog.Handler { return inner.WithAttrs(attrs) })
+}
+
+// WithGroup returns a handler that nests later attributes under name
+func (h *syslogHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(inner slog.Handler) slog.Handler { return inner.WithGroup(name) })
+}
+
+func (h *syslogHandler) with(op func(slog.Handler) slog.Handler) *syslogHandler {
+	clone := *h
+	clone.ops = append(h.ops[:len(h.ops):len(h.ops)], op)
+	return &clone
+}
@@ -0,0 +1,10 @@
+//go:build windows || plan9
+
+package main
+
+import "errors"
+
+// openSyslog always fails: log/syslog isn't available on this platform
+func openSyslog(_, _ string) (syslogWriter, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// fakeSyslog records the messages written at each severity
+type fakeSyslog struct {
+	messages []string
+}
+
+func (f *fakeSyslog) record(severity, m string) error {
+	f.messages = append(f.messages, severity+" "+m)
+	return nil
+}
+
+func (f *fakeSyslog) Debug(m string) error   { return f.record("debug", m) }
+func (f *fakeSyslog) Info(m string) error    { return f.record("info", m) }
+func (f *fakeSyslog) Warning(m string) error { return f.record("warning", m) }
+func (f *fakeSyslog) Err(m string) error     { return f.record("err", m) }
+
+func TestSyslogHandler(t *testing.T) {
+	w := &fakeSyslog{}
+	log := slog.New(newSyslogHandler(w, "text", slog.LevelInfo))
+
+	log.Debug("Filtered out")
+	log.Info("Connected", "conn_id", "abc")
+	log.With("client", "1.2.3.4").Warn("Blocked")
+	log.WithGroup("scan").Error("Failed", "result", "ERROR")
+
+	want := []string{
+		`info level=INFO msg=Connected conn_id=abc`,
+		`warning level=WARN msg=Blocked client=1.2.3.4`,
+		`err level=ERROR msg=Failed scan.result=ERROR`,
+	}
+	if len(w.messages) != len(want) {
+		t.Fatalf("got %d messages %q, want %d", len(w.messages), w.messages, len(want))
+	}
+	for i, msg := range w.messages {
+		if msg != want[i] {
+			t.Errorf("message %d = %q, want %q", i, msg, want[i])
+		}
+	}
+}
+
+func TestSyslogHandlerJSON(t *testing.T) {
+	w := &fakeSyslog{}
+	slog.New(newSyslogHandler(w, "json", slog.LevelDebug)).Debug("Retrying", "attempt", 2)
+
+	if len(w.messages) != 1 {
+		t.Fatalf("got %d messages, want 1", len(w.messages))
+	}
+	if want := `debug {"level":"DEBUG","msg":"Retrying","attempt":2}`; w.messages[0] != want {
+		t.Errorf("message = %q, want %q", w.messages[0], want)
+	}
+}
+
+func TestGetLoggerSyslogErrors(t *testing.T) {
+	saved := cli.SyslogFacility
+	defer func() { cli.SyslogFacility = saved }()
+	cli.SyslogFacility = "bogus"
+
+	if _, err := getLogger("info", "text", "syslog"); err == nil || !strings.Contains(err.Error(), "syslog") {
+		t.Errorf("getLogger with bad facility: err = %v, want syslog error", err)
+	}
+	if _, err := getLogger("info", "text", "file"); err == nil {
+		t.Error("getLogger with unknown output: expected error")
+	}
+}
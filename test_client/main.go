@@ -9,19 +9,31 @@ import (
 	"net"
 	"os"
 	"strings"
-	"text/tabwriter"
 	"time"
 )
 
 var (
-	proxyAddr string
-	timeout   int
+	proxyAddr    string
+	timeout      int
+	replayFile   string
+	replayFast   bool
+	scanFile     string
+	outputFormat string
 )
 
 func init() {
 	flag.StringVar(&proxyAddr, "proxy", "127.0.0.1:3310", "Address of the clamdproxy server")
 	flag.IntVar(&timeout, "timeout", 5, "Timeout in seconds for command responses")
+	flag.StringVar(&replayFile, "replay", "", "Replay a recorded session transcript instead of running the self-test")
+	flag.BoolVar(&replayFast, "replay-fast", false, "Replay the transcript as fast as possible, ignoring the recorded timing")
+	flag.StringVar(&scanFile, "file", "", "Scan this file via INSTREAM and print the verdict instead of running the self-test")
+	flag.StringVar(&outputFormat, "output", "table", "Self-test output format: table or json")
 	flag.Parse()
+
+	if outputFormat != "table" && outputFormat != "json" {
+		fmt.Printf("Invalid --output %q: must be table or json\n", outputFormat)
+		os.Exit(2)
+	}
 }
 
 // Commands to test, grouped by expected behavior
@@ -47,80 +59,31 @@ var (
 )
 
 func main() {
-	fmt.Printf("Testing clamdproxy at %s (timeout: %ds)\n\n", proxyAddr, timeout)
-
-	// Create a tabwriter for formatted output
-	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-
-	// Print table headers
-	if _, err := fmt.Fprintln(w, "Command\tStatus\tResponse"); err != nil {
-		fmt.Printf("Error writing to output: %v\n", err)
-		return
+	if replayFile != "" {
+		os.Exit(runReplay(replayFile))
 	}
-	if _, err := fmt.Fprintln(w, "-------\t------\t--------"); err != nil {
-		fmt.Printf("Error writing to output: %v\n", err)
-		return
+	if scanFile != "" {
+		os.Exit(runScanFile(scanFile))
 	}
 
-	// Test allowed commands
-	if _, err := fmt.Fprintln(w, "=== Allowed Commands ===\t\t"); err != nil {
-		fmt.Printf("Error writing to output: %v\n", err)
-		return
-	}
-	for _, cmd := range allowedCommands {
-		// Skip INSTREAM commands for now, we'll test them separately
-		if strings.Contains(cmd, "INSTREAM") {
-			continue
-		}
-		status, response := testCommand(cmd)
-		if _, err := fmt.Fprintf(w, "%s\t%s\t%s\n", cmd, status, formatResponse(response)); err != nil {
-			fmt.Printf("Error writing to output: %v\n", err)
-			return
-		}
-	}
+	results := runSelfTest()
 
-	if _, err := fmt.Fprintln(w, "\n=== Blocked Commands ===\t\t"); err != nil {
-		fmt.Printf("Error writing to output: %v\n", err)
-		return
+	var err error
+	switch outputFormat {
+	case "json":
+		err = writeJSON(os.Stdout, results)
+	default:
+		fmt.Printf("Testing clamdproxy at %s (timeout: %ds)\n\n", proxyAddr, timeout)
+		err = writeTable(os.Stdout, results)
 	}
-	for _, cmd := range disallowedCommands {
-		status, response := testCommand(cmd)
-		if _, err := fmt.Fprintf(w, "%s\t%s\t%s\n", cmd, status, formatResponse(response)); err != nil {
-			fmt.Printf("Error writing to output: %v\n", err)
-			return
-		}
-	}
-
-	if _, err := fmt.Fprintln(w, "\n=== Special Commands ===\t\t"); err != nil {
-		fmt.Printf("Error writing to output: %v\n", err)
-		return
-	}
-	status, response := testInstream()
-	if _, err := fmt.Fprintf(w, "INSTREAM (EICAR test)\t%s\t%s\n", status, formatResponse(response)); err != nil {
-		fmt.Printf("Error writing to output: %v\n", err)
-		return
-	}
-
-	// Add a connection test
-	if _, err := fmt.Fprintln(w, "\n=== Connection Test ===\t\t"); err != nil {
+	if err != nil {
 		fmt.Printf("Error writing to output: %v\n", err)
-		return
-	}
-	if isBackendReachable() {
-		if _, err := fmt.Fprintln(w, "Backend connection\tOK\tBackend server is reachable"); err != nil {
-			fmt.Printf("Error writing to output: %v\n", err)
-			return
-		}
-	} else {
-		if _, err := fmt.Fprintln(w, "Backend connection\tFAIL\tCannot reach backend server"); err != nil {
-			fmt.Printf("Error writing to output: %v\n", err)
-			return
-		}
+		os.Exit(2)
 	}
 
-	// Flush the tabwriter
-	if err := w.Flush(); err != nil {
-		fmt.Printf("Error flushing output: %v\n", err)
+	// Fail if an allowed command didn't get through or a blocked one did
+	if !allPassed(results) {
+		os.Exit(1)
 	}
 }
 
@@ -179,7 +142,7 @@ func testCommand(cmd string) (string, string) {
 	response := string(buffer[:n])
 	
 	// Check for error responses
-	if strings.HasPrefix(response, "ERROR") {
+	if strings.HasPrefix(response, "ERROR") || strings.HasPrefix(response, "UNKNOWN COMMAND") {
 		return "BLOCKED", response
 	}
 	
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// testResult is the outcome of a single self-test check
+type testResult struct {
+	Section  string `json:"section"`
+	Command  string `json:"command"`
+	Status   string `json:"status"`
+	Response string `json:"response"`
+	Passed   bool   `json:"passed"`
+}
+
+// Self-test sections, in output order
+const (
+	sectionAllowed    = "Allowed Commands"
+	sectionBlocked    = "Blocked Commands"
+	sectionSpecial    = "Special Commands"
+	sectionConnection = "Connection Test"
+)
+
+// runSelfTest runs every check against the proxy. An allowed command passes
+// if the backend answered it and a blocked command passes as long as it
+// wasn't forwarded.
+func runSelfTest() []testResult {
+	var results []testResult
+
+	for _, cmd := range allowedCommands {
+		// Skip INSTREAM commands for now, we'll test them separately
+		if strings.Contains(cmd, "INSTREAM") {
+			continue
+		}
+		status, response := testCommand(cmd)
+		results = append(results, testResult{sectionAllowed, cmd, status, response, status == "OK"})
+	}
+
+	for _, cmd := range disallowedCommands {
+		status, response := testCommand(cmd)
+		results = append(results, testResult{sectionBlocked, cmd, status, response, status != "OK"})
+	}
+
+	status, response := testInstream()
+	results = append(results, testResult{sectionSpecial, "INSTREAM (EICAR test)", status, response,
+		status == "VIRUS" || status == "OK"})
+
+	if isBackendReachable() {
+		results = append(results, testResult{sectionConnection, "Backend connection", "OK", "Backend server is reachable", true})
+	} else {
+		results = append(results, testResult{sectionConnection, "Backend connection", "FAIL", "Cannot reach backend server", false})
+	}
+
+	return results
+}
+
+// allPassed reports whether every check passed
+func allPassed(results []testResult) bool {
+	for _, r := range results {
+		if !r.Passed {
+			return false
+		}
+	}
+	return true
+}
+
+// writeJSON writes the results as a JSON array
+func writeJSON(w io.Writer, results []testResult) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(results)
+}
+
+// writeTable writes the results as the human-readable table, grouped by section
+func writeTable(w io.Writer, results []testResult) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	if _, err := fmt.Fprintln(tw, "Command\tStatus\tResponse"); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(tw, "-------\t------\t--------"); err != nil {
+		return err
+	}
+
+	section := ""
+	for _, r := range results {
+		if r.Section != section {
+			separator := "\n"
+			if section == "" {
+				separator = ""
+			}
+			section = r.Section
+			if _, err := fmt.Fprintf(tw, "%s=== %s ===\t\t\n", separator, section); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Command, r.Status, formatResponse(r.Response)); err != nil {
+			return err
+		}
+	}
+
+	return tw.Flush()
+}
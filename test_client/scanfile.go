@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// scanChunkSize is the INSTREAM chunk size used when streaming a file
+const scanChunkSize = 32 * 1024
+
+// runScanFile streams a file to the proxy with INSTREAM and prints the
+// verdict. Like clamdscan, it returns 0 if the file is clean, 1 if a virus
+// was found and 2 on any error.
+func runScanFile(path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Printf("Cannot read file to scan: %v\n", err)
+		return 2
+	}
+	defer func() {
+		if err := f.Close(); err != nil {
+			fmt.Printf("Error closing file: %v\n", err)
+		}
+	}()
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		fmt.Printf("Connection failed: %v\n", err)
+		return 2
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			fmt.Printf("Error closing connection: %v\n", err)
+		}
+	}()
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		fmt.Printf("Send failed: %v\n", err)
+		return 2
+	}
+
+	sent, err := streamFile(conn, f)
+	if err != nil {
+		fmt.Printf("Streaming %s failed after %d bytes: %v\n", path, sent, err)
+		return 2
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(time.Duration(timeout) * time.Second)); err != nil {
+		fmt.Printf("Failed to set deadline: %v\n", err)
+		return 2
+	}
+	response, err := io.ReadAll(conn)
+	if err != nil && len(response) == 0 {
+		fmt.Printf("Read failed: %v\n", err)
+		return 2
+	}
+
+	verdict := strings.TrimRight(string(response), "\x00\n")
+	fmt.Printf("%s: %s\n", path, verdict)
+	switch {
+	case strings.HasSuffix(verdict, " FOUND"):
+		return 1
+	case strings.HasSuffix(verdict, ": OK"):
+		return 0
+	default:
+		return 2
+	}
+}
+
+// streamFile sends the contents of r as INSTREAM chunks followed by the
+// terminating zero-length chunk and returns the number of payload bytes sent
+func streamFile(w io.Writer, r io.Reader) (int64, error) {
+	buf := make([]byte, 4+scanChunkSize)
+	var sent int64
+
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(n))
+			if _, werr := w.Write(buf[:4+n]); werr != nil {
+				return sent, werr
+			}
+			sent += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return sent, err
+		}
+	}
+
+	_, err := w.Write([]byte{0, 0, 0, 0})
+	return sent, err
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// Build information, set at link time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.date=..."
+// (goreleaser does this by default)
+var (
+	version = ""
+	commit  = ""
+	date    = ""
+)
+
+// versionString describes the running build. Values not injected at link
+// time are taken from the module and VCS information embedded by the Go
+// toolchain, if any.
+func versionString() string {
+	v, c, d := version, commit, date
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v == "" && info.Main.Version != "" {
+			v = info.Main.Version
+		}
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && c == "":
+				c = s.Value
+			case s.Key == "vcs.time" && d == "":
+				d = s.Value
+			}
+		}
+	}
+	return formatVersion(v, c, d)
+}
+
+// formatVersion renders build information as "<version> (commit <c>, built <d>)",
+// using "unknown" for missing values
+func formatVersion(v, c, d string) string {
+	if v == "" {
+		v = "dev"
+	}
+	if c == "" {
+		c = "unknown"
+	}
+	if d == "" {
+		d = "unknown"
+	}
+	return fmt.Sprintf("%s (commit %s, built %s)", v, c, d)
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestFormatVersion(t *testing.T) {
+	tests := []struct {
+		version, commit, date string
+		expected              string
+	}{
+		{"1.2.3", "abc123", "2024-01-02T03:04:05Z", "1.2.3 (commit abc123, built 2024-01-02T03:04:05Z)"},
+		{"", "", "", "dev (commit unknown, built unknown)"},
+		{"v0.1.0", "", "", "v0.1.0 (commit unknown, built unknown)"},
+	}
+
+	for _, test := range tests {
+		got := formatVersion(test.version, test.commit, test.date)
+		if got != test.expected {
+			t.Errorf("Expected %q, got %q", test.expected, got)
+		}
+	}
+}
+
+func TestVersionStringPrefersLinkerValues(t *testing.T) {
+	oldVersion, oldCommit, oldDate := version, commit, date
+	defer func() { version, commit, date = oldVersion, oldCommit, oldDate }()
+
+	version, commit, date = "1.0.0", "deadbeef", "2024-05-06"
+	expected := "1.0.0 (commit deadbeef, built 2024-05-06)"
+	if got := versionString(); got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+}